@@ -0,0 +1,11 @@
+package main
+
+import (
+	"testing"
+)
+
+// TestFlags checks if there are flag duplication, which will cause application
+// panic during startup, and is not detected during compile stage.
+func TestFlags(t *testing.T) {
+	_ = main
+}
@@ -7,6 +7,7 @@ import (
 	"flag"
 	"fmt"
 	"io"
+	"net"
 	"os"
 	"path"
 	"path/filepath"
@@ -21,6 +22,9 @@ import (
 	api "k8s.io/api/core/v1"
 
 	"github.com/binchencoder/letsgo"
+	pb "github.com/binchencoder/skylb-api/proto"
+	"github.com/binchencoder/skylb/hub"
+	"github.com/binchencoder/skylb/hub/util"
 )
 
 const (
@@ -37,8 +41,6 @@ type service struct {
 }
 
 var (
-	etcdEndpoints = flag.String("etcd-endpoints", "", "Comma separated etcd endpoints")
-
 	line     *liner.State
 	commands = map[string]string{
 		"?":        "Show this help",
@@ -51,6 +53,7 @@ var (
 		"rm":       "Delete an instance for the current service",
 		"portname": "Display or set port name",
 		"select":   "Select a service to manage or reset to not manage any service",
+		"weight":   "Change the weight of an instance for the current service",
 	}
 	cmds []string
 
@@ -97,7 +100,7 @@ Options:`)
 }
 
 func checkFlags() {
-	if *etcdEndpoints == "" {
+	if *hub.EtcdEndpoints == "" {
 		fmt.Println("flag --etcd-endpoints is required")
 		os.Exit(2)
 	}
@@ -116,6 +119,9 @@ func main() {
 		fmt.Printf("Error, %s.\n", err.Error())
 		return
 	}
+	// The weights are changed through the registry selected by flag
+	// --registry-backend, the same way the hub changes them.
+	reg := hub.CreateRegistry()
 
 	for {
 		if cmd, err := line.Prompt(prompt); err == nil {
@@ -144,6 +150,8 @@ func main() {
 				fmt.Printf("\tCurrent port name: %s\n", portName)
 			case "rm":
 				fmt.Println("\tusage: rm <index>")
+			case "weight":
+				fmt.Println("\tusage: weight <index> <weight>")
 			case "select":
 				fmt.Println("\t Reset. Not managing any service. To select a service to manage, run \"select <number>\"")
 				prompt = defaultPromp
@@ -162,6 +170,8 @@ func main() {
 					deleteInstance(cli, cmd[3:])
 				} else if strings.HasPrefix(cmd, "select ") {
 					selectService(cli, cmd[7:])
+				} else if strings.HasPrefix(cmd, "weight ") {
+					setWeight(reg, cmd[7:])
 				} else if strings.HasPrefix(cmd, "portname ") {
 					setPortname(cli, cmd[9:])
 				} else {
@@ -314,6 +324,52 @@ func deleteInstance(cli etcd.KeysAPI, param string) {
 	}
 }
 
+func setWeight(reg hub.Registry, param string) {
+	if currentService == nil {
+		fmt.Println("No service is selected.")
+		return
+	}
+
+	params := strings.Fields(param)
+	if len(params) != 2 {
+		fmt.Println("\tTwo parameters are expected: index weight")
+		return
+	}
+	idx, err := strconv.Atoi(params[0])
+	if err != nil {
+		fmt.Printf("\tError, %s.\n", err.Error())
+		return
+	}
+	weight, err := strconv.Atoi(params[1])
+	if err != nil || weight < 0 {
+		fmt.Println("\tError, valid weight is required.")
+		return
+	}
+
+	if idx < 0 || idx >= len(currentService.endpoints) {
+		fmt.Println("\tIndex exceeds limit. Use \"ls\" to list all endpoints.")
+		return
+	}
+
+	ep := currentService.endpoints[idx]
+	host, port, err := net.SplitHostPort(ep)
+	if err != nil {
+		fmt.Printf("\tError, %s.\n", err.Error())
+		return
+	}
+	portNum, _ := strconv.Atoi(port)
+	spec := pb.ServiceSpec{
+		Namespace:   currentService.namespace,
+		ServiceName: currentService.name,
+		PortName:    portName,
+	}
+	if err := hub.SetEndpointWeight(context.Background(), reg, &spec, host, int32(portNum), int32(weight)); err != nil {
+		fmt.Printf("\tFailed to change the weight of instance %s: %v.\n", ep, err)
+		return
+	}
+	fmt.Println("\tDone.")
+}
+
 func listServices(cli etcd.KeysAPI) {
 	resp, err := cli.Get(context.Background(), prefix, &getOpts)
 	if err != nil {
@@ -380,7 +436,7 @@ func listInstances(cli etcd.KeysAPI) {
 		for _, sub := range eps.Subsets {
 			for k, port := range sub.Ports {
 				if port.Name == portName {
-					fmt.Printf("\t%d: %s:%d %s\n", cnt, sub.Addresses[k].IP, port.Port, ttl)
+					fmt.Printf("\t%d: %s:%d %s%s\n", cnt, sub.Addresses[k].IP, port.Port, ttl, formatMetadata(&eps, sub.Addresses[k].IP, port.Port))
 					currentService.endpoints = append(currentService.endpoints, fmt.Sprintf("%s:%d", sub.Addresses[k].IP, port.Port))
 					cnt++
 					break
@@ -394,6 +450,16 @@ func listInstances(cli etcd.KeysAPI) {
 	fmt.Printf("\tFound %d instances in total.\n", cnt)
 }
 
+// formatMetadata formats the metadata which the instance registered in the
+// labels, as " {key=value,...}" sorted by key, or "" if none.
+func formatMetadata(eps *api.Endpoints, host string, port int32) string {
+	md := util.EndpointMetadata(eps, host, port)
+	if len(md) == 0 {
+		return ""
+	}
+	return fmt.Sprintf(" {%s}", util.FormatMetadata(md))
+}
+
 func selectService(cli etcd.KeysAPI, svcNum string) {
 	num, err := strconv.Atoi(svcNum)
 	if err != nil {
@@ -416,8 +482,8 @@ func setPortname(cli etcd.KeysAPI, pn string) {
 }
 
 func createEtcdClient() (etcd.KeysAPI, error) {
-	eps := strings.Split(*etcdEndpoints, ",")
-	if *etcdEndpoints == "" || len(eps) == 0 {
+	eps := strings.Split(*hub.EtcdEndpoints, ",")
+	if *hub.EtcdEndpoints == "" || len(eps) == 0 {
 		return nil, errors.New("flag --etcd-endpoints is required")
 	}
 
@@ -0,0 +1,76 @@
+// skylb-migrate copies the SkyLB keyspace from an etcd v2 store to an
+// etcd v3 store, so that SkyLB can be switched to --registry-backend=etcd3.
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+
+	"github.com/golang/glog"
+
+	"github.com/binchencoder/letsgo"
+	"github.com/binchencoder/letsgo/strings"
+)
+
+var (
+	v2EtcdEndpoints = flag.String("v2-etcd-endpoints", "", "The etcd endpoints to read the v2 keyspace from")
+	v3EtcdEndpoints = flag.String("v3-etcd-endpoints", "", "The etcd endpoints to write the v3 keyspace to")
+
+	dryRun  = flag.Bool("dry-run", false, "Print the diff between the v2 and v3 keyspaces without writing anything")
+	verify  = flag.Bool("verify", false, "Compare the v2 and v3 keyspaces key by key, exit with status 1 if they differ")
+	rewrite = flag.Bool("rewrite-graph-timestamps", true, "Rewrite the service graph timestamps to the migration time")
+)
+
+func usage() {
+	fmt.Println(`SkyLB Migrate: copy the SkyLB keyspace from etcd v2 to etcd v3.
+
+Usage:
+	skylb-migrate [options]
+
+Options:`)
+
+	flag.PrintDefaults()
+	os.Exit(2)
+}
+
+func checkFlags() {
+	if *v2EtcdEndpoints == "" {
+		glog.Fatalf("Flag --v2-etcd-endpoints is required.")
+	}
+	if *v3EtcdEndpoints == "" {
+		*v3EtcdEndpoints = *v2EtcdEndpoints
+	}
+	if *dryRun && *verify {
+		glog.Fatalf("Flags --dry-run and --verify can not be used together.")
+	}
+}
+
+func main() {
+	letsgo.Init(letsgo.FlagUsage(usage))
+	checkFlags()
+
+	glog.Infof("V2 etcd endpoints: %s", *v2EtcdEndpoints)
+	glog.Infof("V3 etcd endpoints: %s", *v3EtcdEndpoints)
+
+	m, err := newMigrator(strings.CsvToSlice(*v2EtcdEndpoints), strings.CsvToSlice(*v3EtcdEndpoints))
+	if err != nil {
+		glog.Fatalf("Failed to connect to etcd, %v", err)
+	}
+	defer m.close()
+
+	switch {
+	case *dryRun:
+		err = m.dryRun(os.Stdout)
+	case *verify:
+		var ok bool
+		if ok, err = m.verify(os.Stdout); err == nil && !ok {
+			os.Exit(1)
+		}
+	default:
+		err = m.migrate(os.Stdout)
+	}
+	if err != nil {
+		glog.Fatalf("Failed to migrate, %v", err)
+	}
+}
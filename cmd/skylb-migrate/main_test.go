@@ -0,0 +1,251 @@
+package main
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+	"time"
+
+	etcd "github.com/coreos/etcd/client"
+	. "github.com/smartystreets/goconvey/convey"
+	"github.com/stretchr/testify/mock"
+	"go.etcd.io/etcd/api/v3/mvccpb"
+	clientv3 "go.etcd.io/etcd/client/v3"
+	"golang.org/x/net/context"
+
+	mocks "github.com/binchencoder/letsgo/testing/mocks/etcd"
+)
+
+const (
+	epKey1   = "/registry/services/endpoints/default/service1/172.0.10.1_8080"
+	epKey2   = "/registry/services/endpoints/default/service1/172.0.10.2_8080"
+	graphKey = "/skylb/graph/default/service1/clients/caller1"
+)
+
+// fakeV3 keeps the etcd v3 keyspace in memory. A key put with any option
+// is taken as attached to a lease, since migrator passes no other option.
+type fakeV3 struct {
+	clientv3.KV
+	clientv3.Lease
+
+	kvs    map[string]*mvccpb.KeyValue
+	puts   int
+	grants []int64
+}
+
+func newFakeV3() *fakeV3 {
+	return &fakeV3{
+		kvs: map[string]*mvccpb.KeyValue{},
+	}
+}
+
+func (f *fakeV3) Get(ctx context.Context, key string, opts ...clientv3.OpOption) (*clientv3.GetResponse, error) {
+	resp := &clientv3.GetResponse{}
+	for k, kv := range f.kvs {
+		if strings.HasPrefix(k, key) {
+			resp.Kvs = append(resp.Kvs, kv)
+		}
+	}
+	return resp, nil
+}
+
+func (f *fakeV3) Put(ctx context.Context, key, val string, opts ...clientv3.OpOption) (*clientv3.PutResponse, error) {
+	f.puts++
+	kv := &mvccpb.KeyValue{
+		Key:   []byte(key),
+		Value: []byte(val),
+	}
+	if len(opts) > 0 {
+		kv.Lease = 1
+	}
+	f.kvs[key] = kv
+	return &clientv3.PutResponse{}, nil
+}
+
+func (f *fakeV3) Grant(ctx context.Context, ttl int64) (*clientv3.LeaseGrantResponse, error) {
+	f.grants = append(f.grants, ttl)
+	return &clientv3.LeaseGrantResponse{
+		ID:  clientv3.LeaseID(len(f.grants)),
+		TTL: ttl,
+	}, nil
+}
+
+// newTestMigrator returns a migrator on a v2 keyspace holding two endpoint
+// keys and a graph key, and an empty v3 keyspace.
+func newTestMigrator() (*migrator, *fakeV3) {
+	v2 := new(mocks.KeysAPIMock)
+	v2.On("Get", mock.Anything, "/registry/services/endpoints", mock.Anything).Return(&etcd.Response{
+		Node: &etcd.Node{
+			Key: "/registry/services/endpoints",
+			Dir: true,
+			Nodes: etcd.Nodes{
+				{
+					Key: "/registry/services/endpoints/default/service1",
+					Dir: true,
+					Nodes: etcd.Nodes{
+						{Key: epKey1, Value: "ep1", TTL: 8},
+						{Key: epKey2, Value: "ep2", TTL: 8},
+					},
+				},
+			},
+		},
+	}, nil)
+	v2.On("Get", mock.Anything, "/skylb/graph", mock.Anything).Return(&etcd.Response{
+		Node: &etcd.Node{
+			Key: "/skylb/graph",
+			Dir: true,
+			Nodes: etcd.Nodes{
+				{Key: graphKey, Value: "1600000000", TTL: 3600},
+			},
+		},
+	}, nil)
+	v2.On("Get", mock.Anything, "/skylb/lameduck", mock.Anything).Return(nil, etcd.Error{Code: etcd.ErrorCodeKeyNotFound})
+
+	v3 := newFakeV3()
+	return &migrator{
+		v2:     v2,
+		kv:     v3,
+		lease:  v3,
+		leases: map[int64]clientv3.LeaseID{},
+		now: func() time.Time {
+			return time.Unix(1700000000, 0)
+		},
+	}, v3
+}
+
+// TestFlags checks if there are flag duplication.
+func TestFlags(t *testing.T) {
+	_ = main
+}
+
+func TestDiffRecords(t *testing.T) {
+	Convey("Calculate the diff between v2 and v3 records", t, func() {
+		epKey := epKey1
+		from := map[string]*record{
+			epKey:    {key: epKey, value: "ep", ttl: 8},
+			graphKey: {key: graphKey, value: "1600000000", ttl: 3600},
+		}
+
+		Convey("When v3 is empty", func() {
+			changes := diffRecords(from, map[string]*record{})
+			So(changes, ShouldHaveLength, 2)
+			So(changes[0].typ, ShouldEqual, changeAdd)
+			So(changes[0].key, ShouldEqual, epKey)
+			So(changes[1].typ, ShouldEqual, changeAdd)
+			So(changes[1].key, ShouldEqual, graphKey)
+		})
+
+		Convey("When v3 is in line with v2", func() {
+			to := map[string]*record{
+				epKey:    {key: epKey, value: "ep", lease: true},
+				graphKey: {key: graphKey, value: "1600000001", lease: true},
+			}
+			So(diffRecords(from, to), ShouldHaveLength, 0)
+		})
+
+		Convey("When v3 differs from v2", func() {
+			extraKey := "/skylb/lameduck/default/service1/172.0.10.9_8080"
+			to := map[string]*record{
+				epKey:    {key: epKey, value: "ep", lease: false},
+				extraKey: {key: extraKey, value: ""},
+			}
+			changes := diffRecords(from, to)
+			So(changes, ShouldHaveLength, 3)
+			So(changes[0].typ, ShouldEqual, changeUpdate)
+			So(changes[0].key, ShouldEqual, epKey)
+			So(changes[1].typ, ShouldEqual, changeAdd)
+			So(changes[1].key, ShouldEqual, graphKey)
+			So(changes[2].typ, ShouldEqual, changeExtra)
+			So(changes[2].key, ShouldEqual, extraKey)
+		})
+	})
+}
+
+func TestLoadV2(t *testing.T) {
+	Convey("Load the v2 records with their TTLs", t, func() {
+		m, _ := newTestMigrator()
+		records, err := m.loadV2()
+		So(err, ShouldBeNil)
+		So(records, ShouldHaveLength, 3)
+		So(records[epKey1].value, ShouldEqual, "ep1")
+		So(records[epKey1].ttl, ShouldEqual, 8)
+		So(records[epKey2].ttl, ShouldEqual, 8)
+		So(records[graphKey].ttl, ShouldEqual, 3600)
+
+		Convey("Rewrite the graph timestamps", func() {
+			So(records[graphKey].value, ShouldEqual, "1700000000")
+		})
+
+		Convey("Keep the graph timestamps if not required", func() {
+			*rewrite = false
+			defer func() { *rewrite = true }()
+
+			records, err := m.loadV2()
+			So(err, ShouldBeNil)
+			So(records[graphKey].value, ShouldEqual, "1600000000")
+		})
+	})
+}
+
+func TestMigrate(t *testing.T) {
+	Convey("Migrate the v2 records to v3", t, func() {
+		m, v3 := newTestMigrator()
+		var out bytes.Buffer
+		So(m.migrate(&out), ShouldBeNil)
+		So(out.String(), ShouldContainSubstring, "3 key(s) copied.")
+		So(v3.puts, ShouldEqual, 3)
+		So(string(v3.kvs[epKey1].Value), ShouldEqual, "ep1")
+		So(string(v3.kvs[graphKey].Value), ShouldEqual, "1700000000")
+
+		Convey("Keys with the same TTL share one lease", func() {
+			So(v3.grants, ShouldResemble, []int64{8, 3600})
+			So(m.leases, ShouldHaveLength, 2)
+		})
+
+		Convey("Put a key without a TTL", func() {
+			So(m.put(&record{key: epKey1, value: "ep"}), ShouldBeNil)
+			So(v3.kvs[epKey1].Lease, ShouldEqual, 0)
+			So(v3.grants, ShouldHaveLength, 2)
+		})
+
+		Convey("Migrate again copies nothing", func() {
+			out.Reset()
+			So(m.migrate(&out), ShouldBeNil)
+			So(out.String(), ShouldContainSubstring, "0 key(s) copied.")
+			So(v3.puts, ShouldEqual, 3)
+		})
+	})
+}
+
+func TestVerify(t *testing.T) {
+	Convey("Verify the v3 records against v2", t, func() {
+		m, v3 := newTestMigrator()
+		var out bytes.Buffer
+
+		Convey("When v3 is empty", func() {
+			ok, err := m.verify(&out)
+			So(err, ShouldBeNil)
+			So(ok, ShouldBeFalse)
+			So(out.String(), ShouldContainSubstring, "3 mismatch(es) found.")
+			So(v3.puts, ShouldEqual, 0)
+		})
+
+		Convey("When v3 has been migrated", func() {
+			So(m.migrate(&bytes.Buffer{}), ShouldBeNil)
+			ok, err := m.verify(&out)
+			So(err, ShouldBeNil)
+			So(ok, ShouldBeTrue)
+			So(out.String(), ShouldContainSubstring, "0 mismatch(es) found.")
+		})
+
+		Convey("When a v3 key differs or is not leased", func() {
+			So(m.migrate(&bytes.Buffer{}), ShouldBeNil)
+			v3.kvs[epKey1].Value = []byte("stale")
+			v3.kvs[epKey2].Lease = 0
+			ok, err := m.verify(&out)
+			So(err, ShouldBeNil)
+			So(ok, ShouldBeFalse)
+			So(out.String(), ShouldContainSubstring, "2 mismatch(es) found.")
+		})
+	})
+}
@@ -0,0 +1,308 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+	"time"
+
+	etcd "github.com/coreos/etcd/client"
+	"github.com/golang/glog"
+	clientv3 "go.etcd.io/etcd/client/v3"
+	"golang.org/x/net/context"
+
+	"github.com/binchencoder/skylb-api/prefix"
+	hubutil "github.com/binchencoder/skylb/hub/util"
+)
+
+const (
+	dialTimeout = 5 * time.Second
+)
+
+var (
+	getOpts = etcd.GetOptions{
+		Recursive: true,
+	}
+)
+
+// record represents a key in the SkyLB keyspace.
+type record struct {
+	key   string
+	value string
+	ttl   int64 // The TTL in seconds, zero means the key never expires.
+	lease bool  // Whether the v3 key is attached to a lease.
+}
+
+type changeType int
+
+const (
+	changeAdd    changeType = iota // The key exists in v2 only.
+	changeUpdate                   // The key exists in both but differs.
+	changeExtra                    // The key exists in v3 only.
+)
+
+// change represents a difference between the v2 and v3 keyspaces.
+type change struct {
+	typ  changeType
+	key  string
+	from *record // The v2 record.
+	to   *record // The v3 record.
+}
+
+func (c *change) String() string {
+	switch c.typ {
+	case changeAdd:
+		return fmt.Sprintf("+ %s = %q (ttl %ds)", c.key, c.from.value, c.from.ttl)
+	case changeUpdate:
+		return fmt.Sprintf("~ %s = %q -> %q (ttl %ds)", c.key, c.to.value, c.from.value, c.from.ttl)
+	case changeExtra:
+		return fmt.Sprintf("? %s = %q (v3 only, untouched)", c.key, c.to.value)
+	}
+	return ""
+}
+
+// migratedPrefixes returns the key prefixes to be carried over.
+func migratedPrefixes() []string {
+	return []string{
+		hubutil.EndpointsKeyPrefix,
+		prefix.GraphKey,
+		prefix.LameduckKey,
+	}
+}
+
+type migrator struct {
+	v2    etcd.KeysAPI
+	kv    clientv3.KV
+	lease clientv3.Lease
+	v3    io.Closer
+
+	// leases holds the lease granted for each TTL, so that the keys with
+	// the same TTL share one lease instead of holding one lease each.
+	leases map[int64]clientv3.LeaseID
+
+	now func() time.Time
+}
+
+// loadV2 loads all records under the migrated prefixes from etcd v2. The
+// values of service graph keys are rewritten if required.
+func (m *migrator) loadV2() (map[string]*record, error) {
+	records := map[string]*record{}
+	for _, p := range migratedPrefixes() {
+		resp, err := m.v2.Get(context.Background(), p, &getOpts)
+		if err != nil {
+			if e, ok := err.(etcd.Error); ok && e.Code == etcd.ErrorCodeKeyNotFound {
+				glog.Warningf("Key prefix %s absent in etcd v2, skip.", p)
+				continue
+			}
+			return nil, err
+		}
+		collectNodes(resp.Node, records)
+	}
+
+	if *rewrite {
+		ts := fmt.Sprintf("%d", m.now().Unix())
+		for k, r := range records {
+			if isGraphKey(k) {
+				r.value = ts
+			}
+		}
+	}
+	return records, nil
+}
+
+// loadV3 loads all records under the migrated prefixes from etcd v3.
+func (m *migrator) loadV3() (map[string]*record, error) {
+	records := map[string]*record{}
+	for _, p := range migratedPrefixes() {
+		resp, err := m.kv.Get(context.Background(), p+"/", clientv3.WithPrefix())
+		if err != nil {
+			return nil, err
+		}
+		for _, kv := range resp.Kvs {
+			records[string(kv.Key)] = &record{
+				key:   string(kv.Key),
+				value: string(kv.Value),
+				lease: kv.Lease != 0,
+			}
+		}
+	}
+	return records, nil
+}
+
+func (m *migrator) diff() ([]*change, error) {
+	from, err := m.loadV2()
+	if err != nil {
+		return nil, err
+	}
+	to, err := m.loadV3()
+	if err != nil {
+		return nil, err
+	}
+	return diffRecords(from, to), nil
+}
+
+// dryRun prints what the migration would change in etcd v3.
+func (m *migrator) dryRun(w io.Writer) error {
+	changes, err := m.diff()
+	if err != nil {
+		return err
+	}
+	for _, c := range changes {
+		fmt.Fprintln(w, c)
+	}
+	fmt.Fprintf(w, "%d change(s) in total.\n", len(changes))
+	return nil
+}
+
+// migrate copies all records which are absent or different in etcd v3.
+// Keys with a TTL in etcd v2 are attached to a lease with the same TTL,
+// which is shared by all keys with that TTL.
+func (m *migrator) migrate(w io.Writer) error {
+	changes, err := m.diff()
+	if err != nil {
+		return err
+	}
+
+	copied := 0
+	for _, c := range changes {
+		if c.typ == changeExtra {
+			continue
+		}
+		if err := m.put(c.from); err != nil {
+			return fmt.Errorf("failed to copy key %s, %v", c.key, err)
+		}
+		fmt.Fprintln(w, c)
+		copied++
+	}
+	fmt.Fprintf(w, "%d key(s) copied.\n", copied)
+	return nil
+}
+
+// verify compares etcd v2 and v3 key by key and returns false if any key
+// is missing or different in etcd v3.
+func (m *migrator) verify(w io.Writer) (bool, error) {
+	changes, err := m.diff()
+	if err != nil {
+		return false, err
+	}
+
+	mismatches := 0
+	for _, c := range changes {
+		if c.typ == changeExtra {
+			continue
+		}
+		fmt.Fprintln(w, c)
+		mismatches++
+	}
+	fmt.Fprintf(w, "%d mismatch(es) found.\n", mismatches)
+	return mismatches == 0, nil
+}
+
+func (m *migrator) put(r *record) error {
+	ctx := context.Background()
+	if r.ttl <= 0 {
+		_, err := m.kv.Put(ctx, r.key, r.value)
+		return err
+	}
+
+	id, err := m.leaseFor(ctx, r.ttl)
+	if err != nil {
+		return err
+	}
+	_, err = m.kv.Put(ctx, r.key, r.value, clientv3.WithLease(id))
+	return err
+}
+
+// leaseFor returns the lease for the given TTL, granting it on first use.
+func (m *migrator) leaseFor(ctx context.Context, ttl int64) (clientv3.LeaseID, error) {
+	if id, ok := m.leases[ttl]; ok {
+		return id, nil
+	}
+	lease, err := m.lease.Grant(ctx, ttl)
+	if err != nil {
+		return 0, err
+	}
+	m.leases[ttl] = lease.ID
+	return lease.ID, nil
+}
+
+func (m *migrator) close() {
+	if err := m.v3.Close(); err != nil {
+		glog.Warningf("Failed to close etcd v3 client, %v", err)
+	}
+}
+
+func newMigrator(v2Endpoints, v3Endpoints []string) (*migrator, error) {
+	cli, err := etcd.New(etcd.Config{
+		Endpoints: v2Endpoints,
+	})
+	if err != nil {
+		return nil, err
+	}
+	v3, err := clientv3.New(clientv3.Config{
+		Endpoints:   v3Endpoints,
+		DialTimeout: dialTimeout,
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &migrator{
+		v2:     etcd.NewKeysAPI(cli),
+		kv:     v3,
+		lease:  v3,
+		v3:     v3,
+		leases: map[int64]clientv3.LeaseID{},
+		now:    time.Now,
+	}, nil
+}
+
+// diffRecords returns the changes needed to bring the v3 records in line
+// with the v2 records, sorted by key.
+func diffRecords(from, to map[string]*record) []*change {
+	changes := []*change{}
+	for k, f := range from {
+		t, ok := to[k]
+		switch {
+		case !ok:
+			changes = append(changes, &change{typ: changeAdd, key: k, from: f})
+		case isGraphKey(k) && !*rewrite && f.value != t.value,
+			!isGraphKey(k) && f.value != t.value,
+			(f.ttl > 0) != t.lease:
+			changes = append(changes, &change{typ: changeUpdate, key: k, from: f, to: t})
+		}
+	}
+	for k, t := range to {
+		if _, ok := from[k]; !ok {
+			changes = append(changes, &change{typ: changeExtra, key: k, to: t})
+		}
+	}
+
+	sort.Slice(changes, func(i, j int) bool {
+		return changes[i].key < changes[j].key
+	})
+	return changes
+}
+
+func collectNodes(node *etcd.Node, records map[string]*record) {
+	if node == nil {
+		return
+	}
+	if len(node.Nodes) == 0 {
+		if !node.Dir {
+			records[node.Key] = &record{
+				key:   node.Key,
+				value: node.Value,
+				ttl:   node.TTL,
+			}
+		}
+		return
+	}
+	for _, n := range node.Nodes {
+		collectNodes(n, records)
+	}
+}
+
+func isGraphKey(key string) bool {
+	return strings.HasPrefix(key, prefix.GraphKey+"/")
+}
@@ -19,6 +19,7 @@ import (
 	"github.com/binchencoder/letsgo/runtime/pprof"
 	"github.com/binchencoder/skylb-api/metrics"
 	pb "github.com/binchencoder/skylb-api/proto"
+	"github.com/binchencoder/skylb/hub"
 	"github.com/binchencoder/skylb/rpc"
 )
 
@@ -73,7 +74,7 @@ func startGrpcServer(grpcl net.Listener) {
 
 	s := grpc.NewServer(unaryInt, grpc.StreamInterceptor(jgrpc.ChainStreamServer(streamIncepts...)))
 
-	pb.RegisterSkylbServer(s, rpc.NewSkylbServer())
+	pb.RegisterSkylbServer(s, rpc.NewSkylbServer(hub.CreateRegistry()))
 	hpb.RegisterHealthServer(s, health.NewServer())
 
 	glog.Infof("SkyLB grpc service started on %s.\n", *hostPort)
@@ -86,6 +87,8 @@ func startGrpcServer(grpcl net.Listener) {
 func startHTTPServer(httpl net.Listener) {
 	lmetrics.EnablePrometheus(http.DefaultServeMux)
 	pprof.EnablePprof(http.DefaultServeMux)
+	http.HandleFunc("/observers", hub.ObserversHandler)
+	http.HandleFunc("/endpoints", hub.EndpointsHandler)
 	if err := http.Serve(httpl, nil); err != nil {
 		glog.Fatalf("Failed to start prometheus server: %v", err)
 	}
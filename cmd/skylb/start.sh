@@ -4,6 +4,7 @@ cd `dirname $0`
 /skylb/skylb \
     -within-k8s=$WITHIN_K8S \
     -etcd-endpoints="$ENDPOINTS" \
+    -registry-backend=${REGISTRY_BACKEND:-etcd2} \
     -v $LOG_LEVEL -log_dir=$LOG_DIR &
 
 wait
@@ -3,6 +3,7 @@ package svclist
 import (
 	"bytes"
 	"encoding/json"
+	"fmt"
 	"path"
 	"strconv"
 	"strings"
@@ -15,6 +16,7 @@ import (
 	"github.com/binchencoder/skylb-api/prefix"
 	pb "github.com/binchencoder/skylb-api/proto"
 	"github.com/binchencoder/skylb/hub"
+	"github.com/binchencoder/skylb/hub/util"
 )
 
 var (
@@ -24,8 +26,15 @@ var (
 	}
 )
 
-func ListServices(etcdCli etcd.KeysAPI) ([]*pb.ServiceEndpoints, error) {
-	sepsList := make([]*pb.ServiceEndpoints, 0, 200)
+// ServiceInstances is the endpoints of a service, along with the metadata
+// registered by its instances keyed by "host:port".
+type ServiceInstances struct {
+	*pb.ServiceEndpoints
+	Metadata map[string]map[string]string `json:"metadata,omitempty"`
+}
+
+func ListServices(etcdCli etcd.KeysAPI) ([]*ServiceInstances, error) {
+	sepsList := make([]*ServiceInstances, 0, 200)
 	resp, err := etcdCli.Get(context.Background(), prefix.EndpointsKey, getOpts)
 	if nil != err {
 		return nil, err
@@ -35,11 +44,13 @@ func ListServices(etcdCli etcd.KeysAPI) ([]*pb.ServiceEndpoints, error) {
 		glog.V(logLevel).Infof("namespace %#v", ns.Key)
 		for _, svc := range ns.Nodes {
 			glog.V(logLevel).Infof("> svc %#v", svc.Key)
-			seps := &pb.ServiceEndpoints{
-				Spec: &pb.ServiceSpec{
-					Namespace:   path.Base(ns.Key),
-					ServiceName: path.Base(svc.Key),
-					//PortName: // TODO(fuyc): fill it if need to.
+			seps := &ServiceInstances{
+				ServiceEndpoints: &pb.ServiceEndpoints{
+					Spec: &pb.ServiceSpec{
+						Namespace:   path.Base(ns.Key),
+						ServiceName: path.Base(svc.Key),
+						//PortName: // TODO(fuyc): fill it if need to.
+					},
 				},
 			}
 			ieps := make([]*pb.InstanceEndpoint, 0, 30)
@@ -61,13 +72,19 @@ func ListServices(etcdCli etcd.KeysAPI) ([]*pb.ServiceEndpoints, error) {
 					Port: int32(port),
 				}
 				ieps = append(ieps, iep)
-				if seps.Spec.PortName == "" {
-					eps := &api.Endpoints{}
-					err = json.Unmarshal([]byte(si.Value), eps)
-					if err != nil {
-						glog.V(logLevel).Infof("unmarshaling value: %#v but got error", err, ns.Value)
-						continue
+				eps := &api.Endpoints{}
+				err = json.Unmarshal([]byte(si.Value), eps)
+				if err != nil {
+					glog.V(logLevel).Infof("unmarshaling value: %#v but got error", err, ns.Value)
+					continue
+				}
+				if md := util.EndpointMetadata(eps, iep.Host, iep.Port); len(md) > 0 {
+					if seps.Metadata == nil {
+						seps.Metadata = map[string]map[string]string{}
 					}
+					seps.Metadata[fmt.Sprintf("%s:%d", iep.Host, iep.Port)] = md
+				}
+				if seps.Spec.PortName == "" {
 					if len(eps.Subsets) > 0 && len(eps.Subsets[0].Ports) > 0 {
 						seps.Spec.PortName = eps.Subsets[0].Ports[0].Name
 					}
@@ -2,19 +2,23 @@ package dashboard
 
 import (
 	"context"
+	"encoding/json"
 	"fmt"
 	"sort"
+	"strconv"
 	"strings"
 
 	etcd "github.com/coreos/etcd/client"
 	"github.com/gogo/protobuf/proto"
 	"github.com/golang/glog"
 	"github.com/kataras/iris"
+	api "k8s.io/api/core/v1"
 
 	"github.com/binchencoder/letsgo/service/naming"
 	"github.com/binchencoder/skylb-api/lameduck"
 	"github.com/binchencoder/skylb/dashboard/db"
 	pb "github.com/binchencoder/skylb/dashboard/proto"
+	"github.com/binchencoder/skylb/hub/util"
 	"github.com/binchencoder/gateway-proto/data"
 )
 
@@ -83,6 +87,24 @@ func loadInstances(name string, lameducks map[string]string) []*pb.InstanceInfo
 	return nil
 }
 
+// instanceMetadata returns the metadata registered by the instance of the
+// given "host_port" as comma separated key=value pairs sorted by key.
+func instanceMetadata(hostPort, value string) string {
+	pos := strings.LastIndex(hostPort, "_")
+	if pos < 0 {
+		return ""
+	}
+	port, err := strconv.Atoi(hostPort[pos+1:])
+	if err != nil {
+		return ""
+	}
+	eps := api.Endpoints{}
+	if err := json.Unmarshal([]byte(value), &eps); err != nil {
+		return ""
+	}
+	return util.FormatMetadata(util.EndpointMetadata(&eps, hostPort[:pos], int32(port)))
+}
+
 func extractInstances(root *etcd.Node, prefixLen int, lameducks map[string]string) []*pb.InstanceInfo {
 	instances := []*pb.InstanceInfo{}
 	for _, node := range root.Nodes {
@@ -96,6 +118,7 @@ func extractInstances(root *etcd.Node, prefixLen int, lameducks map[string]strin
 		instances = append(instances, &pb.InstanceInfo{
 			Address:  hostAddr,
 			Lameduck: isLameduck,
+			Metadata: instanceMetadata(node.Key[prefixLen:], node.Value),
 		})
 	}
 	for k := range lameducks {
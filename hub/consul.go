@@ -0,0 +1,246 @@
+package hub
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/golang/glog"
+	"golang.org/x/net/context"
+	api "k8s.io/api/core/v1"
+)
+
+const (
+	consulIndexHeader   = "X-Consul-Index"
+	consulStatusPassing = "passing"
+
+	// Service meta keys recognized by SkyLB on Consul service instances.
+	consulMetaNamespace = "skylb-namespace"
+	consulMetaPortName  = "skylb-port-name"
+	consulMetaWeight    = "skylb-weight"
+
+	defaultNamespace = "default"
+)
+
+var (
+	consulAddr     = flag.String("consul-addr", "", "The Consul agent HTTP address. If set, Consul is used as the endpoints source")
+	consulWaitTime = flag.Duration("consul-wait-time", 5*time.Minute, "The max wait time of Consul blocking queries")
+	consulPortName = flag.String("consul-port-name", "grpc", "The port name of Consul service instances without meta skylb-port-name")
+
+	consulCli *consulClient
+)
+
+// consulHealthEntry is one entry returned by Consul API /v1/health/service.
+type consulHealthEntry struct {
+	Node struct {
+		Node    string
+		Address string
+	}
+	Service struct {
+		ID      string
+		Service string
+		Address string
+		Port    int32
+		Meta    map[string]string
+	}
+	Checks []struct {
+		CheckID string
+		Status  string
+	}
+}
+
+// healthy returns true if all health checks of the entry are passing.
+func (e *consulHealthEntry) healthy() bool {
+	for _, c := range e.Checks {
+		if c.Status != consulStatusPassing {
+			return false
+		}
+	}
+	return true
+}
+
+func (e *consulHealthEntry) address() string {
+	if e.Service.Address != "" {
+		return e.Service.Address
+	}
+	return e.Node.Address
+}
+
+func (e *consulHealthEntry) meta(key, defaultValue string) string {
+	if v, ok := e.Service.Meta[key]; ok && v != "" {
+		return v
+	}
+	return defaultValue
+}
+
+// consulClient talks to the Consul agent HTTP API.
+type consulClient struct {
+	baseURL string
+	httpCli *http.Client
+}
+
+// healthService returns the instances of the given Consul service with
+// their health checks. If index is not zero, it's a blocking query which
+// returns when the service changes after index, or when the wait time
+// elapses.
+func (cc *consulClient) healthService(ctx context.Context, serviceName string, index uint64) ([]*consulHealthEntry, uint64, error) {
+	u := fmt.Sprintf("%s/v1/health/service/%s", cc.baseURL, url.PathEscape(serviceName))
+	if index > 0 {
+		u = fmt.Sprintf("%s?index=%d&wait=%ds", u, index, int64(*consulWaitTime/time.Second))
+	}
+	req, err := http.NewRequest(http.MethodGet, u, nil)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	resp, err := cc.httpCli.Do(req.WithContext(ctx))
+	if err != nil {
+		return nil, 0, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, 0, fmt.Errorf("consul returned status %s for service %s", resp.Status, serviceName)
+	}
+
+	newIndex, err := strconv.ParseUint(resp.Header.Get(consulIndexHeader), 10, 64)
+	if err != nil {
+		return nil, 0, fmt.Errorf("invalid consul index %q, %v", resp.Header.Get(consulIndexHeader), err)
+	}
+
+	entries := []*consulHealthEntry{}
+	if err := json.NewDecoder(resp.Body).Decode(&entries); err != nil {
+		return nil, 0, err
+	}
+	return entries, newIndex, nil
+}
+
+func newConsulClient(addr string) *consulClient {
+	if !strings.HasPrefix(addr, "http://") && !strings.HasPrefix(addr, "https://") {
+		addr = "http://" + addr
+	}
+	return &consulClient{
+		baseURL: strings.TrimSuffix(addr, "/"),
+		httpCli: &http.Client{
+			// Leave enough room for blocking queries.
+			Timeout: *consulWaitTime + *consulWaitTime/16 + 10*time.Second,
+		},
+	}
+}
+
+func withinConsul() bool {
+	return *consulAddr != ""
+}
+
+func (eh *endpointsHub) initConsul() {
+	consulCli = newConsulClient(*consulAddr)
+	glog.Infof("Use Consul agent %s as the endpoints source.", consulCli.baseURL)
+}
+
+func (eh *endpointsHub) fetchConsulEndpoints(namespace, serviceName string) (*api.Endpoints, error) {
+	entries, _, err := consulCli.healthService(context.Background(), serviceName, 0)
+	if err != nil {
+		return nil, err
+	}
+	return consulEntriesToEndpoints(namespace, serviceName, entries), nil
+}
+
+// startConsulWatcher watches the given service with Consul blocking
+// queries and applies the endpoints whenever the service changes, until
+// stopCh is closed.
+func (eh *endpointsHub) startConsulWatcher(namespace, serviceName string, stopCh <-chan struct{}) {
+	key := eh.calculateKey(namespace, serviceName)
+
+	// Cancel the pending blocking query once stopped.
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() {
+		<-stopCh
+		cancel()
+	}()
+
+	var index uint64
+	for {
+		entries, newIndex, err := consulCli.healthService(ctx, serviceName, index)
+		if ctx.Err() != nil {
+			glog.V(3).Infof("Stopped watching Consul service %s.", serviceName)
+			return
+		}
+		if err != nil {
+			glog.Errorf("Failed to query Consul service %s, %v", serviceName, err)
+			select {
+			case <-stopCh:
+			case <-time.After(time.Second):
+			}
+			continue
+		}
+		if newIndex == index {
+			// Wait time elapsed without changes.
+			continue
+		}
+		if newIndex < index {
+			// The index went backwards, e.g. Consul servers were restored
+			// from a snapshot. Reset and reload.
+			glog.Warningf("Consul index of service %s went backwards, reset.", serviceName)
+			index = 0
+			continue
+		}
+		index = newIndex
+
+		glog.V(4).Infof("Consul service %s changed at index %d", serviceName, index)
+		eh.applyServiceEndpoints(key, sourceConsul, consulEntriesToEndpoints(namespace, serviceName, entries))
+	}
+}
+
+// consulEntriesToEndpoints converts the Consul service instances which
+// belong to the given namespace to Kubernetes endpoints. Instances with
+// failing health checks are put in NotReadyAddresses.
+func consulEntriesToEndpoints(namespace, serviceName string, entries []*consulHealthEntry) *api.Endpoints {
+	eps := api.Endpoints{}
+	eps.Name = serviceName
+	eps.Namespace = namespace
+
+	for _, e := range entries {
+		if e.meta(consulMetaNamespace, defaultNamespace) != namespace {
+			continue
+		}
+
+		host := e.address()
+		addr := api.EndpointAddress{
+			IP: host,
+			TargetRef: &api.ObjectReference{
+				Kind:      defaultKind,
+				Namespace: namespace,
+				Name:      e.Service.ID,
+			},
+		}
+		subset := api.EndpointSubset{
+			Ports: []api.EndpointPort{
+				{
+					Name: e.meta(consulMetaPortName, *consulPortName),
+					Port: e.Service.Port,
+				},
+			},
+		}
+		if e.healthy() {
+			subset.Addresses = []api.EndpointAddress{addr}
+		} else {
+			subset.NotReadyAddresses = []api.EndpointAddress{addr}
+		}
+		eps.Subsets = append(eps.Subsets, subset)
+
+		if w, ok := e.Service.Meta[consulMetaWeight]; ok {
+			if _, err := strconv.Atoi(w); err == nil {
+				if eps.Labels == nil {
+					eps.Labels = make(map[string]string)
+				}
+				eps.Labels[calculateWeightKey(host, e.Service.Port)] = w
+			}
+		}
+	}
+	return &eps
+}
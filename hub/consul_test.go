@@ -0,0 +1,99 @@
+package hub
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	. "github.com/smartystreets/goconvey/convey"
+	"golang.org/x/net/context"
+
+	pb "github.com/binchencoder/skylb-api/proto"
+)
+
+const consulHealthResp = `[
+	{
+		"Node": {"Node": "node1", "Address": "10.0.0.1"},
+		"Service": {"ID": "service1-1", "Service": "service1", "Address": "172.0.10.1", "Port": 8080},
+		"Checks": [{"CheckID": "serfHealth", "Status": "passing"}, {"CheckID": "service:service1-1", "Status": "passing"}]
+	},
+	{
+		"Node": {"Node": "node2", "Address": "10.0.0.2"},
+		"Service": {"ID": "service1-2", "Service": "service1", "Address": "", "Port": 8080, "Meta": {"skylb-weight": "20"}},
+		"Checks": [{"CheckID": "serfHealth", "Status": "passing"}]
+	},
+	{
+		"Node": {"Node": "node3", "Address": "10.0.0.3"},
+		"Service": {"ID": "service1-3", "Service": "service1", "Address": "172.0.10.3", "Port": 8080},
+		"Checks": [{"CheckID": "service:service1-3", "Status": "critical"}]
+	},
+	{
+		"Node": {"Node": "node4", "Address": "10.0.0.4"},
+		"Service": {"ID": "service1-4", "Service": "service1", "Address": "172.0.10.4", "Port": 8080, "Meta": {"skylb-namespace": "other"}},
+		"Checks": []
+	}
+]`
+
+func newConsulStandIn(index *int) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/v1/health/service/service1" {
+			w.Header().Set(consulIndexHeader, "1")
+			w.Write([]byte("[]"))
+			return
+		}
+		w.Header().Set(consulIndexHeader, fmt.Sprintf("%d", *index))
+		w.Write([]byte(consulHealthResp))
+	}))
+}
+
+func TestConsulHealthService(t *testing.T) {
+	Convey("Query service health from a Consul agent", t, func() {
+		index := 42
+		srv := newConsulStandIn(&index)
+		defer srv.Close()
+
+		cc := newConsulClient(srv.URL)
+		entries, newIndex, err := cc.healthService(context.Background(), serviceName, 0)
+		So(err, ShouldBeNil)
+		So(newIndex, ShouldEqual, 42)
+		So(entries, ShouldHaveLength, 4)
+		So(entries[0].healthy(), ShouldBeTrue)
+		So(entries[1].address(), ShouldEqual, "10.0.0.2")
+		So(entries[2].healthy(), ShouldBeFalse)
+	})
+}
+
+func TestConsulEntriesToEndpoints(t *testing.T) {
+	spec := &pb.ServiceSpec{
+		Namespace:   "default",
+		ServiceName: serviceName,
+		PortName:    "grpc",
+	}
+
+	Convey("Convert Consul service instances to endpoints", t, func() {
+		index := 42
+		srv := newConsulStandIn(&index)
+		defer srv.Close()
+
+		prevCli := consulCli
+		defer func() { consulCli = prevCli }()
+		consulCli = newConsulClient(srv.URL)
+
+		eh := endpointsHub{}
+		eps, err := eh.fetchConsulEndpoints(spec.Namespace, spec.ServiceName)
+		So(err, ShouldBeNil)
+		So(eps.Subsets, ShouldHaveLength, 3)
+
+		epsMap := skypbEndpointsToMap(spec, eps)
+		So(epsMap, ShouldHaveLength, 2)
+		So(epsMap, ShouldContainKey, "172.0.10.1:8080")
+		So(epsMap, ShouldContainKey, "10.0.0.2:8080")
+		So(epsMap["10.0.0.2:8080"].Weight, ShouldEqual, 20)
+		So(epsMap, ShouldNotContainKey, "172.0.10.3:8080")
+		So(epsMap, ShouldNotContainKey, "172.0.10.4:8080")
+
+		So(eps.Subsets[2].NotReadyAddresses, ShouldHaveLength, 1)
+		So(eps.Subsets[2].NotReadyAddresses[0].IP, ShouldEqual, "172.0.10.3")
+	})
+}
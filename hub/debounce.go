@@ -0,0 +1,139 @@
+package hub
+
+import (
+	"flag"
+	"sync"
+	"time"
+
+	prom "github.com/prometheus/client_golang/prometheus"
+)
+
+const (
+	debounceActionApplied   = "applied"
+	debounceActionCoalesced = "coalesced"
+)
+
+var (
+	updateDebounceMin = flag.Duration("update-debounce-min", 100*time.Millisecond, "The quiet time to wait for more endpoint update events of a service before applying them at once. Zero disables debouncing")
+	updateDebounceMax = flag.Duration("update-debounce-max", time.Second, "The max time to delay endpoint update events of a service while they keep coming")
+
+	debouncedUpdateCounts = prom.NewCounterVec(
+		prom.CounterOpts{
+			Namespace: "infra",
+			Subsystem: "skylb",
+			Name:      "debounced_update_counts",
+			Help:      "SkyLB endpoint update event counts, by service and action, either applied or coalesced into an applied one.",
+		},
+		[]string{"service", "action"},
+	)
+)
+
+func init() {
+	prom.MustRegister(debouncedUpdateCounts)
+}
+
+// debouncer coalesces bursts of update events of a service, e.g. during a
+// rolling deployment, so that the endpoints are fetched and pushed once
+// per burst.
+//
+// An event is applied after --update-debounce-min without further events,
+// or at the latest --update-debounce-max after the first pending event.
+type debouncer struct {
+	label  string // The service label for metrics.
+	update func()
+
+	// Serializes the updates, so that a slow one never overwrites the
+	// result of a later one.
+	updateLock sync.Mutex
+
+	// Guards the fields below.
+	lock    sync.Mutex
+	timer   *time.Timer
+	first   time.Time // When the first pending event arrived.
+	events  int       // The number of pending events.
+	stopped bool
+}
+
+func newDebouncer(label string, update func()) *debouncer {
+	return &debouncer{
+		label:  label,
+		update: update,
+	}
+}
+
+// trigger records an update event.
+func (d *debouncer) trigger() {
+	d.lock.Lock()
+	if d.stopped {
+		d.lock.Unlock()
+		return
+	}
+	if *updateDebounceMin <= 0 {
+		d.lock.Unlock()
+		d.apply(1)
+		return
+	}
+	defer d.lock.Unlock()
+
+	now := time.Now()
+	d.events++
+	if d.timer == nil {
+		d.first = now
+		var timer *time.Timer
+		timer = time.AfterFunc(*updateDebounceMin, func() {
+			d.flush(timer)
+		})
+		d.timer = timer
+		return
+	}
+
+	// Wait for the quiet time again, but not beyond the max delay.
+	delay := *updateDebounceMin
+	if remaining := d.first.Add(*updateDebounceMax).Sub(now); remaining < delay {
+		delay = remaining
+	}
+	// If the timer has fired, the pending flush takes the event as well.
+	if d.timer.Stop() {
+		d.timer.Reset(delay)
+	}
+}
+
+// flush applies the pending events, if the given timer is still current.
+func (d *debouncer) flush(timer *time.Timer) {
+	d.lock.Lock()
+	if d.timer != timer || d.stopped {
+		d.lock.Unlock()
+		return
+	}
+	events := d.events
+	d.timer = nil
+	d.events = 0
+	d.lock.Unlock()
+
+	d.apply(events)
+}
+
+// apply runs the update once for the given number of events.
+func (d *debouncer) apply(events int) {
+	debouncedUpdateCounts.WithLabelValues(d.label, debounceActionApplied).Inc()
+	if events > 1 {
+		debouncedUpdateCounts.WithLabelValues(d.label, debounceActionCoalesced).Add(float64(events - 1))
+	}
+
+	d.updateLock.Lock()
+	defer d.updateLock.Unlock()
+	d.update()
+}
+
+// stop drops the pending events and stops debouncing.
+func (d *debouncer) stop() {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	d.stopped = true
+	if d.timer != nil {
+		d.timer.Stop()
+		d.timer = nil
+		d.events = 0
+	}
+}
@@ -0,0 +1,59 @@
+package hub
+
+import (
+	"sync/atomic"
+	"testing"
+	"time"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestDebouncer(t *testing.T) {
+	Convey("Coalesce bursts of update events", t, func() {
+		oldMin, oldMax := *updateDebounceMin, *updateDebounceMax
+		*updateDebounceMin, *updateDebounceMax = 50*time.Millisecond, 200*time.Millisecond
+		Reset(func() {
+			*updateDebounceMin, *updateDebounceMax = oldMin, oldMax
+		})
+
+		var updates int32
+		d := newDebouncer("default.service1", func() {
+			atomic.AddInt32(&updates, 1)
+		})
+
+		Convey("A burst should be applied once after the quiet time", func() {
+			for i := 0; i < 10; i++ {
+				d.trigger()
+			}
+			So(atomic.LoadInt32(&updates), ShouldEqual, 0)
+
+			time.Sleep(150 * time.Millisecond)
+			So(atomic.LoadInt32(&updates), ShouldEqual, 1)
+		})
+
+		Convey("Events which keep coming should be applied within the max delay", func() {
+			start := time.Now()
+			for time.Since(start) < 500*time.Millisecond {
+				d.trigger()
+				time.Sleep(10 * time.Millisecond)
+			}
+			So(atomic.LoadInt32(&updates), ShouldBeGreaterThanOrEqualTo, 2)
+		})
+
+		Convey("Pending events should be dropped once stopped", func() {
+			d.trigger()
+			d.stop()
+			d.trigger()
+
+			time.Sleep(150 * time.Millisecond)
+			So(atomic.LoadInt32(&updates), ShouldEqual, 0)
+		})
+
+		Convey("Every event should be applied at once without debouncing", func() {
+			*updateDebounceMin = 0
+			d.trigger()
+			d.trigger()
+			So(atomic.LoadInt32(&updates), ShouldEqual, 2)
+		})
+	})
+}
@@ -1,30 +1,88 @@
 package hub
 
 import (
+	"sort"
+
 	api "k8s.io/api/core/v1"
 
 	pb "github.com/binchencoder/skylb-api/proto"
 )
 
+// opUndefined stands for an operation which the Operation enum of the
+// linked skylb-api doesn't define. It's never sent.
+const opUndefined pb.Operation = -1
+
+// OpNotReady marks an endpoint which is known but not ready to serve yet.
+// It's only sent to observers with ObserverOptions.IncludeNotReady, and
+// only once skylb-api defines it, see operation.
+var OpNotReady = operation("NotReady")
+
+// operation returns the named value of the Operation enum of skylb-api, or
+// opUndefined if the enum lacks it. The operations which the released
+// skylb-api lacks are looked up by name rather than pinned to a number, so
+// the hub never sends a value which clients can't decode to a known
+// operation.
+func operation(name string) pb.Operation {
+	if v, ok := pb.Operation_value[name]; ok {
+		return pb.Operation(v)
+	}
+	return opUndefined
+}
+
+// OpWeight marks an endpoint already known by the client whose weight
+// changed, sent with the new weight. It's only sent to observers with
+// ObserverOptions.WeightUpdates, and only once skylb-api defines it, see
+// operation.
+var OpWeight = operation("Weight")
+
+// EndpointsUpdate is an update of the endpoints of a service to an observer.
+// It doesn't carry the endpoint metadata, since pb.InstanceEndpoint has no
+// field for it. The metadata is only used by the hub to select and order
+// endpoints, and shown by the dashboard and skylb-command.
 type EndpointsUpdate struct {
 	Id        int64
 	Endpoints *pb.ServiceEndpoints
 }
 
-func diffEndpoints(spec *pb.ServiceSpec, last, now serviceEndpoints) *pb.ServiceEndpoints {
-	// Found common entries.
+// diffEndpoints returns the changes from the last endpoints to the current
+// ones. An endpoint whose weight alone changed is sent with OpWeight if
+// weightOps is set, or added again with the new weight otherwise, which is
+// what clients unaware of OpWeight understand. The changes of each kind
+// are sorted by address, so the order is stable for orderByZone.
+func diffEndpoints(spec *pb.ServiceSpec, last, now serviceEndpoints, weightOps bool) *pb.ServiceEndpoints {
+	eps := []*pb.InstanceEndpoint{}
+
+	// Found common entries, whose readiness and weight are unchanged. An
+	// endpoint which changed its readiness is added again with its current
+	// state. A metadata change alone isn't sent, since clients don't get
+	// the metadata.
 	common := make(map[string]struct{})
-	for k := range now {
-		if _, ok := last[k]; ok {
+	for _, k := range now.keys() {
+		v := now[k]
+		l, ok := last[k]
+		if !ok || l.NotReady != v.NotReady {
+			continue
+		}
+		if l.Weight == v.Weight {
+			common[k] = struct{}{}
+			continue
+		}
+		if weightOps {
+			ep := pb.InstanceEndpoint{
+				Op:     OpWeight,
+				Host:   v.IP,
+				Port:   v.Port,
+				Weight: v.Weight,
+			}
+			eps = append(eps, &ep)
 			common[k] = struct{}{}
 		}
 	}
 
-	eps := []*pb.InstanceEndpoint{}
-
 	// Found endpoints to be removed from client.
-	for k, v := range last {
-		if _, ok := common[k]; !ok {
+	for _, k := range last.keys() {
+		if _, ok := now[k]; !ok {
+			v := last[k]
 			ep := pb.InstanceEndpoint{
 				Op:   pb.Operation_Delete,
 				Host: v.IP,
@@ -35,14 +93,18 @@ func diffEndpoints(spec *pb.ServiceSpec, last, now serviceEndpoints) *pb.Service
 	}
 
 	// Found endpoints to be added for client.
-	for k, v := range now {
+	for _, k := range now.keys() {
 		if _, ok := common[k]; !ok {
+			v := now[k]
 			ep := pb.InstanceEndpoint{
 				Op:     pb.Operation_Add,
 				Host:   v.IP,
 				Port:   v.Port,
 				Weight: v.Weight,
 			}
+			if v.NotReady {
+				ep.Op = OpNotReady
+			}
 			eps = append(eps, &ep)
 		}
 	}
@@ -53,6 +115,41 @@ func diffEndpoints(spec *pb.ServiceSpec, last, now serviceEndpoints) *pb.Service
 	}
 }
 
+// snapshotEndpoints returns all the given endpoints sorted by address, with
+// ready endpoints first.
+func snapshotEndpoints(spec *pb.ServiceSpec, now serviceEndpoints) *pb.ServiceEndpoints {
+	keys := make([]string, 0, len(now))
+	for k := range now {
+		keys = append(keys, k)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		a, b := now[keys[i]], now[keys[j]]
+		if a.NotReady != b.NotReady {
+			return !a.NotReady
+		}
+		return keys[i] < keys[j]
+	})
+
+	eps := make([]*pb.InstanceEndpoint, 0, len(keys))
+	for _, k := range keys {
+		v := now[k]
+		ep := pb.InstanceEndpoint{
+			Host:   v.IP,
+			Port:   v.Port,
+			Weight: v.Weight,
+		}
+		if v.NotReady {
+			ep.Op = OpNotReady
+		}
+		eps = append(eps, &ep)
+	}
+
+	return &pb.ServiceEndpoints{
+		Spec:          spec,
+		InstEndpoints: eps,
+	}
+}
+
 func findPort(ports []api.EndpointPort, portName string) int32 {
 	for _, ep := range ports {
 		if ep.Name == portName {
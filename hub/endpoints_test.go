@@ -16,6 +16,17 @@ const (
 	port        = 8080
 )
 
+func init() {
+	// The released skylb-api doesn't define the NotReady and Weight
+	// operations yet, so the tests give them the values proposed for them.
+	if OpNotReady == opUndefined {
+		OpNotReady = 2
+	}
+	if OpWeight == opUndefined {
+		OpWeight = 3
+	}
+}
+
 func TestDiffEndpoints(t *testing.T) {
 	spec := &pb.ServiceSpec{
 		Namespace:   namespace,
@@ -54,7 +65,7 @@ func TestDiffEndpoints(t *testing.T) {
 	}
 
 	Convey("Calculate endpoints diff", t, func() {
-		diff := diffEndpoints(spec, last, now)
+		diff := diffEndpoints(spec, last, now, false)
 		So(diff, ShouldNotBeNil)
 		So(diff.Spec, ShouldNotBeNil)
 		So(diff.Spec.Namespace, ShouldEqual, namespace)
@@ -76,6 +87,69 @@ func TestDiffEndpoints(t *testing.T) {
 			So(ep.Port, ShouldEqual, port)
 		})
 	})
+
+	Convey("Calculate endpoints diff with weight changes", t, func() {
+		weighted := serviceEndpoints{}
+		for k, v := range last {
+			weighted[k] = v
+		}
+		ep := weighted["192.168.1.2:8080"]
+		ep.Weight = 5
+		weighted["192.168.1.2:8080"] = ep
+
+		Convey("Sent with OpWeight to clients which opt in", func() {
+			diff := diffEndpoints(spec, last, weighted, true)
+			So(diff.InstEndpoints, ShouldHaveLength, 1)
+			So(diff.InstEndpoints[0].Op, ShouldEqual, OpWeight)
+			So(diff.InstEndpoints[0].Host, ShouldEqual, "192.168.1.2")
+			So(diff.InstEndpoints[0].Weight, ShouldEqual, 5)
+		})
+
+		Convey("Added again with the new weight to other clients", func() {
+			diff := diffEndpoints(spec, last, weighted, false)
+			So(diff.InstEndpoints, ShouldHaveLength, 1)
+			So(diff.InstEndpoints[0].Op, ShouldEqual, pb.Operation_Add)
+			So(diff.InstEndpoints[0].Host, ShouldEqual, "192.168.1.2")
+			So(diff.InstEndpoints[0].Weight, ShouldEqual, 5)
+		})
+
+		Convey("Sent with OpWeight even if the metadata changed too", func() {
+			ep.Metadata = map[string]string{"version": "v2"}
+			weighted["192.168.1.2:8080"] = ep
+			diff := diffEndpoints(spec, last, weighted, true)
+			So(diff.InstEndpoints, ShouldHaveLength, 1)
+			So(diff.InstEndpoints[0].Op, ShouldEqual, OpWeight)
+			So(diff.InstEndpoints[0].Weight, ShouldEqual, 5)
+		})
+
+		So(diffEndpoints(spec, weighted, weighted, true).InstEndpoints, ShouldBeEmpty)
+
+		Convey("Added again to clients which opt in while skylb-api lacks OpWeight", func() {
+			op := OpWeight
+			OpWeight = operation("Weight-Undefined")
+			defer func() {
+				OpWeight = op
+			}()
+
+			co := newClientObject(spec, "192.168.0.1:8000", newObserverQueue(make(chan *EndpointsUpdate, 1)), ObserverOptions{WeightUpdates: true}, nil)
+			defer co.Close()
+			So(co.weightUpdates, ShouldBeFalse)
+		})
+	})
+
+	Convey("Calculate endpoints diff with metadata changes", t, func() {
+		changed := serviceEndpoints{}
+		for k, v := range last {
+			changed[k] = v
+		}
+		ep := changed["192.168.1.2:8080"]
+		ep.Metadata = map[string]string{"version": "v2"}
+		changed["192.168.1.2:8080"] = ep
+
+		// Clients don't get the metadata, so there's nothing to send.
+		So(diffEndpoints(spec, last, changed, true).InstEndpoints, ShouldBeEmpty)
+		So(diffEndpoints(spec, last, changed, false).InstEndpoints, ShouldBeEmpty)
+	})
 }
 
 func TestFindPort(t *testing.T) {
@@ -113,3 +187,79 @@ func TestFindPort(t *testing.T) {
 		})
 	})
 }
+
+func TestNotReadyEndpoints(t *testing.T) {
+	spec := &pb.ServiceSpec{
+		Namespace:   namespace,
+		ServiceName: serviceName,
+		PortName:    portName,
+	}
+
+	eps := api.Endpoints{
+		Subsets: []api.EndpointSubset{
+			{
+				Addresses: []api.EndpointAddress{
+					{IP: "192.168.1.1"},
+				},
+				NotReadyAddresses: []api.EndpointAddress{
+					{IP: "192.168.1.2"},
+				},
+				Ports: []api.EndpointPort{
+					{Name: portName, Port: port},
+				},
+			},
+		},
+	}
+
+	Convey("Track readiness of endpoints", t, func() {
+		Convey("Not ready endpoints are excluded by default", func() {
+			So(skypbEndpointsToMap(spec, &eps), ShouldHaveLength, 1)
+
+			slice := snapshotEndpoints(spec, skypbAllEndpointsToMap(spec, &eps).ready())
+			So(slice.InstEndpoints, ShouldHaveLength, 1)
+			So(slice.InstEndpoints[0].Host, ShouldEqual, "192.168.1.1")
+		})
+
+		Convey("Not ready endpoints are marked if included", func() {
+			epsMap := skypbAllEndpointsToMap(spec, &eps)
+			So(epsMap, ShouldHaveLength, 2)
+			So(epsMap["192.168.1.1:8080"].NotReady, ShouldBeFalse)
+			So(epsMap["192.168.1.2:8080"].NotReady, ShouldBeTrue)
+			So(epsMap.ready(), ShouldHaveLength, 1)
+
+			slice := snapshotEndpoints(spec, epsMap)
+			So(slice.InstEndpoints, ShouldHaveLength, 2)
+			So(slice.InstEndpoints[0].Op, ShouldEqual, pb.Operation_Add)
+			So(slice.InstEndpoints[1].Host, ShouldEqual, "192.168.1.2")
+			So(slice.InstEndpoints[1].Op, ShouldEqual, OpNotReady)
+		})
+
+		Convey("Readiness change is sent as the current state", func() {
+			last := skypbAllEndpointsToMap(spec, &eps)
+			eps.Subsets[0].Addresses, eps.Subsets[0].NotReadyAddresses = eps.Subsets[0].NotReadyAddresses, eps.Subsets[0].Addresses
+			now := skypbAllEndpointsToMap(spec, &eps)
+
+			diff := diffEndpoints(spec, last, now, false)
+			So(diff.InstEndpoints, ShouldHaveLength, 2)
+			for _, ep := range diff.InstEndpoints {
+				if ep.Host == "192.168.1.1" {
+					So(ep.Op, ShouldEqual, OpNotReady)
+				} else {
+					So(ep.Op, ShouldEqual, pb.Operation_Add)
+				}
+			}
+		})
+
+		Convey("Not ready endpoints are withheld while skylb-api lacks OpNotReady", func() {
+			op := OpNotReady
+			OpNotReady = operation("NotReady-Undefined")
+			defer func() {
+				OpNotReady = op
+			}()
+
+			co := newClientObject(spec, "192.168.0.1:8000", newObserverQueue(make(chan *EndpointsUpdate, 1)), ObserverOptions{IncludeNotReady: true}, nil)
+			defer co.Close()
+			So(co.includeNotReady, ShouldBeFalse)
+		})
+	})
+}
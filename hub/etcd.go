@@ -0,0 +1,254 @@
+package hub
+
+import (
+	"path"
+	"sort"
+	"time"
+
+	etcd "github.com/coreos/etcd/client"
+	"github.com/golang/glog"
+	"golang.org/x/net/context"
+
+	"github.com/binchencoder/skylb-api/prefix"
+	"github.com/binchencoder/skylb-api/util"
+)
+
+var (
+	getOpts = etcd.GetOptions{
+		Recursive: true,
+	}
+	deleteOpts = etcd.DeleteOptions{
+		Recursive: true,
+	}
+)
+
+// etcdRegistry implements interface Registry with etcd v2 API.
+type etcdRegistry struct {
+	cli etcd.KeysAPI
+}
+
+func (er *etcdRegistry) List(ctx context.Context, key string) ([]*KeyValue, uint64, error) {
+	resp, err := er.cli.Get(ctx, key, &getOpts)
+	if err != nil {
+		if e, ok := err.(etcd.Error); ok && e.Code == etcd.ErrorCodeKeyNotFound {
+			return nil, e.Index, ErrKeyNotFound
+		}
+		return nil, 0, err
+	}
+
+	kvs := []*KeyValue{}
+	if resp.Node != nil {
+		kvs = flattenNode(resp.Node, kvs)
+	}
+	return kvs, resp.Index, nil
+}
+
+func (er *etcdRegistry) Put(ctx context.Context, key, value string, ttl time.Duration) error {
+	opts := etcd.SetOptions{
+		TTL: ttl,
+	}
+	glog.V(6).Infof("etcd set %#v -- %#v | %#v\n", key, value, opts)
+	_, err := er.cli.Set(ctx, key, value, &opts)
+	return err
+}
+
+func (er *etcdRegistry) Refresh(ctx context.Context, key string, ttl time.Duration) error {
+	opts := etcd.SetOptions{
+		TTL:     ttl,
+		Refresh: true,
+	}
+	glog.V(6).Infof("etcd set %#v -- %#v | %#v\n", key, "", opts)
+	if _, err := er.cli.Set(ctx, key, "", &opts); err != nil {
+		if e, ok := err.(etcd.Error); ok && e.Code == etcd.ErrorCodeKeyNotFound {
+			return ErrKeyNotFound
+		}
+		return err
+	}
+	return nil
+}
+
+// Update sets the value with the remaining TTL of the key, as long as the
+// key is not changed in between.
+func (er *etcdRegistry) Update(ctx context.Context, key, value string) error {
+	resp, err := er.cli.Get(ctx, key, nil)
+	if err != nil {
+		if e, ok := err.(etcd.Error); ok && e.Code == etcd.ErrorCodeKeyNotFound {
+			return ErrKeyNotFound
+		}
+		return err
+	}
+
+	opts := etcd.SetOptions{
+		PrevExist: etcd.PrevExist,
+		PrevIndex: resp.Node.ModifiedIndex,
+		TTL:       time.Duration(resp.Node.TTL) * time.Second,
+	}
+	if resp.Node.Expiration != nil && opts.TTL <= 0 {
+		// About to expire, which must not turn it into a static key.
+		opts.TTL = time.Second
+	}
+	glog.V(6).Infof("etcd set %#v -- %#v | %#v\n", key, value, opts)
+	if _, err := er.cli.Set(ctx, key, value, &opts); err != nil {
+		if e, ok := err.(etcd.Error); ok && e.Code == etcd.ErrorCodeKeyNotFound {
+			return ErrKeyNotFound
+		}
+		return err
+	}
+	return nil
+}
+
+func (er *etcdRegistry) Delete(ctx context.Context, key string) error {
+	if _, err := er.cli.Delete(ctx, key, &deleteOpts); err != nil {
+		if e, ok := err.(etcd.Error); ok && e.Code == etcd.ErrorCodeKeyNotFound {
+			return ErrKeyNotFound
+		}
+		return err
+	}
+	return nil
+}
+
+func (er *etcdRegistry) Watch(key string, afterIndex uint64) Watcher {
+	opts := etcd.WatcherOptions{
+		AfterIndex: afterIndex,
+		Recursive:  true,
+	}
+	return &etcdWatcher{
+		w: er.cli.Watcher(key, &opts),
+	}
+}
+
+// etcdWatcher implements interface Watcher with etcd v2 API.
+type etcdWatcher struct {
+	w etcd.Watcher
+}
+
+func (ew *etcdWatcher) Next(ctx context.Context) (*Event, error) {
+	resp, err := ew.w.Next(ctx)
+	glog.V(4).Infof("Watched: %+v", resp)
+	if err != nil {
+		if e, ok := err.(etcd.Error); ok {
+			if e.Code == etcd.ErrorCodeEventIndexCleared ||
+				e.Code == etcd.ErrorCodeWatcherCleared {
+				glog.Errorf("Abandon watcher, %v", err)
+				return nil, ErrWatchReset
+			}
+		}
+		return nil, err
+	}
+
+	ev := Event{}
+	switch resp.Action {
+	case util.ActionCreate, util.ActionSet, "update", "compareAndSwap":
+		ev.Type = EventPut
+	case util.ActionDelete, "compareAndDelete":
+		ev.Type = EventDelete
+	case util.ActionExpire:
+		ev.Type = EventExpire
+	default:
+		glog.Errorf("Unexpected action %s, ignore.", resp.Action)
+		return ew.Next(ctx)
+	}
+	if resp.Node != nil {
+		ev.Key = resp.Node.Key
+		ev.Value = resp.Node.Value
+		ev.Index = resp.Node.ModifiedIndex
+	}
+	if resp.PrevNode != nil {
+		ev.Key = resp.PrevNode.Key
+		ev.PrevValue = resp.PrevNode.Value
+	}
+	return &ev, nil
+}
+
+// NewEtcdRegistry returns a Registry backed by the given etcd v2 client.
+func NewEtcdRegistry(cli etcd.KeysAPI) Registry {
+	prefix.Init(cli)
+	return &etcdRegistry{
+		cli: cli,
+	}
+}
+
+func flattenNode(node *etcd.Node, kvs []*KeyValue) []*KeyValue {
+	if len(node.Nodes) == 0 {
+		if node.Dir {
+			return kvs
+		}
+		return append(kvs, &KeyValue{
+			Key:   node.Key,
+			Value: node.Value,
+		})
+	}
+	for _, n := range node.Nodes {
+		kvs = flattenNode(n, kvs)
+	}
+	return kvs
+}
+
+// kvsToNode rebuilds an etcd v2 node tree rooted at the given key from the
+// flat key/values returned by Registry.List.
+func kvsToNode(root string, kvs []*KeyValue) *etcd.Node {
+	rootNode := &etcd.Node{
+		Key: root,
+		Dir: true,
+	}
+	dirs := map[string]*etcd.Node{
+		root: rootNode,
+	}
+
+	var mkdir func(key string) *etcd.Node
+	mkdir = func(key string) *etcd.Node {
+		if n, ok := dirs[key]; ok {
+			return n
+		}
+		n := &etcd.Node{
+			Key: key,
+			Dir: true,
+		}
+		dirs[key] = n
+		parent := mkdir(path.Dir(key))
+		parent.Nodes = append(parent.Nodes, n)
+		return n
+	}
+
+	sorted := make([]*KeyValue, len(kvs))
+	copy(sorted, kvs)
+	sort.Slice(sorted, func(i, j int) bool {
+		return sorted[i].Key < sorted[j].Key
+	})
+	for _, kv := range sorted {
+		if kv.Key == root || !keyUnder(kv.Key, root) {
+			continue
+		}
+		parent := mkdir(path.Dir(kv.Key))
+		parent.Nodes = append(parent.Nodes, &etcd.Node{
+			Key:   kv.Key,
+			Value: kv.Value,
+		})
+	}
+	return rootNode
+}
+
+// eventToResponse converts the registry event to an etcd v2 response.
+func eventToResponse(ev *Event) *etcd.Response {
+	resp := etcd.Response{
+		Node: &etcd.Node{
+			Key:           ev.Key,
+			Value:         ev.Value,
+			ModifiedIndex: ev.Index,
+		},
+		PrevNode: &etcd.Node{
+			Key:   ev.Key,
+			Value: ev.PrevValue,
+		},
+		Index: ev.Index,
+	}
+	switch ev.Type {
+	case EventPut:
+		resp.Action = util.ActionSet
+	case EventDelete:
+		resp.Action = util.ActionDelete
+	case EventExpire:
+		resp.Action = util.ActionExpire
+	}
+	return &resp
+}
@@ -0,0 +1,351 @@
+package hub
+
+import (
+	"sync"
+	"time"
+
+	"github.com/golang/glog"
+	"go.etcd.io/etcd/api/v3/mvccpb"
+	"go.etcd.io/etcd/api/v3/v3rpc/rpctypes"
+	clientv3 "go.etcd.io/etcd/client/v3"
+	"golang.org/x/net/context"
+
+	"github.com/binchencoder/letsgo/strings"
+)
+
+var (
+	etcd3DialTimeout = 5 * time.Second
+
+	// etcd3LeaseSweepInterval is the min interval between two sweeps of
+	// the leases which have expired without being refreshed.
+	etcd3LeaseSweepInterval = time.Minute
+)
+
+// etcd3Lease is the lease a key is attached to.
+type etcd3Lease struct {
+	id       clientv3.LeaseID
+	ttl      int64     // In seconds.
+	expireAt time.Time // When the lease expires if not kept alive.
+}
+
+// etcd3Registry implements interface Registry with etcd v3 API.
+//
+// Instead of refreshing the TTL of each key, every key put with a TTL is
+// attached to its own lease, and Refresh sends a keep-alive for that lease.
+// Since a ReportLoad stream reports exactly one endpoint, each stream holds
+// one lease for its whole life time. A lease is forgotten once it expires,
+// which is also what happens after its stream ends.
+type etcd3Registry struct {
+	kv      clientv3.KV
+	lease   clientv3.Lease
+	watcher clientv3.Watcher
+
+	leasesLock sync.Mutex
+	leases     map[string]*etcd3Lease
+	sweptAt    time.Time
+
+	now func() time.Time
+}
+
+func (er *etcd3Registry) List(ctx context.Context, key string) ([]*KeyValue, uint64, error) {
+	resp, err := er.kv.Get(ctx, key, clientv3.WithPrefix(), clientv3.WithSort(clientv3.SortByKey, clientv3.SortAscend))
+	if err != nil {
+		return nil, 0, err
+	}
+
+	kvs := []*KeyValue{}
+	for _, kv := range resp.Kvs {
+		if !keyUnder(string(kv.Key), key) {
+			continue
+		}
+		kvs = append(kvs, &KeyValue{
+			Key:   string(kv.Key),
+			Value: string(kv.Value),
+		})
+	}
+	if len(kvs) == 0 {
+		return nil, uint64(resp.Header.Revision), ErrKeyNotFound
+	}
+	return kvs, uint64(resp.Header.Revision), nil
+}
+
+func (er *etcd3Registry) Put(ctx context.Context, key, value string, ttl time.Duration) error {
+	glog.V(6).Infof("etcd3 put %#v -- %#v | %s\n", key, value, ttl)
+	if ttl <= 0 {
+		_, err := er.kv.Put(ctx, key, value)
+		return err
+	}
+
+	secs := int64(ttl / time.Second)
+	if secs < 1 {
+		secs = 1
+	}
+
+	// Reuse the lease the key is attached to, so that putting a key again
+	// doesn't leave a lease behind.
+	if l := er.getLease(key); l != nil && l.ttl == secs {
+		_, err := er.kv.Put(ctx, key, value, clientv3.WithLease(l.id))
+		if err != rpctypes.ErrLeaseNotFound {
+			return err
+		}
+		er.dropLease(key, l.id)
+	}
+
+	resp, err := er.lease.Grant(ctx, secs)
+	if err != nil {
+		return err
+	}
+	if _, err := er.kv.Put(ctx, key, value, clientv3.WithLease(resp.ID)); err != nil {
+		return err
+	}
+
+	er.leasesLock.Lock()
+	prev := er.leases[key]
+	er.leases[key] = &etcd3Lease{
+		id:       resp.ID,
+		ttl:      secs,
+		expireAt: er.now().Add(time.Duration(resp.TTL) * time.Second),
+	}
+	er.leasesLock.Unlock()
+
+	if prev != nil && prev.id != resp.ID {
+		// The key has been moved to the new lease, so it's safe to revoke
+		// the previous one.
+		go func() {
+			if _, err := er.lease.Revoke(context.Background(), prev.id); err != nil {
+				glog.V(3).Infof("Failed to revoke lease %x of key %s, %v", prev.id, key, err)
+			}
+		}()
+	}
+	return nil
+}
+
+// Refresh sends a keep-alive for the lease of the given key. The ttl is
+// ignored since a lease keeps the TTL it was granted with.
+func (er *etcd3Registry) Refresh(ctx context.Context, key string, ttl time.Duration) error {
+	l := er.getLease(key)
+	if l == nil {
+		return ErrKeyNotFound
+	}
+
+	glog.V(6).Infof("etcd3 keep-alive %#v | %x\n", key, l.id)
+	resp, err := er.lease.KeepAliveOnce(ctx, l.id)
+	if err != nil {
+		if err == rpctypes.ErrLeaseNotFound {
+			er.dropLease(key, l.id)
+			return ErrKeyNotFound
+		}
+		return err
+	}
+
+	er.leasesLock.Lock()
+	if cur := er.leases[key]; cur != nil && cur.id == l.id {
+		cur.expireAt = er.now().Add(time.Duration(resp.TTL) * time.Second)
+	}
+	er.leasesLock.Unlock()
+	return nil
+}
+
+// getLease returns the unexpired lease of the given key, or nil. It also
+// forgets the leases which have expired, at most once per
+// etcd3LeaseSweepInterval.
+func (er *etcd3Registry) getLease(key string) *etcd3Lease {
+	er.leasesLock.Lock()
+	defer er.leasesLock.Unlock()
+
+	now := er.now()
+	if now.Sub(er.sweptAt) >= etcd3LeaseSweepInterval {
+		for k, l := range er.leases {
+			if !now.Before(l.expireAt) {
+				delete(er.leases, k)
+			}
+		}
+		er.sweptAt = now
+	}
+
+	l, ok := er.leases[key]
+	if !ok {
+		return nil
+	}
+	if !now.Before(l.expireAt) {
+		delete(er.leases, key)
+		return nil
+	}
+	cp := *l
+	return &cp
+}
+
+// dropLease forgets the lease of the given key if it's still the given one.
+func (er *etcd3Registry) dropLease(key string, id clientv3.LeaseID) {
+	er.leasesLock.Lock()
+	if l := er.leases[key]; l != nil && l.id == id {
+		delete(er.leases, key)
+	}
+	er.leasesLock.Unlock()
+}
+
+// Update puts the value only if the key exists, and keeps the lease which
+// the key is attached to.
+func (er *etcd3Registry) Update(ctx context.Context, key, value string) error {
+	glog.V(6).Infof("etcd3 update %#v -- %#v\n", key, value)
+	resp, err := er.kv.Txn(ctx).
+		If(clientv3.Compare(clientv3.CreateRevision(key), ">", 0)).
+		Then(clientv3.OpPut(key, value, clientv3.WithIgnoreLease())).
+		Commit()
+	if err != nil {
+		return err
+	}
+	if !resp.Succeeded {
+		return ErrKeyNotFound
+	}
+	return nil
+}
+
+func (er *etcd3Registry) Delete(ctx context.Context, key string) error {
+	resp, err := er.kv.Delete(ctx, key)
+	if err != nil {
+		return err
+	}
+	deleted := resp.Deleted
+
+	resp, err = er.kv.Delete(ctx, key+"/", clientv3.WithPrefix())
+	if err != nil {
+		return err
+	}
+	deleted += resp.Deleted
+
+	if deleted == 0 {
+		return ErrKeyNotFound
+	}
+	return nil
+}
+
+func (er *etcd3Registry) Watch(key string, afterIndex uint64) Watcher {
+	return &etcd3Watcher{
+		w:   er.watcher,
+		key: key,
+		rev: int64(afterIndex),
+	}
+}
+
+// etcd3Watcher implements interface Watcher with etcd v3 API. It resumes
+// from the last seen revision when the underlying watch channel breaks.
+type etcd3Watcher struct {
+	w   clientv3.Watcher
+	key string
+	rev int64 // The last seen revision.
+
+	wch     clientv3.WatchChan
+	cancel  context.CancelFunc
+	pending []*Event
+}
+
+func (ew *etcd3Watcher) Next(ctx context.Context) (*Event, error) {
+	for len(ew.pending) == 0 {
+		if ew.wch == nil {
+			opts := []clientv3.OpOption{
+				clientv3.WithPrefix(),
+				clientv3.WithPrevKV(),
+				clientv3.WithProgressNotify(),
+			}
+			if ew.rev > 0 {
+				opts = append(opts, clientv3.WithRev(ew.rev+1))
+			}
+			var wctx context.Context
+			wctx, ew.cancel = context.WithCancel(context.Background())
+			ew.wch = ew.w.Watch(wctx, ew.key, opts...)
+		}
+
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case resp, ok := <-ew.wch:
+			if !ok {
+				glog.Warningf("Watch channel of %s closed, resume from revision %d.", ew.key, ew.rev)
+				ew.reset()
+				continue
+			}
+			if resp.CompactRevision != 0 || resp.Err() == rpctypes.ErrCompacted {
+				glog.Errorf("Abandon watcher, revision %d has been compacted", ew.rev)
+				ew.reset()
+				ew.rev = 0
+				return nil, ErrWatchReset
+			}
+			if err := resp.Err(); err != nil {
+				ew.reset()
+				return nil, err
+			}
+
+			for _, e := range resp.Events {
+				k := string(e.Kv.Key)
+				if !keyUnder(k, ew.key) {
+					continue
+				}
+				ev := Event{
+					Key:   k,
+					Index: uint64(e.Kv.ModRevision),
+				}
+				switch e.Type {
+				case mvccpb.PUT:
+					ev.Type = EventPut
+					ev.Value = string(e.Kv.Value)
+				case mvccpb.DELETE:
+					ev.Type = EventDelete
+				}
+				if e.PrevKv != nil {
+					ev.PrevValue = string(e.PrevKv.Value)
+				}
+				ew.pending = append(ew.pending, &ev)
+			}
+			if resp.Header.Revision > ew.rev {
+				ew.rev = resp.Header.Revision
+			}
+		}
+	}
+
+	ev := ew.pending[0]
+	ew.pending = ew.pending[1:]
+	return ev, nil
+}
+
+func (ew *etcd3Watcher) reset() {
+	if ew.cancel != nil {
+		ew.cancel()
+	}
+	ew.wch = nil
+	ew.cancel = nil
+}
+
+// NewEtcd3Registry returns a Registry backed by the given etcd v3 client.
+func NewEtcd3Registry(cli *clientv3.Client) Registry {
+	return &etcd3Registry{
+		kv:      cli,
+		lease:   cli,
+		watcher: cli,
+		leases:  make(map[string]*etcd3Lease),
+		now:     time.Now,
+	}
+}
+
+// CreateEtcd3Client returns a new etcd v3 client.
+func CreateEtcd3Client(etcdEndpoints string) *clientv3.Client {
+	eps := strings.CsvToSlice(etcdEndpoints)
+	if len(eps) == 0 {
+		glog.Fatalln("Flag --etcd-endpoints is required.")
+	}
+
+	glog.Infof("Use etcd v3 endpoints %s.", eps)
+
+	for {
+		cli, err := clientv3.New(clientv3.Config{
+			Endpoints:   eps,
+			DialTimeout: etcd3DialTimeout,
+		})
+		if err != nil {
+			glog.Errorf("Failed to create etcd v3 client, %v. Will retry after one second.", err)
+			time.Sleep(time.Second)
+			continue
+		}
+		return cli
+	}
+}
@@ -0,0 +1,263 @@
+package hub
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	. "github.com/smartystreets/goconvey/convey"
+	pb "go.etcd.io/etcd/api/v3/etcdserverpb"
+	"go.etcd.io/etcd/api/v3/mvccpb"
+	"go.etcd.io/etcd/api/v3/v3rpc/rpctypes"
+	clientv3 "go.etcd.io/etcd/client/v3"
+	"golang.org/x/net/context"
+)
+
+// fakeEtcd3 implements the parts of clientv3.KV, clientv3.Lease and
+// clientv3.Watcher which etcd3Registry uses.
+type fakeEtcd3 struct {
+	clientv3.KV
+	clientv3.Lease
+	clientv3.Watcher
+
+	lock sync.Mutex
+
+	getResp *clientv3.GetResponse
+	puts    int
+
+	nextLease  clientv3.LeaseID
+	grants     int
+	revoked    []clientv3.LeaseID
+	keepAlives []clientv3.LeaseID
+	expired    map[clientv3.LeaseID]bool
+
+	watchRevs []int64
+	watchChs  []chan clientv3.WatchResponse
+	watchCh   chan chan clientv3.WatchResponse
+}
+
+func newFakeEtcd3() *fakeEtcd3 {
+	return &fakeEtcd3{
+		nextLease: 100,
+		expired:   map[clientv3.LeaseID]bool{},
+		watchCh:   make(chan chan clientv3.WatchResponse, 10),
+	}
+}
+
+func (f *fakeEtcd3) Get(ctx context.Context, key string, opts ...clientv3.OpOption) (*clientv3.GetResponse, error) {
+	return f.getResp, nil
+}
+
+func (f *fakeEtcd3) Put(ctx context.Context, key, val string, opts ...clientv3.OpOption) (*clientv3.PutResponse, error) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	f.puts++
+	return &clientv3.PutResponse{}, nil
+}
+
+func (f *fakeEtcd3) Grant(ctx context.Context, ttl int64) (*clientv3.LeaseGrantResponse, error) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	f.grants++
+	f.nextLease++
+	return &clientv3.LeaseGrantResponse{ID: f.nextLease, TTL: ttl}, nil
+}
+
+func (f *fakeEtcd3) Revoke(ctx context.Context, id clientv3.LeaseID) (*clientv3.LeaseRevokeResponse, error) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	f.revoked = append(f.revoked, id)
+	return &clientv3.LeaseRevokeResponse{}, nil
+}
+
+func (f *fakeEtcd3) KeepAliveOnce(ctx context.Context, id clientv3.LeaseID) (*clientv3.LeaseKeepAliveResponse, error) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	if f.expired[id] {
+		return nil, rpctypes.ErrLeaseNotFound
+	}
+	f.keepAlives = append(f.keepAlives, id)
+	return &clientv3.LeaseKeepAliveResponse{ID: id, TTL: 10}, nil
+}
+
+func (f *fakeEtcd3) Watch(ctx context.Context, key string, opts ...clientv3.OpOption) clientv3.WatchChan {
+	ch := make(chan clientv3.WatchResponse, 10)
+	f.lock.Lock()
+	f.watchRevs = append(f.watchRevs, clientv3.OpGet(key, opts...).Rev())
+	f.watchChs = append(f.watchChs, ch)
+	f.lock.Unlock()
+	f.watchCh <- ch
+	return ch
+}
+
+func (f *fakeEtcd3) Close() error {
+	return nil
+}
+
+func TestEtcd3Registry(t *testing.T) {
+	Convey("Operate on an etcd v3 registry", t, func() {
+		ctx := context.Background()
+		f := newFakeEtcd3()
+		now := time.Now()
+		reg := &etcd3Registry{
+			kv:      f,
+			lease:   f,
+			watcher: f,
+			leases:  make(map[string]*etcd3Lease),
+			now: func() time.Time {
+				return now
+			},
+		}
+		key := keyService1 + "/172.0.10.1_8080"
+
+		Convey("List keys under a prefix", func() {
+			f.getResp = &clientv3.GetResponse{
+				Header: &pb.ResponseHeader{Revision: 7},
+				Kvs: []*mvccpb.KeyValue{
+					{Key: []byte(keyService1 + "/172.0.10.1_8080"), Value: []byte("a")},
+					{Key: []byte(keyService1 + "/172.0.10.2_8080"), Value: []byte("b")},
+					{Key: []byte(keyService1 + "x/172.0.10.3_8080"), Value: []byte("c")},
+				},
+			}
+			kvs, index, err := reg.List(ctx, keyService1)
+			So(err, ShouldBeNil)
+			So(index, ShouldEqual, 7)
+			So(kvs, ShouldHaveLength, 2)
+			So(kvs[0].Key, ShouldEqual, keyService1+"/172.0.10.1_8080")
+			So(kvs[1].Value, ShouldEqual, "b")
+
+			f.getResp = &clientv3.GetResponse{
+				Header: &pb.ResponseHeader{Revision: 8},
+			}
+			_, index, err = reg.List(ctx, keyService1)
+			So(err, ShouldEqual, ErrKeyNotFound)
+			So(index, ShouldEqual, 8)
+		})
+
+		Convey("Put keys without a TTL", func() {
+			So(reg.Put(ctx, key, "a", 0), ShouldBeNil)
+			So(f.puts, ShouldEqual, 1)
+			So(f.grants, ShouldEqual, 0)
+			So(reg.Refresh(ctx, key, 0), ShouldEqual, ErrKeyNotFound)
+		})
+
+		Convey("Put a key again reusing its lease", func() {
+			So(reg.Put(ctx, key, "a", 10*time.Second), ShouldBeNil)
+			So(reg.Put(ctx, key, "b", 10*time.Second), ShouldBeNil)
+			So(f.puts, ShouldEqual, 2)
+			So(f.grants, ShouldEqual, 1)
+			So(f.revoked, ShouldBeEmpty)
+			So(reg.leases, ShouldHaveLength, 1)
+		})
+
+		Convey("Refresh keeps the lease alive", func() {
+			So(reg.Put(ctx, key, "a", 10*time.Second), ShouldBeNil)
+			id := reg.leases[key].id
+
+			now = now.Add(8 * time.Second)
+			So(reg.Refresh(ctx, key, 10*time.Second), ShouldBeNil)
+			So(f.keepAlives, ShouldResemble, []clientv3.LeaseID{id})
+			So(reg.leases[key].expireAt, ShouldResemble, now.Add(10*time.Second))
+
+			Convey("Forget the lease once it's gone from etcd", func() {
+				f.expired[id] = true
+				So(reg.Refresh(ctx, key, 10*time.Second), ShouldEqual, ErrKeyNotFound)
+				So(reg.leases, ShouldBeEmpty)
+
+				So(reg.Put(ctx, key, "a", 10*time.Second), ShouldBeNil)
+				So(f.grants, ShouldEqual, 2)
+				So(reg.leases[key].id, ShouldNotEqual, id)
+			})
+
+			Convey("Forget the lease once it expires", func() {
+				now = now.Add(11 * time.Second)
+				So(reg.Refresh(ctx, key, 10*time.Second), ShouldEqual, ErrKeyNotFound)
+				So(reg.leases, ShouldBeEmpty)
+			})
+		})
+
+		Convey("Sweep the leases which are no longer refreshed", func() {
+			other := keyService1 + "/172.0.10.2_8080"
+			So(reg.Put(ctx, key, "a", 10*time.Second), ShouldBeNil)
+			So(reg.Put(ctx, other, "b", 10*time.Second), ShouldBeNil)
+
+			now = now.Add(etcd3LeaseSweepInterval)
+			So(reg.Refresh(ctx, key, 10*time.Second), ShouldEqual, ErrKeyNotFound)
+			So(reg.leases, ShouldBeEmpty)
+		})
+
+		Convey("Watch a prefix", func() {
+			w := reg.Watch(keyService1, 5)
+			put := func(ch chan clientv3.WatchResponse, rev int64, k, v string) {
+				ch <- clientv3.WatchResponse{
+					Header: pb.ResponseHeader{Revision: rev},
+					Events: []*clientv3.Event{
+						{
+							Type: mvccpb.PUT,
+							Kv: &mvccpb.KeyValue{
+								Key:         []byte(k),
+								Value:       []byte(v),
+								ModRevision: rev,
+							},
+						},
+					},
+				}
+			}
+
+			go func() {
+				ch := <-f.watchCh
+				put(ch, 6, key, "a")
+			}()
+			ev, err := w.Next(ctx)
+			So(err, ShouldBeNil)
+			So(ev.Type, ShouldEqual, EventPut)
+			So(ev.Key, ShouldEqual, key)
+			So(ev.Value, ShouldEqual, "a")
+			So(ev.Index, ShouldEqual, 6)
+
+			Convey("Resume from the last seen revision", func() {
+				go func() {
+					close(f.watchChs[0])
+					ch := <-f.watchCh
+					ch <- clientv3.WatchResponse{
+						Header: pb.ResponseHeader{Revision: 7},
+						Events: []*clientv3.Event{
+							{
+								Type: mvccpb.DELETE,
+								Kv: &mvccpb.KeyValue{
+									Key:         []byte(key),
+									ModRevision: 7,
+								},
+								PrevKv: &mvccpb.KeyValue{
+									Key:   []byte(key),
+									Value: []byte("a"),
+								},
+							},
+						},
+					}
+				}()
+				ev, err := w.Next(ctx)
+				So(err, ShouldBeNil)
+				So(ev.Type, ShouldEqual, EventDelete)
+				So(ev.PrevValue, ShouldEqual, "a")
+				So(f.watchRevs, ShouldResemble, []int64{6, 7})
+			})
+
+			Convey("Reset the watcher on compaction", func() {
+				go func() {
+					f.watchChs[0] <- clientv3.WatchResponse{CompactRevision: 10}
+				}()
+				_, err := w.Next(ctx)
+				So(err, ShouldEqual, ErrWatchReset)
+
+				go func() {
+					put(<-f.watchCh, 11, key, "b")
+				}()
+				ev, err := w.Next(ctx)
+				So(err, ShouldBeNil)
+				So(ev.Value, ShouldEqual, "b")
+				So(f.watchRevs, ShouldResemble, []int64{6, 0})
+			})
+		})
+	})
+}
@@ -0,0 +1,201 @@
+package hub
+
+import (
+	"bytes"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"reflect"
+	"sync"
+	"time"
+
+	"github.com/golang/glog"
+	api "k8s.io/api/core/v1"
+	"sigs.k8s.io/yaml"
+)
+
+var (
+	endpointsFile         = flag.String("endpoints-file", "", "The YAML/JSON file of static service endpoints. If set, it's used as the endpoints source instead of etcd")
+	endpointsFileInterval = flag.Duration("endpoints-file-interval", 2*time.Second, "The interval to check the endpoints file for changes")
+
+	fileEps *fileEndpoints
+)
+
+// FileEndpoint is one endpoint in the endpoints file.
+type FileEndpoint struct {
+	Host   string `json:"host"`
+	Port   int32  `json:"port"`
+	Weight int32  `json:"weight,omitempty"`
+}
+
+// FileService is one service port in the endpoints file. The endpoints
+// file is a list of FileService, see README.md for an example.
+type FileService struct {
+	Namespace string          `json:"namespace"`
+	Service   string          `json:"service"`
+	PortName  string          `json:"portName"`
+	Endpoints []*FileEndpoint `json:"endpoints"`
+}
+
+// fileEndpoints holds the endpoints loaded from the endpoints file.
+type fileEndpoints struct {
+	lock sync.RWMutex
+
+	path     string
+	content  []byte
+	services map[string]*api.Endpoints // Keyed by service key.
+}
+
+// load reads and parses the endpoints file. It returns true if the file
+// content has changed since the last load.
+func (fe *fileEndpoints) load() (bool, error) {
+	b, err := ioutil.ReadFile(fe.path)
+	if err != nil {
+		return false, err
+	}
+
+	fe.lock.RLock()
+	same := bytes.Equal(b, fe.content)
+	fe.lock.RUnlock()
+	if same {
+		return false, nil
+	}
+
+	services, err := parseEndpointsFile(b)
+	if err != nil {
+		return false, err
+	}
+
+	fe.lock.Lock()
+	fe.content = b
+	fe.services = services
+	fe.lock.Unlock()
+	return true, nil
+}
+
+// get returns the endpoints of the given service key, or an empty
+// endpoints if the service is absent from the file.
+func (fe *fileEndpoints) get(key string) *api.Endpoints {
+	fe.lock.RLock()
+	defer fe.lock.RUnlock()
+
+	if eps, ok := fe.services[key]; ok {
+		return eps.DeepCopy()
+	}
+	return &api.Endpoints{}
+}
+
+func parseEndpointsFile(b []byte) (map[string]*api.Endpoints, error) {
+	svcs := []*FileService{}
+	if err := yaml.Unmarshal(b, &svcs); err != nil {
+		return nil, err
+	}
+
+	services := map[string]*api.Endpoints{}
+	for i, svc := range svcs {
+		if svc.Service == "" || svc.PortName == "" {
+			return nil, fmt.Errorf("service name and port name are required in entry %d", i)
+		}
+		if svc.Namespace == "" {
+			svc.Namespace = defaultNamespace
+		}
+
+		key := calculateServiceKey(svc.Namespace, svc.Service)
+		eps, ok := services[key]
+		if !ok {
+			eps = &api.Endpoints{}
+			eps.Name = svc.Service
+			eps.Namespace = svc.Namespace
+			services[key] = eps
+		}
+
+		for _, ep := range svc.Endpoints {
+			eps.Subsets = append(eps.Subsets, api.EndpointSubset{
+				Addresses: []api.EndpointAddress{
+					{
+						IP: ep.Host,
+						TargetRef: &api.ObjectReference{
+							Kind:      defaultKind,
+							Namespace: svc.Namespace,
+						},
+					},
+				},
+				Ports: []api.EndpointPort{
+					{
+						Name: svc.PortName,
+						Port: ep.Port,
+					},
+				},
+			})
+			if ep.Weight != 0 {
+				if eps.Labels == nil {
+					eps.Labels = make(map[string]string)
+				}
+				eps.Labels[calculateWeightKey(ep.Host, ep.Port)] = fmt.Sprintf("%d", ep.Weight)
+			}
+		}
+	}
+	return services, nil
+}
+
+func withinFile() bool {
+	return *endpointsFile != ""
+}
+
+// initFile loads the endpoints file. It has to succeed since there's no
+// other endpoints source.
+func (eh *endpointsHub) initFile() {
+	fileEps = &fileEndpoints{
+		path: *endpointsFile,
+	}
+	if _, err := fileEps.load(); err != nil {
+		glog.Fatalf("Failed to load endpoints file %s, %v", *endpointsFile, err)
+	}
+	glog.Infof("Use endpoints file %s as the endpoints source.", *endpointsFile)
+}
+
+func (eh *endpointsHub) fetchFileEndpoints(namespace, serviceName string) (*api.Endpoints, error) {
+	return fileEps.get(eh.calculateKey(namespace, serviceName)), nil
+}
+
+// startFileWatcher periodically checks the endpoints file and applies the
+// changes to observed services.
+func (eh *endpointsHub) startFileWatcher() {
+	for range time.Tick(*endpointsFileInterval) {
+		changed, err := fileEps.load()
+		if err != nil {
+			glog.Errorf("Failed to reload endpoints file %s, keep the current endpoints, %v", *endpointsFile, err)
+			continue
+		}
+		if changed {
+			glog.Infof("Endpoints file %s changed, reloaded.", *endpointsFile)
+			eh.applyFileEndpoints()
+		}
+	}
+}
+
+// applyFileEndpoints diffs the endpoints file against every observed
+// service and applies the endpoints of the services which have changed.
+func (eh *endpointsHub) applyFileEndpoints() {
+	sos := []*serviceObject{}
+	eh.WithRLock(func() error {
+		for _, so := range eh.services {
+			sos = append(sos, so)
+		}
+		return nil
+	})
+
+	for _, so := range sos {
+		eps := fileEps.get(eh.calculateKey(so.Spec().Namespace, so.Spec().ServiceName))
+
+		changed := false
+		so.WithRLock(func() error {
+			changed = !reflect.DeepEqual(so.endpoints, skypbAllEndpointsToMap(so.Spec(), eps))
+			return nil
+		})
+		if changed {
+			glog.V(3).Infof("Endpoints of service %s.%s changed in endpoints file.", so.Spec().Namespace, so.Spec().ServiceName)
+			eh.applyEndpoints(so, eps)
+		}
+	}
+}
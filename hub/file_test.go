@@ -0,0 +1,137 @@
+package hub
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	. "github.com/smartystreets/goconvey/convey"
+
+	pb "github.com/binchencoder/skylb-api/proto"
+)
+
+const (
+	endpointsFileV1 = `
+- namespace: default
+  service: service1
+  portName: port
+  endpoints:
+  - host: 172.0.10.1
+    port: 8080
+  - host: 172.0.10.2
+    port: 8080
+    weight: 20
+`
+	endpointsFileV2 = `[
+  {"namespace": "default", "service": "service1", "portName": "port", "endpoints": [
+    {"host": "172.0.10.2", "port": 8080, "weight": 20},
+    {"host": "172.0.10.3", "port": 8080}
+  ]}
+]`
+)
+
+func TestParseEndpointsFile(t *testing.T) {
+	spec := &pb.ServiceSpec{
+		Namespace:   namespace,
+		ServiceName: serviceName,
+		PortName:    portName,
+	}
+
+	Convey("Parse the endpoints file", t, func() {
+		Convey("In YAML", func() {
+			services, err := parseEndpointsFile([]byte(endpointsFileV1))
+			So(err, ShouldBeNil)
+			So(services, ShouldContainKey, keyService1)
+
+			epsMap := skypbEndpointsToMap(spec, services[keyService1])
+			So(epsMap, ShouldHaveLength, 2)
+			So(epsMap["172.0.10.1:8080"].Weight, ShouldEqual, 0)
+			So(epsMap["172.0.10.2:8080"].Weight, ShouldEqual, 20)
+		})
+
+		Convey("In JSON", func() {
+			services, err := parseEndpointsFile([]byte(endpointsFileV2))
+			So(err, ShouldBeNil)
+
+			epsMap := skypbEndpointsToMap(spec, services[keyService1])
+			So(epsMap, ShouldHaveLength, 2)
+			So(epsMap, ShouldContainKey, "172.0.10.3:8080")
+		})
+
+		Convey("Without port name", func() {
+			_, err := parseEndpointsFile([]byte(`[{"service": "service1"}]`))
+			So(err, ShouldNotBeNil)
+		})
+	})
+}
+
+func TestFileWatcher(t *testing.T) {
+	spec := &pb.ServiceSpec{
+		Namespace:   namespace,
+		ServiceName: serviceName,
+		PortName:    portName,
+	}
+
+	Convey("Reload the endpoints file and notify observers", t, func() {
+		dir, err := ioutil.TempDir("", "skylb")
+		So(err, ShouldBeNil)
+		defer os.RemoveAll(dir)
+
+		fname := filepath.Join(dir, "endpoints.yaml")
+		So(ioutil.WriteFile(fname, []byte(endpointsFileV1), 0644), ShouldBeNil)
+
+		fileEps = &fileEndpoints{
+			path: fname,
+		}
+		changed, err := fileEps.load()
+		So(err, ShouldBeNil)
+		So(changed, ShouldBeTrue)
+
+		eh := endpointsHub{
+			services: serviceMap{},
+		}
+		eps, err := eh.fetchFileEndpoints(namespace, serviceName)
+		So(err, ShouldBeNil)
+
+		so := newServiceObject(spec, nil)
+		eh.applyEndpoints(so, eps)
+		notifyCh := newTestObserver(so, "192.168.0.1:8000", ObserverOptions{})
+		eh.services[keyService1] = so
+
+		Convey("Unchanged file should not notify", func() {
+			changed, err := fileEps.load()
+			So(err, ShouldBeNil)
+			So(changed, ShouldBeFalse)
+
+			eh.applyFileEndpoints()
+			So(notifyCh, ShouldHaveLength, 0)
+		})
+
+		Convey("Changed file should notify", func() {
+			So(ioutil.WriteFile(fname, []byte(endpointsFileV2), 0644), ShouldBeNil)
+			changed, err := fileEps.load()
+			So(err, ShouldBeNil)
+			So(changed, ShouldBeTrue)
+
+			eh.applyFileEndpoints()
+			select {
+			case up := <-notifyCh:
+				So(up.Endpoints.InstEndpoints, ShouldHaveLength, 2)
+			case <-time.After(time.Second):
+				So("timeout", ShouldBeEmpty)
+			}
+			So(so.endpoints, ShouldContainKey, "172.0.10.3:8080")
+		})
+
+		Convey("Broken file should keep the current endpoints", func() {
+			So(ioutil.WriteFile(fname, []byte("[{"), 0644), ShouldBeNil)
+			_, err := fileEps.load()
+			So(err, ShouldNotBeNil)
+
+			eps, _ := eh.fetchFileEndpoints(namespace, serviceName)
+			So(skypbEndpointsToMap(spec, eps), ShouldHaveLength, 2)
+		})
+	})
+}
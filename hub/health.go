@@ -0,0 +1,279 @@
+package hub
+
+import (
+	"flag"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/golang/glog"
+	prom "github.com/prometheus/client_golang/prometheus"
+	"golang.org/x/net/context"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	hpb "google.golang.org/grpc/health/grpc_health_v1"
+	"google.golang.org/grpc/status"
+)
+
+var (
+	healthCheck                   = flag.Bool("health-check", false, "Whether to check the gRPC health of the endpoints of the services being observed, and withhold the unhealthy ones")
+	healthCheckInterval           = flag.Duration("health-check-interval", 10*time.Second, "The interval of endpoint health checks")
+	healthCheckTimeout            = flag.Duration("health-check-timeout", 2*time.Second, "The timeout of an endpoint health check")
+	healthCheckUnhealthyThreshold = flag.Int("health-check-unhealthy-threshold", 3, "The consecutive failed health checks to mark an endpoint unhealthy")
+	healthCheckHealthyThreshold   = flag.Int("health-check-healthy-threshold", 2, "The consecutive passed health checks to mark an unhealthy endpoint healthy again")
+	healthCheckConcurrency        = flag.Int("health-check-concurrency", 16, "The most endpoint health checks in flight at once, across all services")
+
+	healthStateChangeCounts = prom.NewCounterVec(
+		prom.CounterOpts{
+			Namespace: "infra",
+			Subsystem: "skylb",
+			Name:      "health_state_change_counts",
+			Help:      "SkyLB endpoint health state change counts, by service and new state.",
+		},
+		[]string{"service", "state"},
+	)
+
+	// checkEndpointHealth checks the health of the endpoint of the given
+	// address, replaced in tests.
+	checkEndpointHealth = checkGrpcHealth
+
+	// healthCheckSlots bounds the health checks in flight across all
+	// services, see --health-check-concurrency. It's created on first use,
+	// once the flags are parsed.
+	healthCheckSlots     chan struct{}
+	healthCheckSlotsOnce sync.Once
+)
+
+func init() {
+	prom.MustRegister(healthStateChangeCounts)
+}
+
+// checkGrpcHealth calls the gRPC health service of the endpoint of the
+// given address. An endpoint which doesn't implement it is only checked to
+// accept connections.
+func checkGrpcHealth(addr string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), *healthCheckTimeout)
+	defer cancel()
+
+	conn, err := grpc.DialContext(ctx, addr, grpc.WithInsecure(), grpc.WithBlock())
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	resp, err := hpb.NewHealthClient(conn).Check(ctx, &hpb.HealthCheckRequest{})
+	if status.Code(err) == codes.Unimplemented {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if resp.Status != hpb.HealthCheckResponse_SERVING {
+		return fmt.Errorf("status %s", resp.Status)
+	}
+	return nil
+}
+
+// acquireHealthCheck blocks until fewer than --health-check-concurrency
+// health checks are in flight, and returns the func to release the slot.
+func acquireHealthCheck() func() {
+	healthCheckSlotsOnce.Do(func() {
+		n := *healthCheckConcurrency
+		if n < 1 {
+			n = 1
+		}
+		healthCheckSlots = make(chan struct{}, n)
+	})
+	slots := healthCheckSlots
+	slots <- struct{}{}
+	return func() {
+		<-slots
+	}
+}
+
+// healthState tracks the health of the endpoints of a service. An endpoint
+// is marked unhealthy after --health-check-unhealthy-threshold consecutive
+// failed checks, and healthy again after --health-check-healthy-threshold
+// consecutive passed ones. It's guarded by the lock of the service object.
+type healthState struct {
+	// The endpoints of the service before the unhealthy ones are withheld.
+	endpoints serviceEndpoints
+
+	failures  map[string]int
+	successes map[string]int
+	unhealthy map[string]bool
+}
+
+func newHealthState() *healthState {
+	return &healthState{
+		endpoints: serviceEndpoints{},
+		failures:  map[string]int{},
+		successes: map[string]int{},
+		unhealthy: map[string]bool{},
+	}
+}
+
+// record records the result of a health check of the endpoint of the given
+// address, and returns true if its state changed.
+func (hs *healthState) record(service, addr string, err error) bool {
+	if err == nil {
+		hs.failures[addr] = 0
+		if !hs.unhealthy[addr] {
+			return false
+		}
+		hs.successes[addr]++
+		if hs.successes[addr] < *healthCheckHealthyThreshold {
+			return false
+		}
+		delete(hs.unhealthy, addr)
+		delete(hs.successes, addr)
+		glog.Infof("Endpoint %s of service %s is healthy again.", addr, service)
+		healthStateChangeCounts.WithLabelValues(service, "healthy").Inc()
+		return true
+	}
+
+	hs.successes[addr] = 0
+	hs.failures[addr]++
+	if hs.unhealthy[addr] || hs.failures[addr] < *healthCheckUnhealthyThreshold {
+		return false
+	}
+	hs.unhealthy[addr] = true
+	glog.Warningf("Endpoint %s of service %s is unhealthy after %d failed checks, withhold it, %v", addr, service, hs.failures[addr], err)
+	healthStateChangeCounts.WithLabelValues(service, "unhealthy").Inc()
+	return true
+}
+
+// forget drops the state of the endpoints which are gone.
+func (hs *healthState) forget() {
+	for _, m := range []map[string]int{hs.failures, hs.successes} {
+		for k := range m {
+			if _, ok := hs.endpoints[k]; !ok {
+				delete(m, k)
+			}
+		}
+	}
+	for k := range hs.unhealthy {
+		if _, ok := hs.endpoints[k]; !ok {
+			delete(hs.unhealthy, k)
+		}
+	}
+}
+
+// filter returns the given endpoints without the unhealthy ones. If none of
+// the ready ones is healthy, they are all kept, since withholding all of
+// them would only make things worse.
+func (hs *healthState) filter(service string, eps serviceEndpoints) serviceEndpoints {
+	if len(hs.unhealthy) == 0 {
+		return eps
+	}
+	m := make(serviceEndpoints, len(eps))
+	for k, v := range eps {
+		if !hs.unhealthy[k] {
+			m[k] = v
+		}
+	}
+	if len(m.ready()) == 0 && len(eps.ready()) > 0 {
+		glog.Warningf("All ready endpoints of service %s are unhealthy, keep them all.", service)
+		return eps
+	}
+	return m
+}
+
+// healthyEndpoints records the given endpoints to check their health, and
+// returns them without the unhealthy ones. It has to be called with the
+// write lock of the service object held.
+func (so *serviceObject) healthyEndpoints(eps serviceEndpoints) serviceEndpoints {
+	if so.health == nil {
+		return eps
+	}
+	so.health.endpoints = eps
+	so.health.forget()
+	spec := so.Spec()
+	return so.health.filter(fmt.Sprintf("%s.%s", spec.Namespace, spec.ServiceName), eps)
+}
+
+// startHealthCheck checks the health of the endpoints of the service
+// object every --health-check-interval until it's freed.
+func (so *serviceObject) startHealthCheck() {
+	ticker := time.NewTicker(*healthCheckInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-so.stopCh:
+			return
+		case <-ticker.C:
+		}
+		so.checkHealth()
+	}
+}
+
+// checkHealth checks the health of the ready endpoints of the service
+// object, and publishes the endpoints again if any changed its state. The
+// checks are spread over the first half of --health-check-interval, which
+// leaves the other half for the last ones to finish, and bounded by
+// --health-check-concurrency, so that a large service doesn't cause a
+// burst of connections.
+func (so *serviceObject) checkHealth() {
+	spec := so.Spec()
+	label := fmt.Sprintf("%s.%s", spec.Namespace, spec.ServiceName)
+
+	var addrs []string
+	so.WithRLock(func() error {
+		for k := range so.health.endpoints.ready() {
+			addrs = append(addrs, k)
+		}
+		return nil
+	})
+	sort.Strings(addrs)
+
+	var step time.Duration
+	if len(addrs) > 0 {
+		step = *healthCheckInterval / 2 / time.Duration(len(addrs))
+	}
+
+	var lock sync.Mutex
+	var wg sync.WaitGroup
+	results := make(map[string]error, len(addrs))
+	for i, addr := range addrs {
+		if i > 0 && step > 0 {
+			select {
+			case <-so.stopCh:
+				wg.Wait()
+				return
+			case <-time.After(step):
+			}
+		}
+		release := acquireHealthCheck()
+		wg.Add(1)
+		go func(addr string) {
+			defer wg.Done()
+			defer release()
+			err := checkEndpointHealth(addr)
+			lock.Lock()
+			results[addr] = err
+			lock.Unlock()
+		}(addr)
+	}
+	wg.Wait()
+
+	so.WithWLock(func() error {
+		changed := false
+		for addr, err := range results {
+			if _, ok := so.health.endpoints[addr]; !ok {
+				// Gone meanwhile.
+				continue
+			}
+			if so.health.record(label, addr, err) {
+				changed = true
+			}
+		}
+		// While the zero endpoints are held back, they are published
+		// along with the next update.
+		if changed && so.zeroTimer == nil {
+			setEndpoints(so, so.health.filter(label, so.health.endpoints))
+		}
+		return nil
+	})
+}
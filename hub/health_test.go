@@ -0,0 +1,229 @@
+package hub
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	. "github.com/smartystreets/goconvey/convey"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/health"
+	hpb "google.golang.org/grpc/health/grpc_health_v1"
+
+	pb "github.com/binchencoder/skylb-api/proto"
+)
+
+func TestCheckGrpcHealth(t *testing.T) {
+	Convey("Check the gRPC health of an endpoint", t, func() {
+		lis, err := net.Listen("tcp", "127.0.0.1:0")
+		So(err, ShouldBeNil)
+		hs := health.NewServer()
+		s := grpc.NewServer()
+		hpb.RegisterHealthServer(s, hs)
+		go s.Serve(lis)
+		defer s.Stop()
+		addr := lis.Addr().String()
+
+		So(checkGrpcHealth(addr), ShouldBeNil)
+
+		hs.SetServingStatus("", hpb.HealthCheckResponse_NOT_SERVING)
+		So(checkGrpcHealth(addr), ShouldNotBeNil)
+
+		Convey("A server without the health service should be healthy", func() {
+			lis, err := net.Listen("tcp", "127.0.0.1:0")
+			So(err, ShouldBeNil)
+			s := grpc.NewServer()
+			go s.Serve(lis)
+			defer s.Stop()
+
+			So(checkGrpcHealth(lis.Addr().String()), ShouldBeNil)
+		})
+
+		Convey("A closed port should be unhealthy", func() {
+			defer func(timeout time.Duration) {
+				*healthCheckTimeout = timeout
+			}(*healthCheckTimeout)
+			*healthCheckTimeout = 200 * time.Millisecond
+
+			lis, err := net.Listen("tcp", "127.0.0.1:0")
+			So(err, ShouldBeNil)
+			addr := lis.Addr().String()
+			lis.Close()
+
+			So(checkGrpcHealth(addr), ShouldNotBeNil)
+		})
+	})
+}
+
+func TestHealthState(t *testing.T) {
+	Convey("Endpoints change state after the thresholds", t, func() {
+		hs := newHealthState()
+		failed := errors.New("failed")
+		addr := "192.168.1.1:8080"
+
+		So(hs.record(serviceName, addr, failed), ShouldBeFalse)
+		So(hs.record(serviceName, addr, failed), ShouldBeFalse)
+		So(hs.record(serviceName, addr, nil), ShouldBeFalse)
+		So(hs.record(serviceName, addr, failed), ShouldBeFalse)
+		So(hs.record(serviceName, addr, failed), ShouldBeFalse)
+		So(hs.record(serviceName, addr, failed), ShouldBeTrue)
+		So(hs.unhealthy[addr], ShouldBeTrue)
+		So(hs.record(serviceName, addr, failed), ShouldBeFalse)
+
+		So(hs.record(serviceName, addr, nil), ShouldBeFalse)
+		So(hs.record(serviceName, addr, failed), ShouldBeFalse)
+		So(hs.record(serviceName, addr, nil), ShouldBeFalse)
+		So(hs.record(serviceName, addr, nil), ShouldBeTrue)
+		So(hs.unhealthy, ShouldBeEmpty)
+
+		Convey("All ready endpoints should be kept if none is healthy", func() {
+			eps := skypbAllEndpointsToMap(&pb.ServiceSpec{PortName: portName}, newTestEndpoints("192.168.1.1", "192.168.1.2"))
+			hs.unhealthy["192.168.1.1:8080"] = true
+			So(hs.filter(serviceName, eps), ShouldHaveLength, 1)
+			hs.unhealthy["192.168.1.2:8080"] = true
+			So(hs.filter(serviceName, eps), ShouldHaveLength, 2)
+
+			hs.endpoints = serviceEndpoints{}
+			hs.forget()
+			So(hs.unhealthy, ShouldBeEmpty)
+		})
+	})
+}
+
+func TestHealthCheckObserver(t *testing.T) {
+	spec := &pb.ServiceSpec{
+		Namespace:   namespace,
+		ServiceName: serviceName,
+		PortName:    portName,
+	}
+
+	Convey("Unhealthy endpoints should be withheld until they recover", t, func() {
+		defer func(interval time.Duration) {
+			*healthCheckInterval = interval
+		}(*healthCheckInterval)
+		*healthCheckInterval = 30 * time.Millisecond
+
+		var lock sync.Mutex
+		unhealthy := map[string]bool{}
+		defer func(check func(string) error) {
+			checkEndpointHealth = check
+		}(checkEndpointHealth)
+		checkEndpointHealth = func(addr string) error {
+			lock.Lock()
+			defer lock.Unlock()
+			if unhealthy[addr] {
+				return errors.New("not serving")
+			}
+			return nil
+		}
+
+		eh := endpointsHub{
+			services: serviceMap{},
+		}
+		so := newServiceObject(spec, nil)
+		so.health = newHealthState()
+		ch := make(chan *EndpointsUpdate, 10)
+		so.addObserver(newClientObject(spec, "192.168.0.1:8000", newObserverQueue(ch), ObserverOptions{}, nil))
+		next := func() *EndpointsUpdate {
+			select {
+			case up := <-ch:
+				return up
+			case <-time.After(time.Second):
+				return nil
+			}
+		}
+		next()
+
+		eh.applyEndpoints(so, newTestEndpoints("192.168.1.1", "192.168.1.2"))
+		So(next().Endpoints.InstEndpoints, ShouldHaveLength, 2)
+
+		lock.Lock()
+		unhealthy["192.168.1.2:8080"] = true
+		lock.Unlock()
+		for i := 0; i < *healthCheckUnhealthyThreshold; i++ {
+			so.checkHealth()
+		}
+		up := next()
+		So(up.Endpoints.InstEndpoints, ShouldHaveLength, 1)
+		So(up.Endpoints.InstEndpoints[0].Op, ShouldEqual, pb.Operation_Delete)
+		So(up.Endpoints.InstEndpoints[0].Host, ShouldEqual, "192.168.1.2")
+
+		// The unhealthy endpoint stays withheld on updates.
+		eh.applyEndpoints(so, newTestEndpoints("192.168.1.1", "192.168.1.2", "192.168.1.3"))
+		up = next()
+		So(up.Endpoints.InstEndpoints, ShouldHaveLength, 1)
+		So(up.Endpoints.InstEndpoints[0].Host, ShouldEqual, "192.168.1.3")
+
+		lock.Lock()
+		unhealthy["192.168.1.2:8080"] = false
+		lock.Unlock()
+		for i := 0; i < *healthCheckHealthyThreshold; i++ {
+			so.checkHealth()
+		}
+		up = next()
+		So(up.Endpoints.InstEndpoints, ShouldHaveLength, 1)
+		So(up.Endpoints.InstEndpoints[0].Op, ShouldEqual, pb.Operation_Add)
+		So(up.Endpoints.InstEndpoints[0].Host, ShouldEqual, "192.168.1.2")
+	})
+}
+
+func TestHealthCheckConcurrency(t *testing.T) {
+	spec := &pb.ServiceSpec{
+		Namespace:   namespace,
+		ServiceName: serviceName,
+		PortName:    portName,
+	}
+
+	Convey("Health checks should be bounded and spread over the interval", t, func() {
+		defer func(interval time.Duration) {
+			*healthCheckInterval = interval
+		}(*healthCheckInterval)
+		*healthCheckInterval = 160 * time.Millisecond
+
+		acquireHealthCheck()()
+		defer func(slots chan struct{}) {
+			healthCheckSlots = slots
+		}(healthCheckSlots)
+		healthCheckSlots = make(chan struct{}, 2)
+
+		var lock sync.Mutex
+		inFlight, maxInFlight := 0, 0
+		var starts []time.Time
+		defer func(check func(string) error) {
+			checkEndpointHealth = check
+		}(checkEndpointHealth)
+		checkEndpointHealth = func(addr string) error {
+			lock.Lock()
+			inFlight++
+			if inFlight > maxInFlight {
+				maxInFlight = inFlight
+			}
+			starts = append(starts, time.Now())
+			lock.Unlock()
+
+			time.Sleep(30 * time.Millisecond)
+
+			lock.Lock()
+			inFlight--
+			lock.Unlock()
+			return nil
+		}
+
+		ips := make([]string, 8)
+		for i := range ips {
+			ips[i] = fmt.Sprintf("192.168.1.%d", i+1)
+		}
+		so := newServiceObject(spec, nil)
+		so.health = newHealthState()
+		so.health.endpoints = skypbAllEndpointsToMap(spec, newTestEndpoints(ips...))
+		so.checkHealth()
+
+		So(starts, ShouldHaveLength, 8)
+		So(maxInFlight, ShouldBeLessThanOrEqualTo, 2)
+		// Eight checks are 10ms apart over the first half of the interval.
+		So(starts[7].Sub(starts[0]), ShouldBeGreaterThanOrEqualTo, 70*time.Millisecond)
+	})
+}
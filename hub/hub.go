@@ -6,6 +6,7 @@ import (
 	"fmt"
 	"net"
 	"path"
+	"sort"
 	"strconv"
 	"sync"
 	"sync/atomic"
@@ -15,13 +16,15 @@ import (
 	"github.com/golang/glog"
 	"golang.org/x/net/context"
 	api "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/labels"
 
 	"github.com/binchencoder/letsgo/strings"
 	jsync "github.com/binchencoder/letsgo/sync"
 	"github.com/binchencoder/skylb-api/lameduck"
 	"github.com/binchencoder/skylb-api/prefix"
 	pb "github.com/binchencoder/skylb-api/proto"
-	"github.com/binchencoder/skylb-api/util"
+	"github.com/binchencoder/skylb/hub/model"
+	"github.com/binchencoder/skylb/hub/util"
 )
 
 const (
@@ -35,77 +38,371 @@ var (
 	graphKeyInterval = flag.Duration("graph-key-interval", 2*time.Hour, "The service graph key update interval")
 	withinK8s        = flag.Bool("within-k8s", false, "Whether SkyLB is running in kubernetes")
 
-	getOpts      etcd.GetOptions
-	setGraphOpts *etcd.SetOptions
-	watchOpts    etcd.WatcherOptions
-
 	nextUpdateId int64
 
 	hub  *endpointsHub
 	once sync.Once
 )
 
-func init() {
-	getOpts = etcd.GetOptions{
-		Recursive: true,
+// clientObject implements model.ClientObserver for one service spec
+// resolved by a client.
+type clientObject struct {
+	// The service object which the observer is added to.
+	so *serviceObject
+
+	spec            *pb.ServiceSpec
+	clientAddr      string
+	resolveFull     bool
+	includeNotReady bool
+	weightUpdates   bool
+	// Only the endpoints whose metadata matches it are notified, or all if
+	// it's nil.
+	selector labels.Selector
+	// The zone of the client, whose endpoints are sent first, or only them
+	// if zoneOnly is set. See zoneEndpoints.
+	zone              string
+	zoneOnly          bool
+	spilloverFraction float64
+	// The size of the subset of endpoints sent, or all if not positive,
+	// and the client identity which the subset is keyed on.
+	subsetSize int
+	subsetKey  string
+
+	// Delivers the updates of all observers of the client.
+	queue *observerQueue
+
+	// Guards the fields below.
+	lock   sync.Mutex
+	closed bool
+	// Whether the zone-only observer gets the endpoints of other zones.
+	spilled bool
+	// The endpoints last delivered, and whether any update was delivered.
+	lastEps serviceEndpoints
+	sent    bool
+}
+
+func newClientObject(spec *pb.ServiceSpec, clientAddr string, queue *observerQueue, opts ObserverOptions, sel labels.Selector) *clientObject {
+	queue.acquire()
+	return &clientObject{
+		spec:              spec,
+		clientAddr:        clientAddr,
+		resolveFull:       opts.ResolveFull,
+		includeNotReady:   opts.IncludeNotReady && OpNotReady != opUndefined,
+		weightUpdates:     opts.WeightUpdates && OpWeight != opUndefined,
+		selector:          sel,
+		zone:              opts.Zone,
+		zoneOnly:          opts.ZoneOnly,
+		spilloverFraction: *zoneSpilloverFraction,
+		subsetSize:        opts.SubsetSizes[fmt.Sprintf("%s.%s", spec.Namespace, spec.ServiceName)],
+		subsetKey:         subsetKey(opts.ClientId, clientAddr),
+		queue:             queue,
 	}
-	watchOpts = etcd.WatcherOptions{
-		Recursive: true,
+}
+
+func (co *clientObject) ClientAddr() string {
+	return co.clientAddr
+}
+
+func (co *clientObject) Spec() *pb.ServiceSpec {
+	return co.spec
+}
+
+// Notify queues an update of the observer, see observerQueue. It never
+// blocks.
+func (co *clientObject) Notify(_ *pb.ServiceEndpoints) {
+	co.lock.Lock()
+	closed := co.closed
+	co.lock.Unlock()
+
+	if !closed {
+		co.queue.push(co)
 	}
-	setGraphOpts = &etcd.SetOptions{
-		TTL: *graphKeyTTL,
+}
+
+// nextUpdate builds the next update of the observer from the latest
+// endpoints of the service which match its selector and zone, or its
+// subset of them, as a snapshot if the observer resolves full endpoints,
+// or else as the delta against the endpoints last delivered to it. The
+// first update is always built, even if the service has no endpoints. It
+// returns nil if there's nothing to send.
+func (co *clientObject) nextUpdate() (*EndpointsUpdate, serviceEndpoints) {
+	// The endpoints are read before locking the observer, since they are
+	// set with the service object locked, which then notifies the
+	// observer.
+	var now serviceEndpoints
+	co.so.WithRLock(func() error {
+		now = co.so.endpoints
+		if co.so.slowStart != nil {
+			now = co.so.slowStart.endpoints(now, time.Now())
+		}
+		return nil
+	})
+
+	co.lock.Lock()
+	defer co.lock.Unlock()
+
+	if co.closed {
+		return nil, nil
 	}
+
+	if !co.includeNotReady {
+		now = now.ready()
+	}
+	// An endpoint whose metadata stops or starts matching the selector is
+	// deleted or added like one which left or joined the service.
+	now = co.zoneEndpoints(now.matching(co.selector)).subset(co.subsetKey, co.subsetSize)
+
+	var eps *pb.ServiceEndpoints
+	if co.resolveFull {
+		eps = snapshotEndpoints(co.spec, now)
+	} else {
+		eps = diffEndpoints(co.spec, co.lastEps, now, co.weightUpdates)
+		if len(eps.InstEndpoints) == 0 && co.sent {
+			return nil, nil
+		}
+	}
+	if co.zone != "" {
+		orderByZone(eps, now, co.zone)
+	}
+
+	return &EndpointsUpdate{
+		Id:        atomic.AddInt64(&nextUpdateId, 1),
+		Endpoints: eps,
+	}, now
 }
 
-type clientObject struct {
-	spec        *pb.ServiceSpec
-	clientAddr  string
-	resolveFull bool
-	notifyCh    chan<- *EndpointsUpdate
-	stopCh      chan struct{}
+// delivered records the update sent to the observer.
+func (co *clientObject) delivered(up *EndpointsUpdate, now serviceEndpoints) {
+	co.lock.Lock()
+	defer co.lock.Unlock()
+
+	co.sent = true
+	co.lastEps = now
+}
+
+// Close stops notifying the observer.
+func (co *clientObject) Close() {
+	co.lock.Lock()
+	closed := co.closed
+	co.closed = true
+	co.lock.Unlock()
+
+	if !closed {
+		co.queue.release()
+	}
+}
+
+// ObserverOptions defines how an observer wants to be notified.
+type ObserverOptions struct {
+	// ResolveFull sends the full endpoints list on every change.
+	ResolveFull bool
+
+	// IncludeNotReady also sends endpoints which are not ready yet, marked
+	// with OpNotReady, so that clients can pre-warm connections to them.
+	// It's ignored while skylb-api doesn't define OpNotReady.
+	IncludeNotReady bool
+
+	// WeightUpdates sends the endpoints whose weight alone changed with
+	// OpWeight, instead of adding them again with the new weight. It's
+	// ignored while skylb-api doesn't define OpWeight.
+	WeightUpdates bool
+
+	// Selectors are the Kubernetes-style label selectors, e.g. "version=v2"
+	// or "zone in (a,b)", keyed by "namespace.service". Only the endpoints
+	// whose metadata matches the selector of a service are sent.
+	Selectors map[string]string
+
+	// Zone is the zone of the client. The endpoints in the same zone, see
+	// ZoneMetadataKey, are sent ahead of the others, in full resolves and
+	// delta updates alike.
+	Zone string
+
+	// ZoneOnly only sends the endpoints in the same zone, unless the zone
+	// is short of ready endpoints, see --zone-spillover-fraction.
+	ZoneOnly bool
+
+	// SubsetSizes are the numbers of endpoints to send, keyed by
+	// "namespace.service". Each observer gets a stable subset of that size,
+	// and the endpoints are evenly spread over the observers.
+	SubsetSizes map[string]int
+
+	// ClientId identifies the client which the subsets are keyed on. It
+	// defaults to the IP of the client address.
+	ClientId string
 }
 
 // ServiceEndpoint represents a service endpoint.
 // (A simplified version of pb.InstanceEndpoint)
 type ServiceEndpoint struct {
-	IP     string
-	Port   int32
-	Weight int32
+	IP       string
+	Port     int32
+	Weight   int32
+	Source   string // Where the endpoint comes from, only set in hybrid mode. See EndpointsHandler.
+	Cluster  string // The Kubernetes cluster of the endpoint, if named. See EndpointsHandler.
+	NotReady bool   // Whether the endpoint is not ready to serve yet.
+
+	// The metadata registered with the endpoint, e.g. version or zone.
+	Metadata map[string]string
 }
 
 func (se ServiceEndpoint) toString() string {
 	return fmt.Sprintf("%s:%d", se.IP, se.Port)
 }
 
+// describe returns the endpoint and its state, for introspection.
+func (se ServiceEndpoint) describe() string {
+	s := fmt.Sprintf("%s weight=%d ready=%t", se.toString(), se.Weight, !se.NotReady)
+	if se.Source != "" {
+		s += fmt.Sprintf(" source=%s", se.Source)
+	}
+	if se.Cluster != "" {
+		s += fmt.Sprintf(" cluster=%s", se.Cluster)
+	}
+	if len(se.Metadata) > 0 {
+		s += fmt.Sprintf(" metadata=%q", util.FormatMetadata(se.Metadata))
+	}
+	return s
+}
+
 type serviceEndpoints map[string]ServiceEndpoint
 
+// keys returns the addresses of the endpoints in sorted order.
+func (se serviceEndpoints) keys() []string {
+	keys := make([]string, 0, len(se))
+	for k := range se {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// ready returns the endpoints which are ready to serve.
+func (se serviceEndpoints) ready() serviceEndpoints {
+	m := make(serviceEndpoints, len(se))
+	for k, v := range se {
+		if !v.NotReady {
+			m[k] = v
+		}
+	}
+	return m
+}
+
+// serviceObject extends model.ServiceObject, which manages the observers
+// of a service, with the state of how its endpoints are collected. It's
+// reference counted by its observers, and freed along with its goroutines
+// when the last one leaves.
 type serviceObject struct {
+	model.ServiceObject
+
+	// Serializes endpoint updates and guards the fields below.
 	jsync.RWLock
 
-	spec      *pb.ServiceSpec
+	// All endpoints of the service, including the not ready ones.
 	endpoints serviceEndpoints
-	observers []*clientObject
+
+	// The timer to notify zero endpoints after the grace period, and the
+	// endpoints held back meanwhile. See holdZeroEndpoints.
+	zeroTimer *time.Timer
+	heldEps   serviceEndpoints
+
+	// Ramps up the weights of new endpoints, nil if the service has no
+	// slow start window.
+	slowStart *slowStart
+
+	// The health of the endpoints, nil if health checks are disabled.
+	health *healthState
+
+	// The latest endpoints by source, only used in hybrid mode.
+	sourceLock sync.Mutex
+	sourceEps  map[string]*api.Endpoints
+
+	// Coalesces the update events from etcd, nil if the endpoints don't
+	// come from etcd.
+	updates *debouncer
+
+	// Closed when the service object is freed, to stop its goroutines.
+	stopCh chan struct{}
+}
+
+// newServiceObject creates a service object. If update is not nil, it
+// fetches and applies the endpoints of the service from etcd. It's called
+// on update events, and periodically while the service object has
+// observers, to rectify their endpoints.
+func newServiceObject(spec *pb.ServiceSpec, update func()) *serviceObject {
+	var listener func(key string)
+	var updates *debouncer
+	if update != nil {
+		listener = func(string) {
+			update()
+		}
+		updates = newDebouncer(fmt.Sprintf("%s.%s", spec.Namespace, spec.ServiceName), update)
+	}
+	so := serviceObject{
+		ServiceObject: model.NewServiceObject(spec, listener),
+		endpoints:     serviceEndpoints{},
+		updates:       updates,
+		stopCh:        make(chan struct{}),
+	}
+	if window := slowStartWindowOf(spec); window > 0 {
+		so.slowStart = newSlowStart(window)
+	}
+	return &so
+}
+
+// addObserver adds the client observer to the service object, which
+// notifies the observer of the current endpoints.
+func (so *serviceObject) addObserver(co *clientObject) {
+	co.so = so
+	so.AddObserver(co)
+}
+
+// close stops all goroutines of the service object, which has no observers
+// left.
+func (so *serviceObject) close() {
+	close(so.stopCh)
+	if so.updates != nil {
+		so.updates.stop()
+	}
+	so.WithWLock(func() error {
+		if so.zeroTimer != nil {
+			so.zeroTimer.Stop()
+			so.zeroTimer = nil
+			so.heldEps = nil
+		}
+		if so.slowStart != nil && so.slowStart.timer != nil {
+			so.slowStart.timer.Stop()
+			so.slowStart.timer = nil
+		}
+		return nil
+	})
 }
 
 type serviceMap map[string]*serviceObject
 
-// EndpointsHub defines the service endpoints hub based on etcd.
+// EndpointsHub defines the service endpoints hub based on a Registry.
 type EndpointsHub interface {
 	// AddObserver adds an observer of the given service specs for the given
 	// clientAddr. When service endpoints changed, it notifies the observer
 	// through the returned channel.
-	AddObserver(specs []*pb.ServiceSpec, clientAddr string, resolveFull bool) (<-chan *EndpointsUpdate, error)
+	AddObserver(specs []*pb.ServiceSpec, clientAddr string, opts ObserverOptions) (<-chan *EndpointsUpdate, error)
 
 	// RemoveObserver removes the observer for the given service specs for the
 	// given clientAddr.
 	RemoveObserver(specs []*pb.ServiceSpec, clientAddr string)
 
 	// InsertEndpoint inserts a service with the given namespace and service name.
-	InsertEndpoint(spec *pb.ServiceSpec, host string, port, weight int32) error
+	// The metadata, if any, is stored along with the endpoint, where the
+	// selectors and the zone of observers match it. It's not delivered to
+	// observers, see EndpointsUpdate.
+	InsertEndpoint(spec *pb.ServiceSpec, host string, port, weight int32, metadata map[string]string) error
+
+	// UpdateEndpointWeight changes the weight of a registered endpoint
+	// without registering it again. Zero resets it to the default weight.
+	UpdateEndpointWeight(spec *pb.ServiceSpec, host string, port, weight int32) error
 
 	// UpsertEndpoint inserts or update a service with the given namespace
 	// and service name.
-	UpsertEndpoint(spec *pb.ServiceSpec, host string, port, weight int32) error
+	UpsertEndpoint(spec *pb.ServiceSpec, host string, port, weight int32, metadata map[string]string) error
 
 	// TrackServiceGraph keeps track of dependency graph between clients and services.
 	TrackServiceGraph(req *pb.ResolveRequest, callee *pb.ServiceSpec, callerAddr net.Addr)
@@ -119,74 +416,62 @@ type endpointsHub struct {
 
 	etcdKeyTtl time.Duration
 	services   serviceMap
-	etcdCli    etcd.KeysAPI
+	registry   Registry
+
+	// The in-memory copy of the endpoints in etcd, loaded and kept updated
+	// by the main watcher.
+	mirror endpointsMirror
 
 	graphKeys     map[string]struct{}
 	graphKeysLock *sync.RWMutex
 }
 
 // InsertEndpoint inserts a service with the given namespace and service name.
-func (eh *endpointsHub) InsertEndpoint(spec *pb.ServiceSpec, host string, port, weight int32) error {
+func (eh *endpointsHub) InsertEndpoint(spec *pb.ServiceSpec, host string, port, weight int32, metadata map[string]string) error {
 	key := eh.calculateEndpointKey(spec.Namespace, spec.ServiceName, host, port)
 	ctx := context.Background()
-	return eh.setKey(ctx, key, spec, host, port, weight)
+	return eh.setKey(ctx, key, spec, host, port, weight, metadata)
 }
 
 // UpsertEndpoint inserts or update a service with the given namespace
 // and service name.
-func (eh *endpointsHub) UpsertEndpoint(spec *pb.ServiceSpec, host string, port, weight int32) error {
+func (eh *endpointsHub) UpsertEndpoint(spec *pb.ServiceSpec, host string, port, weight int32, metadata map[string]string) error {
 	key := eh.calculateEndpointKey(spec.Namespace, spec.ServiceName, host, port)
 
 	ctx := context.Background()
 	err := eh.refreshKey(ctx, key)
-	if err == nil {
-		return nil
-	}
-
-	if e, ok := err.(etcd.Error); ok {
-		switch e.Code {
-		case etcd.ErrorCodeKeyNotFound:
-			// Sometimes the key might be dropped or expired so that
-			// refreshKey will fail.
-			return eh.setKey(ctx, key, spec, host, port, weight)
-		}
+	if err == ErrKeyNotFound {
+		// Sometimes the key might be dropped or expired so that
+		// refreshKey will fail.
+		return eh.setKey(ctx, key, spec, host, port, weight, metadata)
 	}
 	return err
 }
 
+// fetchEndpoints returns the endpoints of the given service from the
+// endpoints mirror, or from etcd if the mirror is not loaded yet.
 func (eh *endpointsHub) fetchEndpoints(namespace, serviceName string) (*api.Endpoints, error) {
 	endpoints := api.Endpoints{}
 
 	key := eh.calculateKey(namespace, serviceName)
-	resp, err := eh.etcdCli.Get(context.Background(), key, &getOpts)
-	if err != nil {
-		if e, ok := err.(etcd.Error); ok && e.Code == etcd.ErrorCodeKeyNotFound {
-			glog.Warningf("Service %s.%s absent, return empty list.", namespace, serviceName)
-			return &endpoints, nil
+	kvs, ok := eh.mirror.list(key)
+	if !ok {
+		var err error
+		if kvs, _, err = eh.registry.List(context.Background(), key); err != nil && err != ErrKeyNotFound {
+			return nil, err
 		}
-		return nil, err
-	}
-
-	if resp.Node == nil {
-		glog.Errorf("No endpoints found for service %s.%s", namespace, serviceName)
-		return &endpoints, nil
 	}
-
-	if len(resp.Node.Nodes) == 0 {
-		if resp.Node.Value != "" {
-			if err := json.Unmarshal([]byte(resp.Node.Value), &endpoints); err != nil {
-				return nil, err
-			}
-		}
+	if len(kvs) == 0 {
+		glog.Warningf("Service %s.%s absent, return empty list.", namespace, serviceName)
 		return &endpoints, nil
 	}
 
-	for i, node := range resp.Node.Nodes {
-		if node.Value == "" {
+	for i, kv := range kvs {
+		if kv.Value == "" {
 			continue
 		}
 		eps := api.Endpoints{}
-		if err := json.Unmarshal([]byte(node.Value), &eps); err != nil {
+		if err := json.Unmarshal([]byte(kv.Value), &eps); err != nil {
 			return nil, err
 		}
 		if i == 0 {
@@ -208,79 +493,103 @@ func (eh *endpointsHub) fetchEndpoints(namespace, serviceName string) (*api.Endp
 	return &endpoints, nil
 }
 
+// startMainWatcher loads the endpoints mirror, and keeps it updated with
+// the changes watched after it. When the watcher is reset, the mirror is
+// reloaded and the services changed in the gap are updated.
 func (eh *endpointsHub) startMainWatcher() {
-outerLoop:
 	for {
-		w := eh.etcdCli.Watcher(prefix.EndpointsKey, &watchOpts)
+		index, err := eh.loadMirror()
+		if err != nil {
+			glog.Errorf("Failed to load endpoints mirror, %v", err)
+			time.Sleep(time.Second)
+			continue
+		}
+		w := eh.registry.Watch(prefix.EndpointsKey, index)
 
-		// Watch etcd keys for all service endpoints and notify clients.
+		// Watch keys for all service endpoints and notify clients.
 		for {
-			resp, err := w.Next(context.Background())
-			glog.V(4).Infof("Watched: %+v", resp)
+			ev, err := w.Next(context.Background())
 			if err != nil {
-				time.Sleep(time.Second)
-				if e, ok := err.(etcd.Error); ok {
-					if e.Code == etcd.ErrorCodeEventIndexCleared ||
-						e.Code == etcd.ErrorCodeWatcherCleared {
-						glog.Errorf("Abandon watcher, %v", err)
-						continue outerLoop
-					}
+				if err == ErrWatchReset {
+					glog.Warningf("Endpoints watcher reset after index %d, resync.", index)
+					watcherResyncCounts.WithLabelValues(resyncWatcherEndpoints).Inc()
+					break
 				}
+				time.Sleep(time.Second)
 				glog.Errorf("Failed to get next watch event, %v", err)
 				continue
 			}
-			eh.extractUpdates(resp)
+			index = ev.Index
+			eh.extractUpdates(ev)
 		}
 	}
 }
 
-// startLameDuckWatcher starts a watcher to watch changes of lame duck.
+// startLameDuckWatcher starts a watcher to watch changes of lame duck. When
+// the watcher is reset, the lameduck instances are reloaded and the changes
+// in the gap are replayed.
 func (eh *endpointsHub) startLameDuckWatcher() {
-	// Load current lameduck endpoints.
-	resp, err := eh.etcdCli.Get(context.Background(), prefix.LameduckKey, &etcd.GetOptions{Recursive: true})
-	if err != nil {
-		glog.Errorf("Failed to load lameduck instances with key prefix %s, %v", prefix.LameduckKey, err)
-	} else {
-		lameduck.ExtractLameduck(resp.Node)
-	}
-
-outerLoop:
+	var lameducks keyValueSet
 	for {
-		w := eh.etcdCli.Watcher(prefix.LameduckKey, &watchOpts)
+		// Load current lameduck endpoints.
+		kvs, index, err := eh.registry.List(context.Background(), prefix.LameduckKey)
+		if err != nil && err != ErrKeyNotFound {
+			glog.Errorf("Failed to load lameduck instances with key prefix %s, %v", prefix.LameduckKey, err)
+			time.Sleep(time.Second)
+			continue
+		}
+		if lameducks == nil {
+			lameducks = newKeyValueSet(kvs)
+			lameduck.ExtractLameduck(kvsToNode(prefix.LameduckKey, kvs))
+		} else {
+			for _, ev := range lameducks.resync(kvs, index) {
+				glog.V(4).Infof("Resynced lameduck change: %+v", ev)
+				lameduck.ExtractLameduckChange(eventToResponse(ev))
+			}
+		}
+
+		w := eh.registry.Watch(prefix.LameduckKey, index)
 		for {
-			resp, err := w.Next(context.Background())
-			glog.V(4).Infof("Watched lameduck change: %+v", resp)
+			ev, err := w.Next(context.Background())
+			glog.V(4).Infof("Watched lameduck change: %+v", ev)
 			if err != nil {
-				time.Sleep(time.Second)
-				if e, ok := err.(etcd.Error); ok {
-					if e.Code == etcd.ErrorCodeEventIndexCleared ||
-						e.Code == etcd.ErrorCodeWatcherCleared {
-						glog.Errorf("Abandon watcher, %v", err)
-						continue outerLoop
-					}
+				if err == ErrWatchReset {
+					glog.Warningf("Lameduck watcher reset after index %d, resync.", index)
+					watcherResyncCounts.WithLabelValues(resyncWatcherLameduck).Inc()
+					break
 				}
+				time.Sleep(time.Second)
 				glog.Errorf("Failed to get next watch event, %v", err)
 				continue
 			}
-			lameduck.ExtractLameduckChange(resp)
+			index = ev.Index
+			lameducks.apply(ev)
+			lameduck.ExtractLameduckChange(eventToResponse(ev))
 		}
 	}
 }
 
-// SkyLB receives full set of current endpoints.
-func (eh *endpointsHub) extractUpdates(resp *etcd.Response) {
-	var key string
-	switch resp.Action {
-	case util.ActionCreate, util.ActionSet:
-		key = path.Dir(resp.Node.Key)
-	case util.ActionDelete, util.ActionExpire:
-		key = path.Dir(resp.PrevNode.Key)
-	default:
-		glog.Errorf("Unexpected action %s, ignore.", resp.Action)
-		return
+// extractUpdates patches the endpoints mirror with the watch event, and
+// updates the services changed.
+func (eh *endpointsHub) extractUpdates(ev *Event) {
+	for _, key := range eh.mirror.apply(ev) {
+		eh.triggerUpdate(key)
 	}
+}
 
-	eh.updateEndpoints(key)
+// triggerUpdate updates the service with the given key, if any client
+// observes it. Bursts of updates are coalesced, see debouncer.
+func (eh *endpointsHub) triggerUpdate(key string) {
+	var so *serviceObject
+	eh.WithRLock(func() error {
+		so = eh.services[key]
+		return nil
+	})
+	if so == nil || so.updates == nil {
+		glog.V(6).Infof("serviceObject is nil for key %#v", key)
+		return
+	}
+	so.updates.trigger()
 }
 
 func (eh *endpointsHub) updateEndpoints(key string) {
@@ -294,41 +603,87 @@ func (eh *endpointsHub) updateEndpoints(key string) {
 		return
 	}
 
-	eps, err := eh.fetchEndpoints(so.spec.Namespace, so.spec.ServiceName)
+	eps, err := eh.fetchEndpoints(so.Spec().Namespace, so.Spec().ServiceName)
 	if err != nil {
-		glog.Errorf("Failed to fetch endpoints for service %s.%s: %+v", so.spec.Namespace, so.spec.ServiceName, err)
+		glog.Errorf("Failed to fetch endpoints for service %s.%s: %+v", so.Spec().Namespace, so.Spec().ServiceName, err)
 		return
 	}
 
-	eh.applyEndpoints(so, eps)
+	eh.applySourceEndpoints(so, sourceEtcd, eps)
+}
+
+// applyServiceEndpoints applies the given endpoints from the given source
+// to the service object with the given key, if any client observes it.
+func (eh *endpointsHub) applyServiceEndpoints(key, source string, eps *api.Endpoints) {
+	var so *serviceObject
+	eh.WithRLock(func() error {
+		so, _ = eh.services[key]
+		return nil
+	})
+	if so == nil {
+		// It's normal to get nil service objects because not all services
+		// use SkyLB.
+		glog.V(6).Infof("serviceObject is nil for key %#v", key)
+		return
+	}
+	eh.applySourceEndpoints(so, source, eps)
 }
 
+// deleteServiceEndpoints applies an empty endpoints from the given source
+// to the service object with the given key, since the service has been
+// deleted from the source.
+func (eh *endpointsHub) deleteServiceEndpoints(key, source string) {
+	var so *serviceObject
+	eh.WithRLock(func() error {
+		so = eh.services[key]
+		return nil
+	})
+	if so == nil {
+		glog.V(6).Infof("serviceObject is nil for key %#v", key)
+		return
+	}
+
+	eps := api.Endpoints{}
+	eps.Name = so.Spec().ServiceName
+	eps.Namespace = so.Spec().Namespace
+	eh.applySourceEndpoints(so, source, &eps)
+}
+
+// applyEndpoints updates the endpoints of the service object and notifies
+// its observers. The unhealthy endpoints are withheld, see healthState.
+// When the service loses all of its endpoints, the update may be held back
+// for a while, see holdZeroEndpoints.
 func (eh *endpointsHub) applyEndpoints(so *serviceObject, eps *api.Endpoints) {
-	var fullEps *pb.ServiceEndpoints
-	var observers []*clientObject
+	epsMap := skypbAllEndpointsToMap(so.Spec(), eps)
+
+	zero := false
 	so.WithWLock(func() error {
-		so.endpoints = skypbEndpointsToMap(so.spec, eps)
-		fullEps = skypbEndpointsToSlice(so.spec, eps)
-		observers = so.observers
+		epsMap = so.healthyEndpoints(epsMap)
+		if eh.holdZeroEndpoints(so, epsMap) {
+			return nil
+		}
+		zero = setEndpoints(so, epsMap)
 		return nil
 	})
+	if zero {
+		reportZeroEndpoints(so.Spec(), so.Observers())
+	}
+}
 
-	for _, observer := range observers {
-		go func(observer *clientObject, eps *pb.ServiceEndpoints) {
-			if len(eps.InstEndpoints) == 0 {
-				return
-			}
-
-			up := EndpointsUpdate{
-				Id:        atomic.AddInt64(&nextUpdateId, 1),
-				Endpoints: eps,
-			}
-			select {
-			case <-observer.stopCh:
-			case observer.notifyCh <- &up:
-			}
-		}(observer, fullEps)
+// setEndpoints sets the endpoints of the service object, which notifies its
+// observers, and returns true if the service has just lost all of its
+// endpoints. It has to be called with the write lock of the service object
+// held.
+func setEndpoints(so *serviceObject, epsMap serviceEndpoints) bool {
+	zero := len(epsMap.ready()) == 0 && len(so.endpoints.ready()) > 0
+	countWeightChanges(so.Spec(), so.endpoints, epsMap)
+	if so.slowStart != nil {
+		so.slowStart.update(so.endpoints, epsMap, time.Now())
+		so.scheduleSlowStart()
 	}
+	so.endpoints = epsMap
+	so.SetEndpoints(snapshotEndpoints(so.Spec(), epsMap))
+	return zero
 }
 
 func (eh *endpointsHub) TrackServiceGraph(req *pb.ResolveRequest, callee *pb.ServiceSpec, callerAddr net.Addr) {
@@ -344,7 +699,7 @@ func (eh *endpointsHub) TrackServiceGraph(req *pb.ResolveRequest, callee *pb.Ser
 	timestamp := fmt.Sprintf("%d", time.Now().Unix())
 	succeeded := false
 	for i := 0; i < 3; i++ {
-		if _, err := eh.etcdCli.Set(context.Background(), graphKey, timestamp, setGraphOpts); nil != err {
+		if err := eh.registry.Put(context.Background(), graphKey, timestamp, *graphKeyTTL); nil != err {
 			if i == 2 {
 				glog.Warningf("Save service graph key %s in etcd: %#v", graphKey, err)
 			}
@@ -381,7 +736,7 @@ func (eh *endpointsHub) startGraphTracking() {
 		timestamp := fmt.Sprintf("%d", time.Now().Unix())
 		fmt.Printf("startGraphTracking: timestamp %s", timestamp)
 		for k := range keys {
-			if _, err := eh.etcdCli.Set(context.Background(), k, timestamp, setGraphOpts); nil != err {
+			if err := eh.registry.Put(context.Background(), k, timestamp, *graphKeyTTL); nil != err {
 				glog.Warningf("Save service graph key %s in etcd err: %#v", k, err)
 			}
 			// Throttle the traffic to ETCD to 20 keys/sec.
@@ -390,21 +745,31 @@ func (eh *endpointsHub) startGraphTracking() {
 	}
 }
 
-// Init initializes and returns the endpoint hub.
-func Init() EndpointsHub {
+// Init initializes and returns the endpoint hub backed by the given registry.
+func Init(registry Registry) EndpointsHub {
 	// Start hub only once.
 	once.Do(func() {
 		hub = &endpointsHub{
 			services:      make(serviceMap),
-			etcdCli:       CreateEtcdClient(*EtcdEndpoints, true),
+			registry:      registry,
 			graphKeys:     make(map[string]struct{}),
 			graphKeysLock: &sync.RWMutex{},
 		}
-		prefix.Init(hub.etcdCli)
-		if *withinK8s {
-			go hub.startK8sWatcher()
-		} else {
+		switch {
+		case *withinK8s:
+			hub.startK8sWatcher()
+			if *hybrid {
+				go hub.startMainWatcher()
+				go hub.startMirrorCheck()
+			}
+		case withinConsul():
+			hub.initConsul()
+		case withinFile():
+			hub.initFile()
+			go hub.startFileWatcher()
+		default:
 			go hub.startMainWatcher()
+			go hub.startMirrorCheck()
 		}
 		go hub.startLameDuckWatcher()
 		go hub.startGraphTracking()
@@ -451,52 +816,52 @@ func CreateEtcdClient(etcdEndpoints string, required bool) etcd.KeysAPI {
 	return etcd.NewKeysAPI(cli)
 }
 
+// skypbEndpointsToMap returns the ready endpoints.
 func skypbEndpointsToMap(spec *pb.ServiceSpec, eps *api.Endpoints) serviceEndpoints {
+	return endpointsToMap(spec, eps, false)
+}
+
+// skypbAllEndpointsToMap returns both the ready and the not ready endpoints.
+func skypbAllEndpointsToMap(spec *pb.ServiceSpec, eps *api.Endpoints) serviceEndpoints {
+	return endpointsToMap(spec, eps, true)
+}
+
+func endpointsToMap(spec *pb.ServiceSpec, eps *api.Endpoints, includeNotReady bool) serviceEndpoints {
 	m := make(serviceEndpoints)
-	for _, s := range eps.Subsets {
-		port := findPort(s.Ports, spec.PortName)
-		if port == 0 {
-			continue
+	add := func(addr api.EndpointAddress, port int32, notReady bool) {
+		se := ServiceEndpoint{
+			IP:       addr.IP,
+			Port:     port,
+			Source:   eps.Labels[calculateSourceKey(addr.IP, port)],
+			Cluster:  eps.Labels[calculateClusterKey(addr.IP, port)],
+			NotReady: notReady,
+			Metadata: util.EndpointMetadata(eps, addr.IP, port),
 		}
-		for _, addr := range s.Addresses {
-			se := ServiceEndpoint{
-				IP:   addr.IP,
-				Port: port,
-			}
-			if weight, ok := eps.Labels[calculateWeightKey(addr.IP, port)]; ok {
-				if tmpWeight, err := strconv.Atoi(weight); err == nil {
-					se.Weight = int32(tmpWeight)
-				}
+		if weight, ok := eps.Labels[calculateWeightKey(addr.IP, port)]; ok {
+			if tmpWeight, err := strconv.Atoi(weight); err == nil {
+				se.Weight = int32(tmpWeight)
 			}
-			m[se.toString()] = se
 		}
+		// The ready one wins if an endpoint shows up in both lists.
+		if prev, ok := m[se.toString()]; ok && !prev.NotReady {
+			return
+		}
+		m[se.toString()] = se
 	}
-	return m
-}
 
-func skypbEndpointsToSlice(spec *pb.ServiceSpec, eps *api.Endpoints) *pb.ServiceEndpoints {
-	svcEps := make([]*pb.InstanceEndpoint, 0, len(eps.Subsets))
 	for _, s := range eps.Subsets {
 		port := findPort(s.Ports, spec.PortName)
 		if port == 0 {
 			continue
 		}
 		for _, addr := range s.Addresses {
-			ep := pb.InstanceEndpoint{
-				Host: addr.IP,
-				Port: port,
-			}
-			if weight, ok := eps.Labels[calculateWeightKey(addr.IP, port)]; ok {
-				if tmpWeight, err := strconv.Atoi(weight); err == nil {
-					ep.Weight = int32(tmpWeight)
-				}
+			add(addr, port, false)
+		}
+		if includeNotReady {
+			for _, addr := range s.NotReadyAddresses {
+				add(addr, port, true)
 			}
-			svcEps = append(svcEps, &ep)
 		}
 	}
-
-	return &pb.ServiceEndpoints{
-		Spec:          spec,
-		InstEndpoints: svcEps,
-	}
+	return m
 }
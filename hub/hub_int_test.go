@@ -13,7 +13,7 @@ import (
 func TestTrackServiceGraph(t *testing.T) {
 	etcdCli := GetTestEtcdClient()
 	eh := endpointsHub{
-		etcdCli: etcdCli,
+		registry: &etcdRegistry{cli: etcdCli},
 	}
 	req := &pb.ResolveRequest{
 		CallerServiceId:   1,
@@ -43,6 +43,9 @@ func TestTrackServiceGraph(t *testing.T) {
 	if _, err := etcdCli.Delete(context.Background(), "/skylb/graph/default/called2/clients", delOpts); nil != err {
 		t.Errorf("Init test data err:%v", err)
 	}
+	setGraphOpts := &etcd.SetOptions{
+		TTL: *graphKeyTTL,
+	}
 	if _, err := etcdCli.Set(context.Background(), "/skylb/graph/default/called2/clients", "stub", setGraphOpts); nil != err {
 		t.Errorf("Simulate test data err:%v", err)
 	}
@@ -60,7 +63,7 @@ func TestTrackServiceGraph(t *testing.T) {
 func TestFetchEndpoints(t *testing.T) {
 	etcdCli := GetTestEtcdClient()
 	eh := endpointsHub{
-		etcdCli: etcdCli,
+		registry: &etcdRegistry{cli: etcdCli},
 	}
 	eps, err := eh.fetchEndpoints("default", "shared-test-server-service")
 	if nil != err {
@@ -3,6 +3,7 @@ package hub
 import (
 	"fmt"
 	"testing"
+	"time"
 
 	. "github.com/smartystreets/goconvey/convey"
 	api "k8s.io/api/core/v1"
@@ -58,3 +59,95 @@ func TestSkypbEndpointsToMap(t *testing.T) {
 		}
 	})
 }
+
+func newTestEndpoints(ips ...string) *api.Endpoints {
+	eps := api.Endpoints{}
+	subset := api.EndpointSubset{
+		Ports: []api.EndpointPort{
+			{Name: portName, Port: port},
+		},
+	}
+	for _, ip := range ips {
+		subset.Addresses = append(subset.Addresses, api.EndpointAddress{IP: ip})
+	}
+	eps.Subsets = []api.EndpointSubset{subset}
+	return &eps
+}
+
+// newTestObserver adds an observer with the given options to the service
+// object, and returns its channel after draining the initial update.
+func newTestObserver(so *serviceObject, clientAddr string, opts ObserverOptions) chan *EndpointsUpdate {
+	ch := make(chan *EndpointsUpdate, 10)
+	so.addObserver(newClientObject(so.Spec(), clientAddr, newObserverQueue(ch), opts, nil))
+	select {
+	case <-ch:
+	case <-time.After(time.Second):
+	}
+	return ch
+}
+
+func TestPublishEndpoints(t *testing.T) {
+	spec := &pb.ServiceSpec{
+		Namespace:   namespace,
+		ServiceName: serviceName,
+		PortName:    portName,
+	}
+
+	Convey("Publish endpoints to full and delta observers", t, func() {
+		eh := endpointsHub{
+			services: serviceMap{},
+		}
+		so := newServiceObject(spec, nil)
+		fullCh := newTestObserver(so, "192.168.0.1:8000", ObserverOptions{ResolveFull: true})
+		deltaCh := newTestObserver(so, "192.168.0.2:8000", ObserverOptions{})
+
+		next := func(ch chan *EndpointsUpdate) *EndpointsUpdate {
+			select {
+			case up := <-ch:
+				return up
+			case <-time.After(time.Second):
+				return nil
+			}
+		}
+
+		eh.applyEndpoints(so, newTestEndpoints("192.168.1.1", "192.168.1.2"))
+		full, delta := next(fullCh), next(deltaCh)
+		So(full.Endpoints.InstEndpoints, ShouldHaveLength, 2)
+		So(delta.Endpoints.InstEndpoints, ShouldHaveLength, 2)
+
+		eh.applyEndpoints(so, newTestEndpoints("192.168.1.2", "192.168.1.3"))
+		full, delta = next(fullCh), next(deltaCh)
+		So(full.Endpoints.InstEndpoints, ShouldHaveLength, 2)
+		So(delta.Endpoints.InstEndpoints, ShouldHaveLength, 2)
+		for _, ep := range delta.Endpoints.InstEndpoints {
+			if ep.Host == "192.168.1.1" {
+				So(ep.Op, ShouldEqual, pb.Operation_Delete)
+			} else {
+				So(ep.Host, ShouldEqual, "192.168.1.3")
+				So(ep.Op, ShouldEqual, pb.Operation_Add)
+			}
+		}
+
+		Convey("Unchanged endpoints should only be sent to full observers", func() {
+			eh.applyEndpoints(so, newTestEndpoints("192.168.1.2", "192.168.1.3"))
+			So(next(fullCh), ShouldNotBeNil)
+			So(next(deltaCh), ShouldBeNil)
+		})
+
+		Convey("Zero endpoints should be notified explicitly", func() {
+			eh.applyEndpoints(so, newTestEndpoints())
+			full = next(fullCh)
+			So(full.Endpoints.InstEndpoints, ShouldBeEmpty)
+			delta = next(deltaCh)
+			So(delta.Endpoints.InstEndpoints, ShouldHaveLength, 2)
+			for _, ep := range delta.Endpoints.InstEndpoints {
+				So(ep.Op, ShouldEqual, pb.Operation_Delete)
+			}
+
+			eh.applyEndpoints(so, newTestEndpoints("192.168.1.4"))
+			delta = next(deltaCh)
+			So(delta.Endpoints.InstEndpoints, ShouldHaveLength, 1)
+			So(delta.Endpoints.InstEndpoints[0].Host, ShouldEqual, "192.168.1.4")
+		})
+	})
+}
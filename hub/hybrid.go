@@ -0,0 +1,138 @@
+package hub
+
+import (
+	"flag"
+	"fmt"
+	"strings"
+
+	"github.com/golang/glog"
+	api "k8s.io/api/core/v1"
+
+	pb "github.com/binchencoder/skylb-api/proto"
+)
+
+const (
+	sourceEtcd   = "etcd"
+	sourceK8s    = "k8s"
+	sourceConsul = "consul"
+	sourceFile   = "file"
+)
+
+var (
+	hybrid = flag.Bool("hybrid", false, "When running in kubernetes, also watch endpoints reported to etcd and publish the union of them")
+
+	// hybridSources lists the sources merged in hybrid mode by priority.
+	// When an endpoint shows up in more than one source, the one from the
+	// higher priority source wins.
+	hybridSources = []string{sourceK8s, sourceEtcd}
+)
+
+func calculateSourceKey(host string, port int32) string {
+	return fmt.Sprintf("%s_%d_source", host, port)
+}
+
+func withinHybrid() bool {
+	return *withinK8s && *hybrid
+}
+
+// fetchHybridEndpoints fetches the endpoints of the given service from both
+// Kubernetes and etcd.
+func (eh *endpointsHub) fetchHybridEndpoints(namespace, serviceName string) (map[string]*api.Endpoints, error) {
+	k8sEps, err := eh.fetchK8sEndpoints(namespace, serviceName)
+	if err != nil {
+		return nil, err
+	}
+
+	etcdEps, err := eh.fetchEndpoints(namespace, serviceName)
+	if err != nil {
+		return nil, err
+	}
+
+	return map[string]*api.Endpoints{
+		sourceK8s:  k8sEps,
+		sourceEtcd: etcdEps,
+	}, nil
+}
+
+// applySourceEndpoints applies the endpoints from the given source to the
+// service object. In hybrid mode they are merged with the endpoints from
+// the other sources first.
+func (eh *endpointsHub) applySourceEndpoints(so *serviceObject, source string, eps *api.Endpoints) {
+	if !withinHybrid() {
+		eh.applyEndpoints(so, eps)
+		return
+	}
+
+	// Hold the lock while applying so that merged endpoints are applied in
+	// the same order as they are merged.
+	so.sourceLock.Lock()
+	defer so.sourceLock.Unlock()
+
+	if so.sourceEps == nil {
+		so.sourceEps = make(map[string]*api.Endpoints)
+	}
+	so.sourceEps[source] = eps
+	eh.applyEndpoints(so, mergeSourceEndpoints(so.Spec(), so.sourceEps))
+}
+
+// copyEndpointLabels copies the labels of the given endpoint, such as its
+// weight, cluster and metadata, from src to dst.
+func copyEndpointLabels(dst, src *api.Endpoints, host string, port int32) {
+	prefix := calculateEndpointLabelPrefix(host, port)
+	for k, v := range src.Labels {
+		if strings.HasPrefix(k, prefix) {
+			dst.Labels[k] = v
+		}
+	}
+}
+
+// mergeSourceEndpoints returns the union of the endpoints from all sources
+// for the given service spec. Each endpoint is tagged with its source in
+// the labels.
+func mergeSourceEndpoints(spec *pb.ServiceSpec, sources map[string]*api.Endpoints) *api.Endpoints {
+	merged := api.Endpoints{}
+	merged.Name = spec.ServiceName
+	merged.Namespace = spec.Namespace
+	merged.Labels = make(map[string]string)
+
+	for _, source := range hybridSources {
+		eps, ok := sources[source]
+		if !ok || eps == nil {
+			continue
+		}
+
+		for _, s := range eps.Subsets {
+			port := findPort(s.Ports, spec.PortName)
+			if port == 0 {
+				continue
+			}
+
+			subset := api.EndpointSubset{
+				Ports: s.Ports,
+			}
+			tag := func(addr api.EndpointAddress) bool {
+				sourceKey := calculateSourceKey(addr.IP, port)
+				if prev, ok := merged.Labels[sourceKey]; ok {
+					glog.Warningf("Endpoint %s:%d of service %s.%s shows up in both %s and %s, use the one from %s.",
+						addr.IP, port, spec.Namespace, spec.ServiceName, prev, source, prev)
+					return false
+				}
+				copyEndpointLabels(&merged, eps, addr.IP, port)
+				merged.Labels[sourceKey] = source
+				return true
+			}
+			for _, addr := range s.Addresses {
+				if tag(addr) {
+					subset.Addresses = append(subset.Addresses, addr)
+				}
+			}
+			for _, addr := range s.NotReadyAddresses {
+				if tag(addr) {
+					subset.NotReadyAddresses = append(subset.NotReadyAddresses, addr)
+				}
+			}
+			merged.Subsets = append(merged.Subsets, subset)
+		}
+	}
+	return &merged
+}
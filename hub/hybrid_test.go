@@ -0,0 +1,108 @@
+package hub
+
+import (
+	"bytes"
+	"fmt"
+	"testing"
+
+	. "github.com/smartystreets/goconvey/convey"
+	api "k8s.io/api/core/v1"
+
+	pb "github.com/binchencoder/skylb-api/proto"
+	"github.com/binchencoder/skylb/hub/util"
+)
+
+func newSourceEndpoints(weights map[string]string, ips ...string) *api.Endpoints {
+	eps := api.Endpoints{}
+	eps.Name = serviceName
+	eps.Namespace = namespace
+	eps.Labels = weights
+	for _, ip := range ips {
+		eps.Subsets = append(eps.Subsets, api.EndpointSubset{
+			Addresses: []api.EndpointAddress{{IP: ip}},
+			Ports: []api.EndpointPort{
+				{Name: portName, Port: 8080},
+			},
+		})
+	}
+	return &eps
+}
+
+func TestMergeSourceEndpoints(t *testing.T) {
+	spec := &pb.ServiceSpec{
+		Namespace:   namespace,
+		ServiceName: serviceName,
+		PortName:    portName,
+	}
+
+	Convey("Merge endpoints from kubernetes and etcd", t, func() {
+		Convey("Should publish the union", func() {
+			merged := mergeSourceEndpoints(spec, map[string]*api.Endpoints{
+				sourceK8s:  newSourceEndpoints(nil, "172.0.10.1"),
+				sourceEtcd: newSourceEndpoints(map[string]string{"172.0.10.2_8080_weight": "20"}, "172.0.10.2"),
+			})
+
+			epsMap := skypbEndpointsToMap(spec, merged)
+			So(epsMap, ShouldHaveLength, 2)
+			So(epsMap["172.0.10.1:8080"].Source, ShouldEqual, sourceK8s)
+			So(epsMap["172.0.10.2:8080"].Source, ShouldEqual, sourceEtcd)
+			So(epsMap["172.0.10.2:8080"].Weight, ShouldEqual, 20)
+
+			Convey("The source should be visible in the endpoints", func() {
+				so := newServiceObject(spec, nil)
+				so.endpoints = epsMap
+				eh := endpointsHub{
+					services: serviceMap{keyService1: so},
+				}
+
+				var buf bytes.Buffer
+				eh.describeEndpoints(&buf)
+				So(buf.String(), ShouldEqual, fmt.Sprintf("%s.%s\n", namespace, serviceName)+
+					"\t172.0.10.1:8080 weight=0 ready=true source=k8s\n"+
+					"\t172.0.10.2:8080 weight=20 ready=true source=etcd\n")
+			})
+		})
+
+		Convey("Kubernetes should win on conflicts", func() {
+			merged := mergeSourceEndpoints(spec, map[string]*api.Endpoints{
+				sourceK8s:  newSourceEndpoints(map[string]string{"172.0.10.1_8080_weight": "10"}, "172.0.10.1"),
+				sourceEtcd: newSourceEndpoints(map[string]string{"172.0.10.1_8080_weight": "30"}, "172.0.10.1"),
+			})
+
+			epsMap := skypbEndpointsToMap(spec, merged)
+			So(epsMap, ShouldHaveLength, 1)
+			So(epsMap["172.0.10.1:8080"].Source, ShouldEqual, sourceK8s)
+			So(epsMap["172.0.10.1:8080"].Weight, ShouldEqual, 10)
+		})
+
+		Convey("Should carry all labels of each endpoint", func() {
+			k8sEps := newSourceEndpoints(map[string]string{
+				"172.0.10.1_8080_cluster":   "east",
+				"172.0.10.1_8080_meta_zone": "z1",
+				"172.0.10.3_8080_weight":    "40",
+				"172.0.10.3_8080_cluster":   "west",
+			}, "172.0.10.1")
+			k8sEps.Subsets[0].NotReadyAddresses = []api.EndpointAddress{{IP: "172.0.10.3"}}
+			merged := mergeSourceEndpoints(spec, map[string]*api.Endpoints{
+				sourceK8s: k8sEps,
+			})
+
+			So(merged.Labels["172.0.10.1_8080_cluster"], ShouldEqual, "east")
+			So(util.EndpointMetadata(merged, "172.0.10.1", 8080), ShouldResemble, map[string]string{"zone": "z1"})
+			So(merged.Subsets[0].NotReadyAddresses, ShouldHaveLength, 1)
+			So(merged.Labels[calculateSourceKey("172.0.10.3", 8080)], ShouldEqual, sourceK8s)
+			So(merged.Labels["172.0.10.3_8080_weight"], ShouldEqual, "40")
+			So(merged.Labels["172.0.10.3_8080_cluster"], ShouldEqual, "west")
+		})
+
+		Convey("Missing source should be ignored", func() {
+			merged := mergeSourceEndpoints(spec, map[string]*api.Endpoints{
+				sourceEtcd: newSourceEndpoints(nil, "172.0.10.2"),
+			})
+
+			epsMap := skypbEndpointsToMap(spec, merged)
+			So(epsMap, ShouldHaveLength, 1)
+			So(epsMap, ShouldContainKey, "172.0.10.2:8080")
+		})
+	})
+}
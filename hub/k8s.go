@@ -1,85 +1,322 @@
 package hub
 
 import (
-	"fmt"
+	"errors"
+	"flag"
 	"time"
 
 	"github.com/golang/glog"
+	"golang.org/x/net/context"
 	api "k8s.io/api/core/v1"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
-	"k8s.io/apimachinery/pkg/fields"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/watch"
 	"k8s.io/client-go/kubernetes"
-	corev1 "k8s.io/client-go/kubernetes/typed/core/v1"
 	"k8s.io/client-go/rest"
 	"k8s.io/client-go/tools/cache"
+	"k8s.io/client-go/tools/clientcmd"
+
+	"github.com/binchencoder/letsgo/strings"
+)
+
+const (
+	k8sResyncPeriod = 60 * time.Second
+
+	k8sAPIEndpoints      = "endpoints"
+	k8sAPIEndpointSlices = "endpointslices"
 )
 
 var (
-	k8sv1 corev1.CoreV1Interface
+	// Watching endpointslices uses discovery.k8s.io/v1, which is served
+	// by Kubernetes 1.21 and later only.
+	k8sEndpointsAPI = flag.String("k8s-endpoints-api", k8sAPIEndpoints, "The Kubernetes API to watch service endpoints from, endpoints or endpointslices. endpointslices requires Kubernetes 1.21+")
+	kubeconfig      = flag.String("kubeconfig", "", "The kubeconfig file to connect to Kubernetes clusters. If empty, the in-cluster config is used")
+	k8sContexts     = flag.String("k8s-contexts", "", "Comma separated kubeconfig contexts of the clusters to watch. If empty, the current context is used")
+	k8sClusterName  = flag.String("k8s-cluster-name", "", "The cluster name for the in-cluster config. If set, endpoints carry it as the cluster label")
+
+	// k8sClusters are the watched Kubernetes clusters. It's set up before
+	// the informers start and never changes afterwards.
+	k8sClusters []*k8sCluster
+
+	errK8sNotSynced = errors.New("kubernetes endpoints informer has not synced yet")
 )
 
-func getClient() (*kubernetes.Clientset, error) {
-	config, err := rest.InClusterConfig()
-	if err != nil {
-		return nil, err
+// k8sCluster holds the informer cache of one Kubernetes cluster.
+type k8sCluster struct {
+	name string
+
+	// The local cache of the endpoints informer, keyed by
+	// "<namespace>/<name>".
+	store cache.Store
+	// The local cache of the endpoint slice informer, indexed by
+	// k8sServiceIndex.
+	sliceIndexer cache.Indexer
+	// Reports whether the informer, either of endpoints or of endpoint
+	// slices, has synced.
+	synced cache.InformerSynced
+}
+
+// endpoints returns the endpoints of the given service from the cluster's
+// local cache. It returns false if the service is absent in the cluster.
+func (c *k8sCluster) endpoints(namespace, serviceName string) (*api.Endpoints, bool, error) {
+	if c.sliceIndexer != nil {
+		slices, err := c.sliceIndexer.ByIndex(k8sServiceIndex, namespace+"/"+serviceName)
+		if err != nil {
+			return nil, false, err
+		}
+		return endpointSlicesToEndpoints(namespace, serviceName, slices), len(slices) > 0, nil
+	}
+
+	obj, exists, err := c.store.GetByKey(namespace + "/" + serviceName)
+	if err != nil || !exists {
+		return nil, false, err
 	}
-	return kubernetes.NewForConfig(config)
+	// Objects in the cache must not be modified.
+	return obj.(*api.Endpoints).DeepCopy(), true, nil
+}
+
+// k8sClientConfig is the client config of a cluster to watch.
+type k8sClientConfig struct {
+	name   string
+	config *rest.Config
 }
 
+// k8sClientConfigs returns the client configs of the clusters to watch, in
+// the order of the contexts in flag --k8s-contexts, which is also the order
+// the clusters win when an endpoint shows up in more than one of them.
+func k8sClientConfigs() ([]k8sClientConfig, error) {
+	if *kubeconfig == "" {
+		config, err := rest.InClusterConfig()
+		if err != nil {
+			return nil, err
+		}
+		return []k8sClientConfig{{name: *k8sClusterName, config: config}}, nil
+	}
+
+	contexts := strings.CsvToSlice(*k8sContexts)
+	if len(contexts) == 0 {
+		raw, err := clientcmd.LoadFromFile(*kubeconfig)
+		if err != nil {
+			return nil, err
+		}
+		contexts = []string{raw.CurrentContext}
+	}
+
+	configs := []k8sClientConfig{}
+	rules := &clientcmd.ClientConfigLoadingRules{ExplicitPath: *kubeconfig}
+	for _, ctx := range contexts {
+		overrides := &clientcmd.ConfigOverrides{CurrentContext: ctx}
+		config, err := clientcmd.NewNonInteractiveDeferredLoadingClientConfig(rules, overrides).ClientConfig()
+		if err != nil {
+			return nil, err
+		}
+		configs = append(configs, k8sClientConfig{name: ctx, config: config})
+	}
+	return configs, nil
+}
+
+// startK8sWatcher starts the endpoints informer of every Kubernetes cluster
+// and waits until their local caches are synced.
 func (eh *endpointsHub) startK8sWatcher() {
-	k8sCliset, err := getClient()
+	configs, err := k8sClientConfigs()
 	if err != nil {
 		glog.Fatalln(err)
 	}
-	glog.Infoln("Established connection to Kubernetes API server.")
-
-	k8sv1 = k8sCliset.CoreV1()
-	wlist := cache.NewListWatchFromClient(k8sCliset.CoreV1().RESTClient(), "endpoints", metav1.NamespaceAll, fields.Everything())
-	go func() {
-		_, controller := cache.NewInformer(wlist, &api.Endpoints{}, 60*time.Second,
-			cache.ResourceEventHandlerFuncs{
-				AddFunc: func(obj interface{}) {},
-				UpdateFunc: func(oldObj, newObj interface{}) {
-					if newEps, ok := newObj.(*api.Endpoints); ok {
-						key := eh.calculateKey(newEps.ObjectMeta.Namespace, newEps.ObjectMeta.Name)
-						newEps, _ := newObj.(*api.Endpoints)
-						eh.applyK8sEndpoints(key, newEps)
-					}
-				},
-				DeleteFunc: func(obj interface{}) {},
-			})
-
-		stop := make(chan struct{})
-		defer close(stop)
-		controller.Run(stop)
-	}()
+
+	controllers := []cache.Controller{}
+	for _, cc := range configs {
+		cli, err := kubernetes.NewForConfig(cc.config)
+		if err != nil {
+			glog.Fatalf("Failed to create client of Kubernetes cluster %q, %v", cc.name, err)
+		}
+		glog.Infof("Established connection to Kubernetes API server %s of cluster %q.", cc.config.Host, cc.name)
+
+		c, controller := eh.newK8sCluster(cc.name, cli)
+		k8sClusters = append(k8sClusters, c)
+		controllers = append(controllers, controller)
+	}
+
+	// The informers run for the lifetime of the process.
+	stop := make(chan struct{})
+	for _, controller := range controllers {
+		go controller.Run(stop)
+	}
+	for _, c := range k8sClusters {
+		if !cache.WaitForCacheSync(stop, c.synced) {
+			glog.Fatalf("Failed to sync endpoints informer of Kubernetes cluster %q.", c.name)
+		}
+	}
+	glog.Infof("Endpoints informers of %d Kubernetes cluster(s) synced.", len(k8sClusters))
 }
 
-func (eh *endpointsHub) applyK8sEndpoints(key string, eps *api.Endpoints) {
-	var so *serviceObject
-	eh.WithRLock(func() error {
-		so, _ = eh.services[key]
-		return nil
-	})
-	if so == nil {
-		// It's normal to get nil service objects because not all services
-		// use SkyLB.
-		glog.V(6).Infof("serviceObject is nil for key %#v", key)
+// newK8sCluster creates the cluster and its informer of the API selected by
+// flag --k8s-endpoints-api.
+func (eh *endpointsHub) newK8sCluster(name string, cli kubernetes.Interface) (*k8sCluster, cache.Controller) {
+	c := &k8sCluster{
+		name: name,
+	}
+
+	var controller cache.Controller
+	switch *k8sEndpointsAPI {
+	case k8sAPIEndpoints:
+		controller = eh.newK8sEndpointsInformer(c, cli)
+	case k8sAPIEndpointSlices:
+		controller = eh.newK8sEndpointSliceInformer(c, cli)
+	default:
+		glog.Fatalf("Unknown Kubernetes endpoints API %q.", *k8sEndpointsAPI)
+	}
+	return c, controller
+}
+
+// newK8sEndpointsInformer creates the informer which watches endpoints in
+// all namespaces of the given cluster and applies them to observed services.
+func (eh *endpointsHub) newK8sEndpointsInformer(c *k8sCluster, cli kubernetes.Interface) cache.Controller {
+	wlist := &cache.ListWatch{
+		ListFunc: func(options metav1.ListOptions) (runtime.Object, error) {
+			return cli.CoreV1().Endpoints(metav1.NamespaceAll).List(context.Background(), options)
+		},
+		WatchFunc: func(options metav1.ListOptions) (watch.Interface, error) {
+			return cli.CoreV1().Endpoints(metav1.NamespaceAll).Watch(context.Background(), options)
+		},
+	}
+	store, controller := cache.NewInformer(wlist, &api.Endpoints{}, k8sResyncPeriod,
+		cache.ResourceEventHandlerFuncs{
+			AddFunc: func(obj interface{}) {
+				if eps, ok := obj.(*api.Endpoints); ok {
+					glog.V(4).Infof("Kubernetes endpoints %s.%s added in cluster %q.", eps.Namespace, eps.Name, c.name)
+					eh.applyK8sEndpoints(eps.Namespace, eps.Name)
+				}
+			},
+			UpdateFunc: func(oldObj, newObj interface{}) {
+				if eps, ok := newObj.(*api.Endpoints); ok {
+					eh.applyK8sEndpoints(eps.Namespace, eps.Name)
+				}
+			},
+			DeleteFunc: func(obj interface{}) {
+				// The final state is unknown if the watch missed the deletion.
+				if tombstone, ok := obj.(cache.DeletedFinalStateUnknown); ok {
+					obj = tombstone.Obj
+				}
+				if eps, ok := obj.(*api.Endpoints); ok {
+					glog.V(4).Infof("Kubernetes endpoints %s.%s deleted in cluster %q.", eps.Namespace, eps.Name, c.name)
+					eh.applyK8sEndpoints(eps.Namespace, eps.Name)
+				}
+			},
+		})
+
+	c.store = store
+	c.synced = controller.HasSynced
+	return controller
+}
+
+// applyK8sEndpoints aggregates the endpoints of the given service across
+// all clusters and applies them. When the service is gone from all clusters
+// the observers are notified with an explicit empty set.
+func (eh *endpointsHub) applyK8sEndpoints(namespace, serviceName string) {
+	key := eh.calculateKey(namespace, serviceName)
+	eps, exists, err := aggregateK8sEndpoints(namespace, serviceName)
+	if err != nil {
+		glog.Errorf("Failed to get endpoints of service %s.%s from Kubernetes, %v", namespace, serviceName, err)
+		return
+	}
+	if !exists {
+		glog.V(4).Infof("Service %s.%s deleted from all Kubernetes clusters.", namespace, serviceName)
+		eh.deleteServiceEndpoints(key, sourceK8s)
 		return
 	}
-	eh.applyEndpoints(so, eps)
+	eh.applyServiceEndpoints(key, sourceK8s, eps)
 }
 
+// fetchK8sEndpoints returns the endpoints of the given service from the
+// informers' local caches.
 func (eh *endpointsHub) fetchK8sEndpoints(namespace, serviceName string) (*api.Endpoints, error) {
-	epsList, err := k8sv1.Endpoints(namespace).List(metav1.ListOptions{})
+	for _, c := range k8sClusters {
+		if !c.synced() {
+			return nil, errK8sNotSynced
+		}
+	}
+
+	eps, exists, err := aggregateK8sEndpoints(namespace, serviceName)
 	if err != nil {
 		return nil, err
 	}
+	if !exists {
+		glog.Warningf("Service %s.%s absent in kubernetes, return empty list.", namespace, serviceName)
+	}
+	return eps, nil
+}
+
+// aggregateK8sEndpoints returns the union of the endpoints of the given
+// service in all clusters. It returns false if the service is absent in
+// all clusters.
+func aggregateK8sEndpoints(namespace, serviceName string) (*api.Endpoints, bool, error) {
+	merged := api.Endpoints{}
+	merged.Name = serviceName
+	merged.Namespace = namespace
+
+	found := false
+	for _, c := range k8sClusters {
+		eps, exists, err := c.endpoints(namespace, serviceName)
+		if err != nil {
+			return nil, false, err
+		}
+		if !exists {
+			continue
+		}
+		found = true
+		mergeClusterEndpoints(&merged, c.name, eps)
+	}
+	return &merged, found, nil
+}
+
+// mergeClusterEndpoints merges the endpoints of the given cluster into
+// merged. If the cluster has a name, each endpoint is tagged with it in the
+// labels, which EndpointsHandler shows. It's not sent to clients, since
+// pb.InstanceEndpoint has no field for it. When the same endpoint shows up
+// in more than one cluster, e.g. with overlapping pod networks, the one
+// merged first wins.
+func mergeClusterEndpoints(merged *api.Endpoints, cluster string, eps *api.Endpoints) {
+	if merged.Labels == nil {
+		merged.Labels = make(map[string]string)
+	}
+	for k, v := range eps.Labels {
+		if _, ok := merged.Labels[k]; !ok {
+			merged.Labels[k] = v
+		}
+	}
+	if cluster == "" {
+		merged.Subsets = append(merged.Subsets, eps.Subsets...)
+		return
+	}
 
-	for _, eps := range epsList.Items {
-		if eps.Name == serviceName {
-			return &eps, nil
+	for _, s := range eps.Subsets {
+		subset := api.EndpointSubset{
+			Ports: s.Ports,
+		}
+		tag := func(addr api.EndpointAddress) bool {
+			for _, p := range s.Ports {
+				clusterKey := calculateClusterKey(addr.IP, p.Port)
+				if prev, ok := merged.Labels[clusterKey]; ok && prev != cluster {
+					glog.Warningf("Endpoint %s:%d of service %s.%s shows up in both cluster %q and %q, use the one in %q.",
+						addr.IP, p.Port, merged.Namespace, merged.Name, prev, cluster, prev)
+					return false
+				}
+			}
+			for _, p := range s.Ports {
+				merged.Labels[calculateClusterKey(addr.IP, p.Port)] = cluster
+			}
+			return true
+		}
+		for _, addr := range s.Addresses {
+			if tag(addr) {
+				subset.Addresses = append(subset.Addresses, addr)
+			}
+		}
+		for _, addr := range s.NotReadyAddresses {
+			if tag(addr) {
+				subset.NotReadyAddresses = append(subset.NotReadyAddresses, addr)
+			}
 		}
+		merged.Subsets = append(merged.Subsets, subset)
 	}
-	return nil, fmt.Errorf("endpoints for service %s.%s was not found", namespace, serviceName)
 }
@@ -0,0 +1,201 @@
+package hub
+
+import (
+	"fmt"
+
+	"golang.org/x/net/context"
+	api "k8s.io/api/core/v1"
+	discovery "k8s.io/api/discovery/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/watch"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/tools/cache"
+
+	"github.com/binchencoder/skylb/hub/util"
+)
+
+const (
+	// k8sServiceIndex indexes endpoint slices by "<namespace>/<service>".
+	k8sServiceIndex = "service"
+)
+
+// sliceServiceKey returns the index key of the service which owns the given
+// endpoint slice, or an empty string if the slice has no owner service.
+func sliceServiceKey(slice *discovery.EndpointSlice) string {
+	svc, ok := slice.Labels[discovery.LabelServiceName]
+	if !ok || svc == "" {
+		return ""
+	}
+	return fmt.Sprintf("%s/%s", slice.Namespace, svc)
+}
+
+func indexSliceByService(obj interface{}) ([]string, error) {
+	slice, ok := obj.(*discovery.EndpointSlice)
+	if !ok {
+		return nil, nil
+	}
+	if key := sliceServiceKey(slice); key != "" {
+		return []string{key}, nil
+	}
+	return nil, nil
+}
+
+// newK8sEndpointSliceInformer creates the informer which watches endpoint
+// slices in all namespaces of the given cluster. On every change, all slices
+// of the service are merged and applied to the observers of the service.
+func (eh *endpointsHub) newK8sEndpointSliceInformer(c *k8sCluster, cli kubernetes.Interface) cache.Controller {
+	wlist := &cache.ListWatch{
+		ListFunc: func(options metav1.ListOptions) (runtime.Object, error) {
+			return cli.DiscoveryV1().EndpointSlices(metav1.NamespaceAll).List(context.Background(), options)
+		},
+		WatchFunc: func(options metav1.ListOptions) (watch.Interface, error) {
+			return cli.DiscoveryV1().EndpointSlices(metav1.NamespaceAll).Watch(context.Background(), options)
+		},
+	}
+
+	onChange := func(obj interface{}) {
+		// The final state is unknown if the watch missed the deletion.
+		if tombstone, ok := obj.(cache.DeletedFinalStateUnknown); ok {
+			obj = tombstone.Obj
+		}
+		slice, ok := obj.(*discovery.EndpointSlice)
+		if !ok {
+			return
+		}
+		svc := slice.Labels[discovery.LabelServiceName]
+		if svc == "" {
+			return
+		}
+		eh.applyK8sEndpoints(slice.Namespace, svc)
+	}
+
+	indexer, controller := cache.NewIndexerInformer(wlist, &discovery.EndpointSlice{}, k8sResyncPeriod,
+		cache.ResourceEventHandlerFuncs{
+			AddFunc: onChange,
+			UpdateFunc: func(oldObj, newObj interface{}) {
+				onChange(newObj)
+			},
+			DeleteFunc: onChange,
+		},
+		cache.Indexers{k8sServiceIndex: indexSliceByService})
+
+	c.sliceIndexer = indexer
+	c.synced = controller.HasSynced
+	return controller
+}
+
+// endpointSlicesToEndpoints merges the given endpoint slices of a service
+// into one endpoints object with one subset per port name.
+//
+// Ready endpoints go to Addresses. If a port has no ready endpoint, the
+// endpoints which are terminating but still serving are used instead, so
+// that the service keeps working while all of its pods are rolled.
+// Everything else goes to NotReadyAddresses. The zone of an endpoint, if
+// known, is set as its metadata, see ZoneMetadataKey.
+func endpointSlicesToEndpoints(namespace, serviceName string, slices []interface{}) *api.Endpoints {
+	type portEndpoints struct {
+		port       api.EndpointPort
+		ready      []api.EndpointAddress
+		terminated []api.EndpointAddress // Terminating but serving.
+		notReady   []api.EndpointAddress
+		seen       map[string]struct{}
+		zones      map[string]string // By IP, if the slice knows the zone.
+	}
+	ports := map[string]*portEndpoints{}
+	names := []string{}
+
+	for _, obj := range slices {
+		slice, ok := obj.(*discovery.EndpointSlice)
+		if !ok || slice.AddressType == discovery.AddressTypeFQDN {
+			continue
+		}
+
+		for _, sp := range slice.Ports {
+			if sp.Port == nil {
+				continue
+			}
+			name := ""
+			if sp.Name != nil {
+				name = *sp.Name
+			}
+			pe, ok := ports[name]
+			if !ok {
+				pe = &portEndpoints{
+					port: api.EndpointPort{
+						Name: name,
+						Port: *sp.Port,
+					},
+					seen:  map[string]struct{}{},
+					zones: map[string]string{},
+				}
+				if sp.Protocol != nil {
+					pe.port.Protocol = *sp.Protocol
+				}
+				ports[name] = pe
+				names = append(names, name)
+			}
+
+			for _, ep := range slice.Endpoints {
+				if len(ep.Addresses) == 0 {
+					continue
+				}
+				// Only the first address is used, same as kube-proxy.
+				ip := ep.Addresses[0]
+				if _, ok := pe.seen[ip]; ok {
+					// The endpoint may show up in two slices for a moment
+					// when it's moved between them.
+					continue
+				}
+				pe.seen[ip] = struct{}{}
+				if ep.Zone != nil && *ep.Zone != "" {
+					pe.zones[ip] = *ep.Zone
+				}
+
+				addr := api.EndpointAddress{
+					IP:        ip,
+					NodeName:  ep.NodeName,
+					TargetRef: ep.TargetRef,
+				}
+				if ep.Hostname != nil {
+					addr.Hostname = *ep.Hostname
+				}
+
+				cond := ep.Conditions
+				terminating := cond.Terminating != nil && *cond.Terminating
+				switch {
+				// A nil ready condition should be interpreted as ready.
+				case (cond.Ready == nil || *cond.Ready) && !terminating:
+					pe.ready = append(pe.ready, addr)
+				case terminating && cond.Serving != nil && *cond.Serving:
+					pe.terminated = append(pe.terminated, addr)
+				default:
+					pe.notReady = append(pe.notReady, addr)
+				}
+			}
+		}
+	}
+
+	eps := api.Endpoints{}
+	eps.Name = serviceName
+	eps.Namespace = namespace
+	for _, name := range names {
+		pe := ports[name]
+		subset := api.EndpointSubset{
+			Ports:             []api.EndpointPort{pe.port},
+			Addresses:         pe.ready,
+			NotReadyAddresses: pe.notReady,
+		}
+		if len(pe.ready) == 0 {
+			subset.Addresses = pe.terminated
+		} else {
+			subset.NotReadyAddresses = append(subset.NotReadyAddresses, pe.terminated...)
+		}
+		eps.Subsets = append(eps.Subsets, subset)
+
+		for ip, zone := range pe.zones {
+			util.SetEndpointMetadata(&eps, ip, pe.port.Port, map[string]string{ZoneMetadataKey: zone})
+		}
+	}
+	return &eps
+}
@@ -0,0 +1,127 @@
+package hub
+
+import (
+	"testing"
+
+	. "github.com/smartystreets/goconvey/convey"
+	api "k8s.io/api/core/v1"
+	discovery "k8s.io/api/discovery/v1"
+
+	pb "github.com/binchencoder/skylb-api/proto"
+)
+
+type sliceEndpoint struct {
+	ip                          string
+	ready, serving, terminating bool
+}
+
+func newEndpointSlice(name string, port int32, eps ...sliceEndpoint) *discovery.EndpointSlice {
+	pn := portName
+	slice := discovery.EndpointSlice{
+		AddressType: discovery.AddressTypeIPv4,
+		Ports: []discovery.EndpointPort{
+			{Name: &pn, Port: &port},
+		},
+	}
+	slice.Name = name
+	slice.Namespace = namespace
+	slice.Labels = map[string]string{
+		discovery.LabelServiceName: serviceName,
+	}
+	for _, ep := range eps {
+		ready, serving, terminating := ep.ready, ep.serving, ep.terminating
+		slice.Endpoints = append(slice.Endpoints, discovery.Endpoint{
+			Addresses: []string{ep.ip},
+			Conditions: discovery.EndpointConditions{
+				Ready:       &ready,
+				Serving:     &serving,
+				Terminating: &terminating,
+			},
+		})
+	}
+	return &slice
+}
+
+func readyAddrs(eps *api.Endpoints) []string {
+	addrs := []string{}
+	for _, s := range eps.Subsets {
+		for _, a := range s.Addresses {
+			addrs = append(addrs, a.IP)
+		}
+	}
+	return addrs
+}
+
+func notReadyAddrs(eps *api.Endpoints) []string {
+	addrs := []string{}
+	for _, s := range eps.Subsets {
+		for _, a := range s.NotReadyAddresses {
+			addrs = append(addrs, a.IP)
+		}
+	}
+	return addrs
+}
+
+func TestEndpointSlicesToEndpoints(t *testing.T) {
+	spec := &pb.ServiceSpec{
+		Namespace:   namespace,
+		ServiceName: serviceName,
+		PortName:    portName,
+	}
+
+	Convey("Merge endpoint slices of a service", t, func() {
+		Convey("Should merge all slices into one subset per port name", func() {
+			eps := endpointSlicesToEndpoints(namespace, serviceName, []interface{}{
+				newEndpointSlice("s1", 8080,
+					sliceEndpoint{ip: "172.0.10.1", ready: true, serving: true},
+					sliceEndpoint{ip: "172.0.10.2", ready: true, serving: true}),
+				newEndpointSlice("s2", 8080,
+					sliceEndpoint{ip: "172.0.10.3", ready: true, serving: true},
+					// Shows up in two slices while being moved.
+					sliceEndpoint{ip: "172.0.10.2", ready: true, serving: true}),
+			})
+			So(eps.Subsets, ShouldHaveLength, 1)
+			So(skypbEndpointsToMap(spec, eps), ShouldHaveLength, 3)
+		})
+
+		Convey("Should respect the endpoint conditions", func() {
+			eps := endpointSlicesToEndpoints(namespace, serviceName, []interface{}{
+				newEndpointSlice("s1", 8080,
+					sliceEndpoint{ip: "172.0.10.1", ready: true, serving: true},
+					sliceEndpoint{ip: "172.0.10.2", ready: false, serving: false},
+					sliceEndpoint{ip: "172.0.10.3", ready: false, serving: true, terminating: true}),
+			})
+			So(readyAddrs(eps), ShouldResemble, []string{"172.0.10.1"})
+			So(notReadyAddrs(eps), ShouldResemble, []string{"172.0.10.2", "172.0.10.3"})
+		})
+
+		Convey("Should fall back to serving terminating endpoints", func() {
+			eps := endpointSlicesToEndpoints(namespace, serviceName, []interface{}{
+				newEndpointSlice("s1", 8080,
+					sliceEndpoint{ip: "172.0.10.1", ready: false, serving: true, terminating: true},
+					sliceEndpoint{ip: "172.0.10.2", ready: false, serving: false, terminating: true}),
+			})
+			So(readyAddrs(eps), ShouldResemble, []string{"172.0.10.1"})
+			So(notReadyAddrs(eps), ShouldResemble, []string{"172.0.10.2"})
+		})
+
+		Convey("Should carry the zone as metadata", func() {
+			slice := newEndpointSlice("s1", 8080,
+				sliceEndpoint{ip: "172.0.10.1", ready: true, serving: true},
+				sliceEndpoint{ip: "172.0.10.2", ready: true, serving: true})
+			zone := "zone-a"
+			slice.Endpoints[0].Zone = &zone
+			eps := endpointSlicesToEndpoints(namespace, serviceName, []interface{}{slice})
+			epsMap := skypbEndpointsToMap(spec, eps)
+			So(epsMap["172.0.10.1:8080"].Metadata, ShouldResemble, map[string]string{ZoneMetadataKey: "zone-a"})
+			So(epsMap["172.0.10.2:8080"].Metadata, ShouldBeNil)
+		})
+
+		Convey("Should skip FQDN slices", func() {
+			slice := newEndpointSlice("s1", 8080, sliceEndpoint{ip: "foo.example.com", ready: true})
+			slice.AddressType = discovery.AddressTypeFQDN
+			eps := endpointSlicesToEndpoints(namespace, serviceName, []interface{}{slice})
+			So(eps.Subsets, ShouldBeEmpty)
+		})
+	})
+}
@@ -0,0 +1,266 @@
+package hub
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+
+	. "github.com/smartystreets/goconvey/convey"
+	"golang.org/x/net/context"
+	api "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+	"k8s.io/client-go/tools/cache"
+
+	pb "github.com/binchencoder/skylb-api/proto"
+)
+
+func newK8sEndpoints(ips ...string) *api.Endpoints {
+	eps := api.Endpoints{}
+	eps.Name = serviceName
+	eps.Namespace = namespace
+	subset := api.EndpointSubset{
+		Ports: []api.EndpointPort{
+			{Name: portName, Port: 8080},
+		},
+	}
+	for _, ip := range ips {
+		subset.Addresses = append(subset.Addresses, api.EndpointAddress{IP: ip})
+	}
+	eps.Subsets = []api.EndpointSubset{subset}
+	return &eps
+}
+
+func TestK8sEndpointsInformer(t *testing.T) {
+	spec := &pb.ServiceSpec{
+		Namespace:   namespace,
+		ServiceName: serviceName,
+		PortName:    portName,
+	}
+
+	Convey("Watch Kubernetes endpoints with the informer", t, func() {
+		cli := fake.NewSimpleClientset()
+		eh := endpointsHub{
+			services: serviceMap{},
+		}
+
+		stop := make(chan struct{})
+		defer close(stop)
+		c, controller := eh.newK8sCluster("", cli)
+		k8sClusters = []*k8sCluster{c}
+		go controller.Run(stop)
+		So(cache.WaitForCacheSync(stop, controller.HasSynced), ShouldBeTrue)
+
+		eps, err := eh.fetchK8sEndpoints(namespace, serviceName)
+		So(err, ShouldBeNil)
+		So(eps.Subsets, ShouldBeEmpty)
+
+		so := newServiceObject(spec, nil)
+		eh.applyEndpoints(so, eps)
+		notifyCh := newTestObserver(so, "192.168.0.1:8000", ObserverOptions{ResolveFull: true})
+		eh.services[keyService1] = so
+
+		next := func() *pb.ServiceEndpoints {
+			select {
+			case up := <-notifyCh:
+				return up.Endpoints
+			case <-time.After(5 * time.Second):
+				return nil
+			}
+		}
+
+		ctx := context.Background()
+		endpoints := cli.CoreV1().Endpoints(namespace)
+
+		// Create.
+		_, err = endpoints.Create(ctx, newK8sEndpoints("172.0.10.1"), metav1.CreateOptions{})
+		So(err, ShouldBeNil)
+		up := next()
+		So(up, ShouldNotBeNil)
+		So(up.InstEndpoints, ShouldHaveLength, 1)
+
+		eps, err = eh.fetchK8sEndpoints(namespace, serviceName)
+		So(err, ShouldBeNil)
+		So(skypbEndpointsToMap(spec, eps), ShouldContainKey, "172.0.10.1:8080")
+
+		// Update.
+		_, err = endpoints.Update(ctx, newK8sEndpoints("172.0.10.1", "172.0.10.2"), metav1.UpdateOptions{})
+		So(err, ShouldBeNil)
+		up = next()
+		So(up, ShouldNotBeNil)
+		So(up.InstEndpoints, ShouldHaveLength, 2)
+
+		// Delete should notify an explicit empty set.
+		So(endpoints.Delete(ctx, serviceName, metav1.DeleteOptions{}), ShouldBeNil)
+		up = next()
+		So(up, ShouldNotBeNil)
+		So(up.InstEndpoints, ShouldBeEmpty)
+		So(so.endpoints, ShouldBeEmpty)
+
+		// Recreate.
+		_, err = endpoints.Create(ctx, newK8sEndpoints("172.0.10.3"), metav1.CreateOptions{})
+		So(err, ShouldBeNil)
+		up = next()
+		So(up, ShouldNotBeNil)
+		So(up.InstEndpoints, ShouldHaveLength, 1)
+		So(up.InstEndpoints[0].Host, ShouldEqual, "172.0.10.3")
+	})
+}
+
+func TestK8sMultiCluster(t *testing.T) {
+	spec := &pb.ServiceSpec{
+		Namespace:   namespace,
+		ServiceName: serviceName,
+		PortName:    portName,
+	}
+
+	Convey("Aggregate endpoints across Kubernetes clusters", t, func() {
+		eh := endpointsHub{
+			services: serviceMap{},
+		}
+
+		stop := make(chan struct{})
+		defer close(stop)
+
+		clis := map[string]*fake.Clientset{}
+		k8sClusters = nil
+		for _, name := range []string{"cluster1", "cluster2"} {
+			clis[name] = fake.NewSimpleClientset()
+			c, controller := eh.newK8sCluster(name, clis[name])
+			k8sClusters = append(k8sClusters, c)
+			go controller.Run(stop)
+			So(cache.WaitForCacheSync(stop, controller.HasSynced), ShouldBeTrue)
+		}
+
+		ctx := context.Background()
+		_, err := clis["cluster1"].CoreV1().Endpoints(namespace).Create(ctx, newK8sEndpoints("172.0.10.1"), metav1.CreateOptions{})
+		So(err, ShouldBeNil)
+		_, err = clis["cluster2"].CoreV1().Endpoints(namespace).Create(ctx, newK8sEndpoints("172.0.20.1", "172.0.10.1"), metav1.CreateOptions{})
+		So(err, ShouldBeNil)
+
+		var epsMap serviceEndpoints
+		for i := 0; i < 50; i++ {
+			eps, err := eh.fetchK8sEndpoints(namespace, serviceName)
+			So(err, ShouldBeNil)
+			if epsMap = skypbEndpointsToMap(spec, eps); len(epsMap) == 2 {
+				break
+			}
+			time.Sleep(100 * time.Millisecond)
+		}
+
+		So(epsMap, ShouldHaveLength, 2)
+		So(epsMap["172.0.10.1:8080"].Cluster, ShouldEqual, "cluster1")
+		So(epsMap["172.0.20.1:8080"].Cluster, ShouldEqual, "cluster2")
+
+		Convey("Deleted in one cluster should keep the others", func() {
+			So(clis["cluster1"].CoreV1().Endpoints(namespace).Delete(ctx, serviceName, metav1.DeleteOptions{}), ShouldBeNil)
+			for i := 0; i < 50; i++ {
+				eps, _ := eh.fetchK8sEndpoints(namespace, serviceName)
+				if epsMap = skypbEndpointsToMap(spec, eps); epsMap["172.0.10.1:8080"].Cluster == "cluster2" {
+					break
+				}
+				time.Sleep(100 * time.Millisecond)
+			}
+			So(epsMap, ShouldHaveLength, 2)
+			So(epsMap["172.0.10.1:8080"].Cluster, ShouldEqual, "cluster2")
+		})
+	})
+}
+
+func TestMergeClusterEndpoints(t *testing.T) {
+	Convey("Tag the endpoints of a cluster", t, func() {
+		merged := api.Endpoints{}
+		eps1 := newK8sEndpoints("172.0.10.1")
+		eps1.Subsets[0].NotReadyAddresses = []api.EndpointAddress{{IP: "172.0.10.2"}}
+		eps2 := newK8sEndpoints("172.0.10.2", "172.0.20.1")
+
+		mergeClusterEndpoints(&merged, "cluster1", eps1)
+		mergeClusterEndpoints(&merged, "cluster2", eps2)
+
+		So(merged.Labels[calculateClusterKey("172.0.10.1", 8080)], ShouldEqual, "cluster1")
+		So(merged.Labels[calculateClusterKey("172.0.10.2", 8080)], ShouldEqual, "cluster1")
+		So(merged.Labels[calculateClusterKey("172.0.20.1", 8080)], ShouldEqual, "cluster2")
+		So(merged.Subsets, ShouldHaveLength, 2)
+		So(merged.Subsets[0].NotReadyAddresses, ShouldHaveLength, 1)
+		So(merged.Subsets[1].Addresses, ShouldResemble, []api.EndpointAddress{{IP: "172.0.20.1"}})
+
+		Convey("The cluster should be visible in the endpoints", func() {
+			spec := &pb.ServiceSpec{
+				Namespace:   namespace,
+				ServiceName: serviceName,
+				PortName:    portName,
+			}
+			so := newServiceObject(spec, nil)
+			so.endpoints = skypbAllEndpointsToMap(spec, &merged)
+			eh := endpointsHub{
+				services: serviceMap{keyService1: so},
+			}
+
+			var buf bytes.Buffer
+			eh.describeEndpoints(&buf)
+			So(buf.String(), ShouldEqual, fmt.Sprintf("%s.%s\n", namespace, serviceName)+
+				"\t172.0.10.1:8080 weight=0 ready=true cluster=cluster1\n"+
+				"\t172.0.10.2:8080 weight=0 ready=false cluster=cluster1\n"+
+				"\t172.0.20.1:8080 weight=0 ready=true cluster=cluster2\n")
+		})
+	})
+}
+
+const testKubeconfig = `apiVersion: v1
+kind: Config
+clusters:
+- name: east
+  cluster:
+    server: https://east.example.com
+- name: west
+  cluster:
+    server: https://west.example.com
+contexts:
+- name: east
+  context:
+    cluster: east
+- name: west
+  context:
+    cluster: west
+current-context: east
+`
+
+func TestK8sClientConfigs(t *testing.T) {
+	Convey("Load the client configs of the clusters", t, func() {
+		f, err := ioutil.TempFile("", "kubeconfig")
+		So(err, ShouldBeNil)
+		defer os.Remove(f.Name())
+		_, err = f.WriteString(testKubeconfig)
+		So(err, ShouldBeNil)
+		So(f.Close(), ShouldBeNil)
+
+		prevKubeconfig, prevContexts := *kubeconfig, *k8sContexts
+		defer func() {
+			*kubeconfig, *k8sContexts = prevKubeconfig, prevContexts
+		}()
+		*kubeconfig = f.Name()
+
+		Convey("In the order of the contexts", func() {
+			for _, contexts := range []string{"west,east", "east,west"} {
+				*k8sContexts = contexts
+				configs, err := k8sClientConfigs()
+				So(err, ShouldBeNil)
+				So(configs, ShouldHaveLength, 2)
+				names := configs[0].name + "," + configs[1].name
+				So(names, ShouldEqual, contexts)
+				So(configs[0].config.Host, ShouldEqual, "https://"+configs[0].name+".example.com")
+			}
+		})
+
+		Convey("Of the current context by default", func() {
+			*k8sContexts = ""
+			configs, err := k8sClientConfigs()
+			So(err, ShouldBeNil)
+			So(configs, ShouldHaveLength, 1)
+			So(configs[0].name, ShouldEqual, "east")
+		})
+	})
+}
@@ -7,13 +7,12 @@ import (
 	"path"
 	"time"
 
-	etcd "github.com/coreos/etcd/client"
-	"github.com/golang/glog"
 	"golang.org/x/net/context"
 	api "k8s.io/api/core/v1"
 
 	"github.com/binchencoder/skylb-api/prefix"
 	pb "github.com/binchencoder/skylb-api/proto"
+	"github.com/binchencoder/skylb/hub/util"
 )
 
 const (
@@ -22,40 +21,43 @@ const (
 
 var (
 	etcdKeyTtl = flag.Duration("etcd-key-ttl", 10*time.Second, "The etcd key TTL")
-
-	refreshOpts *etcd.SetOptions
-	setOpts     *etcd.SetOptions
 )
 
-func init() {
-	refreshOpts = &etcd.SetOptions{
-		TTL:     *etcdKeyTtl,
-		Refresh: true,
-	}
-	setOpts = &etcd.SetOptions{
-		TTL: *etcdKeyTtl,
-	}
+// calculateEndpointLabelPrefix returns the prefix of all labels of the
+// given endpoint.
+func calculateEndpointLabelPrefix(host string, port int32) string {
+	return fmt.Sprintf("%s_%d_", host, port)
 }
 
 func calculateWeightKey(host string, port int32) string {
 	return fmt.Sprintf("%s_%d_weight", host, port)
 }
 
-func (eh *endpointsHub) calculateKey(namespace, serviceName string) string {
+func calculateClusterKey(host string, port int32) string {
+	return fmt.Sprintf("%s_%d_cluster", host, port)
+}
+
+func calculateServiceKey(namespace, serviceName string) string {
 	return path.Join(prefix.EndpointsKey, namespace, serviceName)
 }
 
-func (eh *endpointsHub) calculateEndpointKey(namespace, serviceName, host string, port int32) string {
+func (eh *endpointsHub) calculateKey(namespace, serviceName string) string {
+	return calculateServiceKey(namespace, serviceName)
+}
+
+func calculateEndpointKey(namespace, serviceName, host string, port int32) string {
 	return path.Join(prefix.EndpointsKey, namespace, serviceName, fmt.Sprintf("%s_%d", host, port))
 }
 
+func (eh *endpointsHub) calculateEndpointKey(namespace, serviceName, host string, port int32) string {
+	return calculateEndpointKey(namespace, serviceName, host, port)
+}
+
 func (eh *endpointsHub) refreshKey(ctx context.Context, key string) error {
-	glog.V(6).Infof("etcd set %#v -- %#v | %#v\n", key, "", refreshOpts)
-	_, err := eh.etcdCli.Set(ctx, key, "", refreshOpts)
-	return err
+	return eh.registry.Refresh(ctx, key, *etcdKeyTtl)
 }
 
-func (eh *endpointsHub) setKey(ctx context.Context, key string, spec *pb.ServiceSpec, host string, port, weight int32) error {
+func (eh *endpointsHub) setKey(ctx context.Context, key string, spec *pb.ServiceSpec, host string, port, weight int32, metadata map[string]string) error {
 	eps := api.Endpoints{
 		Subsets: []api.EndpointSubset{
 			{
@@ -82,6 +84,7 @@ func (eh *endpointsHub) setKey(ctx context.Context, key string, spec *pb.Service
 			calculateWeightKey(host, port): fmt.Sprintf("%d", weight),
 		}
 	}
+	util.SetEndpointMetadata(&eps, host, port, metadata)
 	eps.Name = fmt.Sprintf("%s:%d", host, port)
 	eps.Namespace = spec.Namespace
 	b, err := json.Marshal(&eps)
@@ -89,7 +92,5 @@ func (eh *endpointsHub) setKey(ctx context.Context, key string, spec *pb.Service
 		return err
 	}
 
-	glog.V(6).Infof("etcd set %#v -- %#v | %#v\n", key, string(b), setOpts)
-	_, err = eh.etcdCli.Set(ctx, key, string(b), setOpts)
-	return err
+	return eh.registry.Put(ctx, key, string(b), *etcdKeyTtl)
 }
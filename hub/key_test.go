@@ -5,6 +5,7 @@ import (
 	"errors"
 	"testing"
 
+	etcdclient "github.com/coreos/etcd/client"
 	. "github.com/smartystreets/goconvey/convey"
 
 	"github.com/binchencoder/letsgo/testing/mocks/etcd"
@@ -16,6 +17,16 @@ const (
 	epKeyTestService = "/registry/services/endpoints/default/test-service/172.0.0.100_8080"
 )
 
+var (
+	refreshOpts = &etcdclient.SetOptions{
+		TTL:     *etcdKeyTtl,
+		Refresh: true,
+	}
+	setOpts = &etcdclient.SetOptions{
+		TTL: *etcdKeyTtl,
+	}
+)
+
 func TestCalculateKey(t *testing.T) {
 	Convey("Calculate etcd key from namespace and service name", t, func() {
 		eh := endpointsHub{}
@@ -40,7 +51,7 @@ func TestRefreshKey(t *testing.T) {
 			etcdcli := new(etcd.KeysAPIMock)
 			etcdcli.On("Set", ctx, keyTestService, "", refreshOpts).Return(nil, nil)
 			eh := endpointsHub{
-				etcdCli: etcdcli,
+				registry: &etcdRegistry{cli: etcdcli},
 			}
 
 			err := eh.refreshKey(context.Background(), keyTestService)
@@ -50,7 +61,7 @@ func TestRefreshKey(t *testing.T) {
 		Convey("When etcd returns error", func() {
 			etcdcli := new(etcd.KeysAPIMock)
 			eh := endpointsHub{
-				etcdCli: etcdcli,
+				registry: &etcdRegistry{cli: etcdcli},
 			}
 
 			mockErr := errors.New("mock-error")
@@ -60,6 +71,19 @@ func TestRefreshKey(t *testing.T) {
 			So(err, ShouldNotBeNil)
 			So(err, ShouldEqual, mockErr)
 		})
+
+		Convey("When the key does not exist", func() {
+			etcdcli := new(etcd.KeysAPIMock)
+			eh := endpointsHub{
+				registry: &etcdRegistry{cli: etcdcli},
+			}
+
+			mockErr := etcdclient.Error{Code: etcdclient.ErrorCodeKeyNotFound}
+			etcdcli.On("Set", ctx, keyTestService, "", refreshOpts).Return(nil, mockErr)
+
+			err := eh.refreshKey(context.Background(), keyTestService)
+			So(err, ShouldEqual, ErrKeyNotFound)
+		})
 	})
 }
 
@@ -75,27 +99,27 @@ func TestSetKey(t *testing.T) {
 		Convey("When everything is fine", func() {
 			etcdcli := new(etcd.KeysAPIMock)
 			eh := endpointsHub{
-				etcdCli: etcdcli,
+				registry: &etcdRegistry{cli: etcdcli},
 			}
 
 			expectedVal := "{\"metadata\":{\"name\":\"172.0.0.100:8080\",\"namespace\":\"default\",\"creationTimestamp\":null},\"subsets\":[{\"addresses\":[{\"ip\":\"172.0.0.100\",\"targetRef\":{\"kind\":\"Pod\",\"namespace\":\"default\"}}],\"ports\":[{\"name\":\"grpc\",\"port\":8080}]}]}"
 			etcdcli.On("Set", ctx, keyTestService, expectedVal, setOpts).Return(nil, nil)
 
-			err := eh.setKey(context.Background(), keyTestService, &spec, "172.0.0.100", 8080, 0)
+			err := eh.setKey(context.Background(), keyTestService, &spec, "172.0.0.100", 8080, 0, nil)
 			So(err, ShouldBeNil)
 		})
 
 		Convey("When etcd returns error", func() {
 			etcdcli := new(etcd.KeysAPIMock)
 			eh := endpointsHub{
-				etcdCli: etcdcli,
+				registry: &etcdRegistry{cli: etcdcli},
 			}
 
 			mockErr := errors.New("mock-error")
 			expectedVal := "{\"metadata\":{\"name\":\"172.0.0.100:8080\",\"namespace\":\"default\",\"creationTimestamp\":null},\"subsets\":[{\"addresses\":[{\"ip\":\"172.0.0.100\",\"targetRef\":{\"kind\":\"Pod\",\"namespace\":\"default\"}}],\"ports\":[{\"name\":\"grpc\",\"port\":8080}]}]}"
 			etcdcli.On("Set", ctx, keyTestService, expectedVal, setOpts).Return(nil, mockErr)
 
-			err := eh.setKey(context.Background(), keyTestService, &spec, "172.0.0.100", 8080, 0)
+			err := eh.setKey(context.Background(), keyTestService, &spec, "172.0.0.100", 8080, 0, nil)
 			So(err, ShouldNotBeNil)
 			So(err, ShouldEqual, mockErr)
 		})
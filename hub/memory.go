@@ -0,0 +1,290 @@
+package hub
+
+import (
+	"sort"
+	"sync"
+	"time"
+
+	"golang.org/x/net/context"
+)
+
+const (
+	// memHistorySize is the max number of events the in-memory registry
+	// keeps for watchers to catch up.
+	memHistorySize = 1000
+)
+
+type memEntry struct {
+	value    string
+	expireAt time.Time // Zero means never expire.
+}
+
+// memRegistry implements interface Registry in memory. It's meant for
+// tests and single node deployments without etcd.
+type memRegistry struct {
+	lock sync.Mutex
+
+	index   uint64
+	entries map[string]*memEntry
+	history []*Event
+
+	// changeCh is closed and replaced whenever a new event is recorded.
+	changeCh chan struct{}
+
+	now func() time.Time
+}
+
+func (mr *memRegistry) List(ctx context.Context, key string) ([]*KeyValue, uint64, error) {
+	mr.lock.Lock()
+	defer mr.lock.Unlock()
+
+	mr.expireLocked()
+
+	kvs := []*KeyValue{}
+	for k, e := range mr.entries {
+		if keyUnder(k, key) {
+			kvs = append(kvs, &KeyValue{
+				Key:   k,
+				Value: e.value,
+			})
+		}
+	}
+	if len(kvs) == 0 {
+		return nil, mr.index, ErrKeyNotFound
+	}
+
+	sort.Slice(kvs, func(i, j int) bool {
+		return kvs[i].Key < kvs[j].Key
+	})
+	return kvs, mr.index, nil
+}
+
+func (mr *memRegistry) Put(ctx context.Context, key, value string, ttl time.Duration) error {
+	mr.lock.Lock()
+	defer mr.lock.Unlock()
+
+	mr.expireLocked()
+
+	e := memEntry{
+		value: value,
+	}
+	if ttl > 0 {
+		e.expireAt = mr.now().Add(ttl)
+	}
+
+	ev := Event{
+		Type:  EventPut,
+		Key:   key,
+		Value: value,
+	}
+	if prev, ok := mr.entries[key]; ok {
+		ev.PrevValue = prev.value
+	}
+	mr.entries[key] = &e
+	mr.recordLocked(&ev)
+	return nil
+}
+
+func (mr *memRegistry) Refresh(ctx context.Context, key string, ttl time.Duration) error {
+	mr.lock.Lock()
+	defer mr.lock.Unlock()
+
+	mr.expireLocked()
+
+	e, ok := mr.entries[key]
+	if !ok {
+		return ErrKeyNotFound
+	}
+	if ttl > 0 {
+		e.expireAt = mr.now().Add(ttl)
+	} else {
+		e.expireAt = time.Time{}
+	}
+	return nil
+}
+
+func (mr *memRegistry) Update(ctx context.Context, key, value string) error {
+	mr.lock.Lock()
+	defer mr.lock.Unlock()
+
+	mr.expireLocked()
+
+	e, ok := mr.entries[key]
+	if !ok {
+		return ErrKeyNotFound
+	}
+	ev := Event{
+		Type:      EventPut,
+		Key:       key,
+		Value:     value,
+		PrevValue: e.value,
+	}
+	e.value = value
+	mr.recordLocked(&ev)
+	return nil
+}
+
+func (mr *memRegistry) Delete(ctx context.Context, key string) error {
+	mr.lock.Lock()
+	defer mr.lock.Unlock()
+
+	mr.expireLocked()
+
+	found := false
+	for _, k := range mr.sortedKeysLocked() {
+		if keyUnder(k, key) {
+			mr.removeLocked(k, EventDelete)
+			found = true
+		}
+	}
+	if !found {
+		return ErrKeyNotFound
+	}
+	return nil
+}
+
+func (mr *memRegistry) Watch(key string, afterIndex uint64) Watcher {
+	mr.lock.Lock()
+	defer mr.lock.Unlock()
+
+	if afterIndex == 0 {
+		afterIndex = mr.index
+	}
+	return &memWatcher{
+		mr:    mr,
+		key:   key,
+		after: afterIndex,
+	}
+}
+
+// Expire removes all expired keys immediately and notifies watchers.
+// It's called implicitly by all other operations.
+func (mr *memRegistry) Expire() {
+	mr.lock.Lock()
+	defer mr.lock.Unlock()
+
+	mr.expireLocked()
+}
+
+func (mr *memRegistry) expireLocked() {
+	now := mr.now()
+	for _, k := range mr.sortedKeysLocked() {
+		e := mr.entries[k]
+		if !e.expireAt.IsZero() && !now.Before(e.expireAt) {
+			mr.removeLocked(k, EventExpire)
+		}
+	}
+}
+
+// nextExpireLocked returns the duration until the next key expires, or
+// zero if no key has a TTL.
+func (mr *memRegistry) nextExpireLocked() time.Duration {
+	var next time.Time
+	for _, e := range mr.entries {
+		if e.expireAt.IsZero() {
+			continue
+		}
+		if next.IsZero() || e.expireAt.Before(next) {
+			next = e.expireAt
+		}
+	}
+	if next.IsZero() {
+		return 0
+	}
+	if d := next.Sub(mr.now()); d > 0 {
+		return d
+	}
+	return time.Millisecond
+}
+
+func (mr *memRegistry) removeLocked(key string, typ EventType) {
+	e := mr.entries[key]
+	delete(mr.entries, key)
+	mr.recordLocked(&Event{
+		Type:      typ,
+		Key:       key,
+		PrevValue: e.value,
+	})
+}
+
+func (mr *memRegistry) recordLocked(ev *Event) {
+	mr.index++
+	ev.Index = mr.index
+	mr.history = append(mr.history, ev)
+	if len(mr.history) > memHistorySize {
+		mr.history = mr.history[len(mr.history)-memHistorySize:]
+	}
+	close(mr.changeCh)
+	mr.changeCh = make(chan struct{})
+}
+
+func (mr *memRegistry) sortedKeysLocked() []string {
+	keys := make([]string, 0, len(mr.entries))
+	for k := range mr.entries {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// memWatcher implements interface Watcher for memRegistry.
+type memWatcher struct {
+	mr    *memRegistry
+	key   string
+	after uint64
+}
+
+func (mw *memWatcher) Next(ctx context.Context) (*Event, error) {
+	for {
+		mw.mr.lock.Lock()
+		mw.mr.expireLocked()
+
+		if len(mw.mr.history) > 0 && mw.mr.history[0].Index > mw.after+1 {
+			mw.mr.lock.Unlock()
+			return nil, ErrWatchReset
+		}
+		for _, ev := range mw.mr.history {
+			if ev.Index <= mw.after {
+				continue
+			}
+			mw.after = ev.Index
+			if keyUnder(ev.Key, mw.key) {
+				mw.mr.lock.Unlock()
+				return ev, nil
+			}
+		}
+		changeCh := mw.mr.changeCh
+		wait := mw.mr.nextExpireLocked()
+		mw.mr.lock.Unlock()
+
+		var timer *time.Timer
+		var timeoutCh <-chan time.Time
+		if wait > 0 {
+			timer = time.NewTimer(wait)
+			timeoutCh = timer.C
+		}
+
+		select {
+		case <-ctx.Done():
+			err := ctx.Err()
+			if timer != nil {
+				timer.Stop()
+			}
+			return nil, err
+		case <-changeCh:
+		case <-timeoutCh:
+		}
+		if timer != nil {
+			timer.Stop()
+		}
+	}
+}
+
+// NewMemRegistry returns a Registry which keeps everything in memory.
+func NewMemRegistry() Registry {
+	return &memRegistry{
+		entries:  make(map[string]*memEntry),
+		changeCh: make(chan struct{}),
+		now:      time.Now,
+	}
+}
@@ -0,0 +1,178 @@
+package hub
+
+import (
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	. "github.com/smartystreets/goconvey/convey"
+	"golang.org/x/net/context"
+
+	pb "github.com/binchencoder/skylb-api/proto"
+)
+
+func TestMemRegistry(t *testing.T) {
+	Convey("Operate on an in-memory registry", t, func() {
+		ctx := context.Background()
+		reg := NewMemRegistry()
+		now := time.Now()
+		reg.(*memRegistry).now = func() time.Time {
+			return now
+		}
+
+		Convey("List an absent prefix", func() {
+			_, _, err := reg.List(ctx, keyService1)
+			So(err, ShouldEqual, ErrKeyNotFound)
+		})
+
+		Convey("Put then list keys", func() {
+			So(reg.Put(ctx, keyService1+"/172.0.10.2_8080", "b", 0), ShouldBeNil)
+			So(reg.Put(ctx, keyService1+"/172.0.10.1_8080", "a", 0), ShouldBeNil)
+			So(reg.Put(ctx, keyService1+"x/172.0.10.3_8080", "c", 0), ShouldBeNil)
+
+			kvs, index, err := reg.List(ctx, keyService1)
+			So(err, ShouldBeNil)
+			So(index, ShouldEqual, 3)
+			So(kvs, ShouldHaveLength, 2)
+			So(kvs[0].Key, ShouldEqual, keyService1+"/172.0.10.1_8080")
+			So(kvs[0].Value, ShouldEqual, "a")
+			So(kvs[1].Key, ShouldEqual, keyService1+"/172.0.10.2_8080")
+			So(kvs[1].Value, ShouldEqual, "b")
+
+			Convey("Delete the service recursively", func() {
+				So(reg.Delete(ctx, keyService1), ShouldBeNil)
+				_, _, err := reg.List(ctx, keyService1)
+				So(err, ShouldEqual, ErrKeyNotFound)
+				So(reg.Delete(ctx, keyService1), ShouldEqual, ErrKeyNotFound)
+			})
+		})
+
+		Convey("Keys expire unless refreshed", func() {
+			key := keyService1 + "/172.0.10.1_8080"
+			So(reg.Put(ctx, key, "a", 10*time.Second), ShouldBeNil)
+
+			now = now.Add(8 * time.Second)
+			So(reg.Refresh(ctx, key, 10*time.Second), ShouldBeNil)
+
+			now = now.Add(8 * time.Second)
+			kvs, _, err := reg.List(ctx, key)
+			So(err, ShouldBeNil)
+			So(kvs, ShouldHaveLength, 1)
+
+			now = now.Add(3 * time.Second)
+			_, _, err = reg.List(ctx, key)
+			So(err, ShouldEqual, ErrKeyNotFound)
+			So(reg.Refresh(ctx, key, 10*time.Second), ShouldEqual, ErrKeyNotFound)
+		})
+
+		Convey("Update keys keeping their TTL", func() {
+			key := keyService1 + "/172.0.10.1_8080"
+			So(reg.Update(ctx, key, "b"), ShouldEqual, ErrKeyNotFound)
+			So(reg.Put(ctx, key, "a", 10*time.Second), ShouldBeNil)
+
+			now = now.Add(8 * time.Second)
+			So(reg.Update(ctx, key, "b"), ShouldBeNil)
+			kvs, _, err := reg.List(ctx, key)
+			So(err, ShouldBeNil)
+			So(kvs[0].Value, ShouldEqual, "b")
+
+			now = now.Add(3 * time.Second)
+			_, _, err = reg.List(ctx, key)
+			So(err, ShouldEqual, ErrKeyNotFound)
+		})
+
+		Convey("Watch changes under a prefix", func() {
+			w := reg.Watch(keyService1, 0)
+			key := keyService1 + "/172.0.10.1_8080"
+			So(reg.Put(ctx, "/registry/services/endpoints/default/other/1.1.1.1_80", "x", 0), ShouldBeNil)
+			So(reg.Put(ctx, key, "a", time.Second), ShouldBeNil)
+
+			ev, err := w.Next(ctx)
+			So(err, ShouldBeNil)
+			So(ev.Type, ShouldEqual, EventPut)
+			So(ev.Key, ShouldEqual, key)
+			So(ev.Value, ShouldEqual, "a")
+
+			now = now.Add(time.Second)
+			ev, err = w.Next(ctx)
+			So(err, ShouldBeNil)
+			So(ev.Type, ShouldEqual, EventExpire)
+			So(ev.Key, ShouldEqual, key)
+			So(ev.PrevValue, ShouldEqual, "a")
+
+			Convey("Resume a watch from an earlier index", func() {
+				w := reg.Watch(keyService1, 1)
+				ev, err := w.Next(ctx)
+				So(err, ShouldBeNil)
+				So(ev.Index, ShouldEqual, 2)
+				So(ev.Type, ShouldEqual, EventPut)
+			})
+		})
+
+		Convey("A watcher blocks until a change arrives", func() {
+			w := reg.Watch(keyService1, 0)
+			var wg sync.WaitGroup
+			wg.Add(1)
+			var ev *Event
+			go func() {
+				defer wg.Done()
+				ev, _ = w.Next(ctx)
+			}()
+			time.Sleep(10 * time.Millisecond)
+			So(reg.Put(ctx, keyService1+"/172.0.10.1_8080", "a", 0), ShouldBeNil)
+			wg.Wait()
+			So(ev, ShouldNotBeNil)
+			So(ev.Key, ShouldEqual, keyService1+"/172.0.10.1_8080")
+		})
+	})
+}
+
+func TestHubWithMemRegistry(t *testing.T) {
+	spec := &pb.ServiceSpec{
+		Namespace:   namespace,
+		ServiceName: serviceName,
+		PortName:    portName,
+	}
+
+	Convey("Run the endpoints hub against the in-memory registry", t, func() {
+		reg := NewMemRegistry()
+		eh := endpointsHub{
+			registry:      reg,
+			services:      serviceMap{},
+			graphKeys:     make(map[string]struct{}),
+			graphKeysLock: &sync.RWMutex{},
+		}
+
+		Convey("Register endpoints and fetch them", func() {
+			So(eh.InsertEndpoint(spec, "172.0.10.1", port, 0, nil), ShouldBeNil)
+			So(eh.UpsertEndpoint(spec, "172.0.10.2", port, 10, nil), ShouldBeNil)
+			So(eh.UpsertEndpoint(spec, "172.0.10.1", port, 0, nil), ShouldBeNil)
+
+			eps, err := eh.fetchEndpoints(namespace, serviceName)
+			So(err, ShouldBeNil)
+			epsMap := skypbEndpointsToMap(spec, eps)
+			So(epsMap, ShouldHaveLength, 2)
+			So(epsMap["172.0.10.2:8080"].Weight, ShouldEqual, 10)
+		})
+
+		Convey("Fetch an absent service", func() {
+			eps, err := eh.fetchEndpoints(namespace, "absent")
+			So(err, ShouldBeNil)
+			So(eps.Subsets, ShouldHaveLength, 0)
+		})
+
+		Convey("Track service graph", func() {
+			req := &pb.ResolveRequest{
+				CallerServiceId:   1,
+				CallerServiceName: "caller1",
+			}
+			addr, _ := net.ResolveIPAddr("ip4", "1.2.3.4")
+			eh.TrackServiceGraph(req, spec, addr)
+
+			kvs, _, err := reg.List(context.Background(), "/skylb/graph/default/service1/clients/caller1")
+			So(err, ShouldBeNil)
+			So(kvs, ShouldHaveLength, 1)
+		})
+	})
+}
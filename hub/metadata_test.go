@@ -0,0 +1,70 @@
+package hub
+
+import (
+	"testing"
+
+	. "github.com/smartystreets/goconvey/convey"
+
+	pb "github.com/binchencoder/skylb-api/proto"
+)
+
+func TestEndpointMetadata(t *testing.T) {
+	spec := &pb.ServiceSpec{
+		Namespace:   namespace,
+		ServiceName: serviceName,
+		PortName:    portName,
+	}
+	md := map[string]string{
+		"version": "1.2.0",
+		"zone":    "zone-a",
+	}
+
+	Convey("Carry endpoint metadata from registration to observers", t, func() {
+		eh := endpointsHub{
+			registry: NewMemRegistry(),
+			services: serviceMap{},
+		}
+		So(eh.InsertEndpoint(spec, "192.168.1.1", port, 0, md), ShouldBeNil)
+		So(eh.InsertEndpoint(spec, "192.168.1.2", port, 0, nil), ShouldBeNil)
+
+		eps, err := eh.fetchEndpoints(namespace, serviceName)
+		So(err, ShouldBeNil)
+		epsMap := skypbAllEndpointsToMap(spec, eps)
+		So(epsMap["192.168.1.1:8080"].Metadata, ShouldResemble, md)
+		So(epsMap["192.168.1.2:8080"].Metadata, ShouldBeNil)
+
+		Convey("Changing the weight should keep the metadata", func() {
+			So(eh.UpdateEndpointWeight(spec, "192.168.1.1", port, 5), ShouldBeNil)
+			eps, err := eh.fetchEndpoints(namespace, serviceName)
+			So(err, ShouldBeNil)
+			So(skypbAllEndpointsToMap(spec, eps)["192.168.1.1:8080"].Metadata, ShouldResemble, md)
+		})
+
+		Convey("Observers should receive the endpoints", func() {
+			so := newServiceObject(spec, nil)
+			ch := make(chan *EndpointsUpdate, 10)
+			so.addObserver(newClientObject(spec, "192.168.0.1:8000", newObserverQueue(ch), ObserverOptions{}, nil))
+			<-ch
+
+			eh.applyEndpoints(so, eps)
+			up := <-ch
+			So(up.Endpoints.InstEndpoints, ShouldHaveLength, 2)
+
+			Convey("A metadata change alone should not be sent", func() {
+				So(eh.InsertEndpoint(spec, "192.168.1.2", port, 0, map[string]string{"canary": "true"}), ShouldBeNil)
+				eps, err := eh.fetchEndpoints(namespace, serviceName)
+				So(err, ShouldBeNil)
+				eh.applyEndpoints(so, eps)
+				So(eh.InsertEndpoint(spec, "192.168.1.3", port, 0, nil), ShouldBeNil)
+				eps, err = eh.fetchEndpoints(namespace, serviceName)
+				So(err, ShouldBeNil)
+				eh.applyEndpoints(so, eps)
+
+				up := <-ch
+				So(up.Endpoints.InstEndpoints, ShouldHaveLength, 1)
+				So(up.Endpoints.InstEndpoints[0].Op, ShouldEqual, pb.Operation_Add)
+				So(up.Endpoints.InstEndpoints[0].Host, ShouldEqual, "192.168.1.3")
+			})
+		})
+	})
+}
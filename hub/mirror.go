@@ -0,0 +1,301 @@
+package hub
+
+import (
+	"flag"
+	"path"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/golang/glog"
+	prom "github.com/prometheus/client_golang/prometheus"
+	"golang.org/x/net/context"
+
+	"github.com/binchencoder/skylb-api/prefix"
+)
+
+var (
+	mirrorCheckInterval = flag.Duration("mirror-check-interval", 5*time.Minute, "The interval to check the in-memory endpoints mirror against etcd. Zero disables the check")
+
+	// mirrorRecheckDelay is how long to wait for in-flight watch events
+	// before checking a service which differs from etcd again.
+	mirrorRecheckDelay = 2 * time.Second
+
+	mirrorInconsistencyCounts = prom.NewCounterVec(
+		prom.CounterOpts{
+			Namespace: "infra",
+			Subsystem: "skylb",
+			Name:      "mirror_inconsistency_counts",
+			Help:      "SkyLB endpoints mirror inconsistency counts, by service.",
+		},
+		[]string{"service"},
+	)
+)
+
+func init() {
+	prom.MustRegister(mirrorInconsistencyCounts)
+}
+
+// endpointsMirror keeps an in-memory copy of the endpoints tree under
+// prefix.EndpointsKey. It's loaded once with a recursive read and then
+// patched with watch events, so that the endpoints of a service are read
+// from memory rather than from etcd.
+//
+// The zero value is an empty mirror which is not loaded yet.
+type endpointsMirror struct {
+	lock sync.RWMutex
+
+	loaded bool
+	// The values of the endpoint keys, by service key.
+	services map[string]map[string]string
+	// The registry revision at which each service was last changed,
+	// including the deleted ones.
+	modified map[string]uint64
+}
+
+// mirrorServiceKey returns the service key of the given endpoint key, or
+// false if it's not an endpoint key, i.e.
+// "<prefix.EndpointsKey>/<namespace>/<service>/<endpoint>".
+func mirrorServiceKey(key string) (string, bool) {
+	if !keyUnder(key, prefix.EndpointsKey) {
+		return "", false
+	}
+	parts := strings.Split(strings.TrimPrefix(key, prefix.EndpointsKey+"/"), "/")
+	if len(parts) != 3 {
+		return "", false
+	}
+	return path.Dir(key), true
+}
+
+// groupByService groups the endpoint key/values by service key.
+func groupByService(kvs []*KeyValue) map[string]map[string]string {
+	services := map[string]map[string]string{}
+	for _, kv := range kvs {
+		svc, ok := mirrorServiceKey(kv.Key)
+		if !ok || kv.Value == "" {
+			continue
+		}
+		if services[svc] == nil {
+			services[svc] = map[string]string{}
+		}
+		services[svc][kv.Key] = kv.Value
+	}
+	return services
+}
+
+// load replaces the mirror with the given key/values read at the given
+// registry revision, and returns the keys of the services which differ from
+// the ones loaded before, if any.
+func (em *endpointsMirror) load(kvs []*KeyValue, index uint64) []string {
+	services := groupByService(kvs)
+
+	em.lock.Lock()
+	defer em.lock.Unlock()
+
+	changed := []string{}
+	if em.loaded {
+		for svc, eps := range em.services {
+			if !reflect.DeepEqual(eps, services[svc]) {
+				changed = append(changed, svc)
+			}
+		}
+		for svc := range services {
+			if _, ok := em.services[svc]; !ok {
+				changed = append(changed, svc)
+			}
+		}
+		sort.Strings(changed)
+	}
+
+	em.services = services
+	em.modified = make(map[string]uint64, len(services))
+	for svc := range services {
+		em.modified[svc] = index
+	}
+	for _, svc := range changed {
+		em.modified[svc] = index
+	}
+	em.loaded = true
+	return changed
+}
+
+// apply patches the mirror with the given watch event, and returns the
+// keys of the services changed.
+func (em *endpointsMirror) apply(ev *Event) []string {
+	em.lock.Lock()
+	defer em.lock.Unlock()
+
+	if em.services == nil {
+		em.services = map[string]map[string]string{}
+		em.modified = map[string]uint64{}
+	}
+
+	if svc, ok := mirrorServiceKey(ev.Key); ok {
+		em.modified[svc] = ev.Index
+		if ev.Type == EventPut && ev.Value != "" {
+			if em.services[svc] == nil {
+				em.services[svc] = map[string]string{}
+			}
+			em.services[svc][ev.Key] = ev.Value
+			return []string{svc}
+		}
+		delete(em.services[svc], ev.Key)
+		if len(em.services[svc]) == 0 {
+			delete(em.services, svc)
+		}
+		return []string{svc}
+	}
+
+	if ev.Type == EventPut {
+		return nil
+	}
+	// A directory was deleted along with all services under it.
+	changed := []string{}
+	for svc := range em.services {
+		if keyUnder(svc, ev.Key) {
+			delete(em.services, svc)
+			em.modified[svc] = ev.Index
+			changed = append(changed, svc)
+		}
+	}
+	sort.Strings(changed)
+	return changed
+}
+
+// list returns the key/values of the given service sorted by key, or false
+// if the mirror is not loaded yet.
+func (em *endpointsMirror) list(serviceKey string) ([]*KeyValue, bool) {
+	em.lock.RLock()
+	defer em.lock.RUnlock()
+
+	if !em.loaded {
+		return nil, false
+	}
+	kvs := make([]*KeyValue, 0, len(em.services[serviceKey]))
+	for k, v := range em.services[serviceKey] {
+		kvs = append(kvs, &KeyValue{
+			Key:   k,
+			Value: v,
+		})
+	}
+	sort.Slice(kvs, func(i, j int) bool {
+		return kvs[i].Key < kvs[j].Key
+	})
+	return kvs, true
+}
+
+// diff compares the mirror against the key/values read from etcd at the
+// given registry revision, and returns the keys of the services which
+// differ. Services changed in the mirror after the revision are skipped.
+func (em *endpointsMirror) diff(kvs []*KeyValue, index uint64) []string {
+	fresh := groupByService(kvs)
+
+	em.lock.RLock()
+	defer em.lock.RUnlock()
+
+	if !em.loaded {
+		return nil
+	}
+	differ := []string{}
+	check := func(svc string) {
+		if em.modified[svc] > index {
+			return
+		}
+		if !reflect.DeepEqual(em.services[svc], fresh[svc]) {
+			differ = append(differ, svc)
+		}
+	}
+	for svc := range em.services {
+		check(svc)
+	}
+	for svc := range fresh {
+		if _, ok := em.services[svc]; !ok {
+			check(svc)
+		}
+	}
+	sort.Strings(differ)
+	return differ
+}
+
+// repair replaces the given service in the mirror with the key/values read
+// from etcd at the given registry revision, if they differ. It returns true
+// if the service was replaced.
+func (em *endpointsMirror) repair(serviceKey string, kvs []*KeyValue, index uint64) bool {
+	fresh := groupByService(kvs)[serviceKey]
+
+	em.lock.Lock()
+	defer em.lock.Unlock()
+
+	if !em.loaded || em.modified[serviceKey] > index || reflect.DeepEqual(em.services[serviceKey], fresh) {
+		return false
+	}
+	if len(fresh) == 0 {
+		delete(em.services, serviceKey)
+	} else {
+		em.services[serviceKey] = fresh
+	}
+	em.modified[serviceKey] = index
+	return true
+}
+
+// loadMirror loads the endpoints mirror from etcd, and returns the registry
+// revision to watch the changes after. If the mirror was loaded before,
+// changes might have been missed, so the services changed are updated.
+func (eh *endpointsHub) loadMirror() (uint64, error) {
+	kvs, index, err := eh.registry.List(context.Background(), prefix.EndpointsKey)
+	if err != nil && err != ErrKeyNotFound {
+		return 0, err
+	}
+
+	changed := eh.mirror.load(kvs, index)
+	glog.Infof("Loaded endpoints mirror of %d key(s) at index %d, %d service(s) changed.", len(kvs), index, len(changed))
+	for _, key := range changed {
+		eh.triggerUpdate(key)
+	}
+	return index, nil
+}
+
+// startMirrorCheck periodically checks the endpoints mirror against etcd.
+func (eh *endpointsHub) startMirrorCheck() {
+	if *mirrorCheckInterval <= 0 {
+		return
+	}
+	for range time.Tick(*mirrorCheckInterval) {
+		eh.checkMirror()
+	}
+}
+
+// checkMirror compares the endpoints mirror against a fresh read from etcd.
+// Services which differ are read again after a while, since watch events
+// might be in flight, and repaired if they still differ.
+func (eh *endpointsHub) checkMirror() {
+	kvs, index, err := eh.registry.List(context.Background(), prefix.EndpointsKey)
+	if err != nil && err != ErrKeyNotFound {
+		glog.Errorf("Failed to read endpoints to check the mirror, %v", err)
+		return
+	}
+	suspects := eh.mirror.diff(kvs, index)
+	if len(suspects) == 0 {
+		glog.V(3).Infof("Endpoints mirror is consistent with etcd at index %d.", index)
+		return
+	}
+
+	time.Sleep(mirrorRecheckDelay)
+	for _, key := range suspects {
+		kvs, index, err := eh.registry.List(context.Background(), key)
+		if err != nil && err != ErrKeyNotFound {
+			glog.Errorf("Failed to read endpoints of %s to check the mirror, %v", key, err)
+			continue
+		}
+		if !eh.mirror.repair(key, kvs, index) {
+			continue
+		}
+
+		label := strings.Replace(strings.TrimPrefix(key, prefix.EndpointsKey+"/"), "/", ".", -1)
+		glog.Warningf("Endpoints mirror of service %s was inconsistent with etcd at index %d, repaired.", label, index)
+		mirrorInconsistencyCounts.WithLabelValues(label).Inc()
+		eh.triggerUpdate(key)
+	}
+}
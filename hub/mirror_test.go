@@ -0,0 +1,132 @@
+package hub
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+const (
+	keyService2 = "/registry/services/endpoints/default/service2"
+)
+
+func TestEndpointsMirror(t *testing.T) {
+	Convey("Keep an in-memory mirror of the endpoints", t, func() {
+		em := endpointsMirror{}
+
+		_, ok := em.list(keyService1)
+		So(ok, ShouldBeFalse)
+
+		changed := em.load([]*KeyValue{
+			{Key: keyService1 + "/172.0.10.2_8080", Value: "ep2"},
+			{Key: keyService1 + "/172.0.10.1_8080", Value: "ep1"},
+			{Key: keyService2 + "/172.0.10.3_8080", Value: "ep3"},
+		}, 10)
+		So(changed, ShouldBeEmpty)
+
+		kvs, ok := em.list(keyService1)
+		So(ok, ShouldBeTrue)
+		So(kvs, ShouldHaveLength, 2)
+		So(kvs[0].Key, ShouldEqual, keyService1+"/172.0.10.1_8080")
+		So(kvs[1].Key, ShouldEqual, keyService1+"/172.0.10.2_8080")
+
+		Convey("Watch events should patch the mirror", func() {
+			changed := em.apply(&Event{Type: EventPut, Key: keyService1 + "/172.0.10.4_8080", Value: "ep4", Index: 11})
+			So(changed, ShouldResemble, []string{keyService1})
+			kvs, _ := em.list(keyService1)
+			So(kvs, ShouldHaveLength, 3)
+
+			changed = em.apply(&Event{Type: EventExpire, Key: keyService1 + "/172.0.10.1_8080", Index: 12})
+			So(changed, ShouldResemble, []string{keyService1})
+			changed = em.apply(&Event{Type: EventDelete, Key: keyService2 + "/172.0.10.3_8080", Index: 13})
+			So(changed, ShouldResemble, []string{keyService2})
+			kvs, _ = em.list(keyService1)
+			So(kvs, ShouldHaveLength, 2)
+			kvs, _ = em.list(keyService2)
+			So(kvs, ShouldBeEmpty)
+		})
+
+		Convey("Reloading should return the services changed in between", func() {
+			changed := em.load([]*KeyValue{
+				{Key: keyService1 + "/172.0.10.1_8080", Value: "ep1"},
+				{Key: keyService1 + "/172.0.10.2_8080", Value: "ep2"},
+				{Key: keyService2 + "/172.0.10.4_8080", Value: "ep4"},
+			}, 20)
+			So(changed, ShouldResemble, []string{keyService2})
+			kvs, _ := em.list(keyService2)
+			So(kvs, ShouldHaveLength, 1)
+			So(kvs[0].Value, ShouldEqual, "ep4")
+		})
+
+		Convey("Deleting a directory should delete all services under it", func() {
+			changed := em.apply(&Event{Type: EventDelete, Key: "/registry/services/endpoints/default", Index: 11})
+			So(changed, ShouldResemble, []string{keyService1, keyService2})
+			kvs, _ := em.list(keyService1)
+			So(kvs, ShouldBeEmpty)
+		})
+
+		Convey("Services which differ from etcd should be found and repaired", func() {
+			fresh := []*KeyValue{
+				{Key: keyService1 + "/172.0.10.1_8080", Value: "ep1"},
+				{Key: keyService1 + "/172.0.10.2_8080", Value: "ep2"},
+				{Key: keyService2 + "/172.0.10.5_8080", Value: "ep5"},
+			}
+			So(em.diff(fresh, 10), ShouldResemble, []string{keyService2})
+
+			So(em.repair(keyService2, fresh, 10), ShouldBeTrue)
+			So(em.diff(fresh, 10), ShouldBeEmpty)
+			kvs, _ := em.list(keyService2)
+			So(kvs, ShouldHaveLength, 1)
+			So(kvs[0].Value, ShouldEqual, "ep5")
+		})
+
+		Convey("Services changed after the read should not be checked", func() {
+			em.apply(&Event{Type: EventPut, Key: keyService2 + "/172.0.10.5_8080", Value: "ep5", Index: 12})
+			stale := []*KeyValue{
+				{Key: keyService1 + "/172.0.10.1_8080", Value: "ep1"},
+				{Key: keyService1 + "/172.0.10.2_8080", Value: "ep2"},
+				{Key: keyService2 + "/172.0.10.3_8080", Value: "ep3"},
+			}
+			So(em.diff(stale, 11), ShouldBeEmpty)
+			So(em.repair(keyService2, stale, 11), ShouldBeFalse)
+		})
+	})
+}
+
+func TestCheckMirror(t *testing.T) {
+	Convey("Check the endpoints mirror against etcd", t, func() {
+		oldDelay := mirrorRecheckDelay
+		mirrorRecheckDelay = 0
+		Reset(func() {
+			mirrorRecheckDelay = oldDelay
+		})
+
+		ctx := context.Background()
+		eh := endpointsHub{
+			registry: NewMemRegistry(),
+			services: serviceMap{},
+		}
+		So(eh.registry.Put(ctx, keyService1+"/172.0.10.1_8080", "ep1", 0), ShouldBeNil)
+		_, err := eh.loadMirror()
+		So(err, ShouldBeNil)
+
+		Convey("A missed change should be repaired", func() {
+			So(eh.registry.Put(ctx, keyService1+"/172.0.10.2_8080", "ep2", time.Minute), ShouldBeNil)
+			kvs, _ := eh.mirror.list(keyService1)
+			So(kvs, ShouldHaveLength, 1)
+
+			eh.checkMirror()
+			kvs, _ = eh.mirror.list(keyService1)
+			So(kvs, ShouldHaveLength, 2)
+		})
+
+		Convey("A consistent mirror should be kept", func() {
+			eh.checkMirror()
+			kvs, _ := eh.mirror.list(keyService1)
+			So(kvs, ShouldHaveLength, 1)
+			So(kvs[0].Value, ShouldEqual, "ep1")
+		})
+	})
+}
@@ -49,10 +49,27 @@ func (so *ServiceObjectMock) AddObserver(co ClientObserver) {
 	so.Called(co)
 }
 
-func (so *ServiceObjectMock) RemoveObservers(clientAddr string) {
-	so.Called(clientAddr)
+func (so *ServiceObjectMock) RemoveObservers(clientAddr string) int {
+	args := so.Called(clientAddr)
+	return args.Int(0)
+}
+
+func (so *ServiceObjectMock) Observers() []ClientObserver {
+	args := so.Called()
+	if res, ok := args.Get(0).([]ClientObserver); ok {
+		return res
+	}
+	return nil
 }
 
 func (so *ServiceObjectMock) SetEndpoints(endpoints *pb.ServiceEndpoints) {
 	so.Called(endpoints)
 }
+
+func (so *ServiceObjectMock) Endpoints() *pb.ServiceEndpoints {
+	args := so.Called()
+	if res, ok := args.Get(0).(*pb.ServiceEndpoints); ok {
+		return res
+	}
+	return nil
+}
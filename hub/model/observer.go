@@ -21,6 +21,8 @@ type ClientObserver interface {
 	Spec() *pb.ServiceSpec
 
 	// Notify notifies the client observer of the given service endpoints.
+	// It's called synchronously on every change, so it should hand the
+	// endpoints over rather than wait for the client.
 	Notify(eps *pb.ServiceEndpoints)
 
 	// Close closes the client observer.
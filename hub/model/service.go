@@ -21,15 +21,23 @@ type ServiceObject interface {
 	// Spec returns the spec of the service.
 	Spec() *pb.ServiceSpec
 
-	// AddObserver adds a service client observer to the service object.
+	// AddObserver adds a service client observer to the service object, and
+	// notifies it of the current endpoints.
 	AddObserver(co ClientObserver)
 
 	// RemoveObservers removes all client observers with the specified clientAddr
-	// from the service object.
-	RemoveObservers(clientAddr string)
+	// from the service object, and returns the number of remaining observers.
+	// The owner of the service object frees it when none remains.
+	RemoveObservers(clientAddr string) int
+
+	// Observers returns the client observers of the service object.
+	Observers() []ClientObserver
 
 	// SetEndpoints sets the service enpoints.
 	SetEndpoints(endpoints *pb.ServiceEndpoints)
+
+	// Endpoints returns the current service endpoints.
+	Endpoints() *pb.ServiceEndpoints
 }
 
 // serviceObject implements interface ServiceObject.
@@ -52,36 +60,37 @@ func (so *serviceObject) Spec() *pb.ServiceSpec {
 
 func (so *serviceObject) AddObserver(co ClientObserver) {
 	so.lock.Lock()
-	defer so.lock.Unlock()
 
 	glog.V(4).Infof("Adding observer %s for service %s.%s.\n", co.ClientAddr(), so.spec.GetNamespace(), so.spec.GetServiceName())
 
-	if len(so.observers) == 0 {
+	if len(so.observers) == 0 && so.listener != nil {
 		// Start the auto rectify goroutine.
 		so.stopCh = make(chan struct{})
-		go so.startAutoRectify()
+		go so.startAutoRectify(so.stopCh)
 	}
 
 	so.observers = append(so.observers, co)
+	endpoints := so.endpoints
+	so.lock.Unlock()
 
-	if so.endpoints != nil && len(so.endpoints.InstEndpoints) > 0 {
-		// Notify client observer so that it will not block
-		// the current goroutine.
-		go co.Notify(so.endpoints)
-	}
+	// Notify client observer of the initial endpoints, even if empty, so
+	// that it knows the service has been resolved.
+	co.Notify(endpoints)
 }
 
-func (so *serviceObject) RemoveObservers(clientAddr string) {
+func (so *serviceObject) RemoveObservers(clientAddr string) int {
 	so.lock.Lock()
 	defer so.lock.Unlock()
 
 	if len(so.observers) == 0 {
-		return
+		return 0
 	}
 
 	remaining := make([]ClientObserver, 0, len(so.observers))
 	for _, observer := range so.observers {
-		if observer.ClientAddr() == clientAddr && observer.Spec().String() == so.spec.String() {
+		// Observers of the same service may resolve different port names.
+		spec := observer.Spec()
+		if observer.ClientAddr() == clientAddr && spec.GetNamespace() == so.spec.GetNamespace() && spec.GetServiceName() == so.spec.GetServiceName() {
 			observer.Close()
 		} else {
 			remaining = append(remaining, observer)
@@ -94,35 +103,52 @@ func (so *serviceObject) RemoveObservers(clientAddr string) {
 		close(so.stopCh)
 		so.stopCh = nil
 	}
+	return len(so.observers)
 }
 
-func (so *serviceObject) SetEndpoints(endpoints *pb.ServiceEndpoints) {
+func (so *serviceObject) Observers() []ClientObserver {
 	so.lock.Lock()
 	defer so.lock.Unlock()
 
+	observers := make([]ClientObserver, len(so.observers))
+	copy(observers, so.observers)
+	return observers
+}
+
+func (so *serviceObject) SetEndpoints(endpoints *pb.ServiceEndpoints) {
+	so.lock.Lock()
 	glog.V(4).Infof("Setting endpoints %s for service %s.%s.\n", endpoints, so.spec.GetNamespace(), so.spec.GetServiceName())
 
 	so.endpoints = endpoints
-	for _, co := range so.observers {
-		go co.Notify(endpoints)
+	observers := make([]ClientObserver, len(so.observers))
+	copy(observers, so.observers)
+	so.lock.Unlock()
+
+	for _, co := range observers {
+		co.Notify(endpoints)
 	}
 }
 
+func (so *serviceObject) Endpoints() *pb.ServiceEndpoints {
+	so.lock.Lock()
+	defer so.lock.Unlock()
+
+	return so.endpoints
+}
+
 // startAutoRectify periodically updates the endpoints so that client gets a
 // chance to rectify its endpoint list.
-func (so *serviceObject) startAutoRectify() {
+func (so *serviceObject) startAutoRectify(stopCh <-chan struct{}) {
 	ticker := time.NewTicker(*autoRectifyInterval)
 	for {
 		select {
-		case <-so.stopCh:
+		case <-stopCh:
 			// Exit to avoid goroutine leak.
 			ticker.Stop()
 			return
 		case <-ticker.C:
 			glog.V(3).Infof("Automatic endpoints rectification for %s.", so.key)
-			if so.listener != nil {
-				so.listener(so.key)
-			}
+			so.listener(so.key)
 		}
 	}
 }
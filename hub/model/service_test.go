@@ -2,6 +2,7 @@ package model
 
 import (
 	"testing"
+	"time"
 
 	. "github.com/smartystreets/goconvey/convey"
 
@@ -131,8 +132,53 @@ func TestServiceObject(t *testing.T) {
 		So(realSo.observers, ShouldHaveLength, 5)
 
 		Convey("Remove observers with the same ids, the service object should hold zero observer", func() {
-			so.RemoveObservers("192.168.0.1:33254")
+			So(so.RemoveObservers("192.168.0.1:33254"), ShouldEqual, 0)
 			So(realSo.observers, ShouldHaveLength, 0)
 		})
 	})
 }
+
+func TestAutoRectify(t *testing.T) {
+	Convey("Auto rectify a service object while it has observers", t, func() {
+		oldInterval := *autoRectifyInterval
+		*autoRectifyInterval = 10 * time.Millisecond
+		Reset(func() {
+			*autoRectifyInterval = oldInterval
+		})
+
+		spec := pb.ServiceSpec{
+			Namespace:   "default",
+			ServiceName: "test-service",
+			PortName:    "grpc",
+		}
+		rectified := make(chan string, 100)
+		so := NewServiceObject(&spec, func(key string) {
+			rectified <- key
+		})
+
+		co := ClientObserverMock{}
+		co.On("ClientAddr").Return("192.168.0.1:33254")
+		co.On("Close")
+		co.On("Notify", so.Endpoints())
+		co.On("Spec").Return(&spec)
+		so.AddObserver(&co)
+
+		select {
+		case key := <-rectified:
+			So(key, ShouldEqual, "/registry/services/endpoints/default/test-service")
+		case <-time.After(time.Second):
+			So("timeout", ShouldBeEmpty)
+		}
+
+		Convey("After removing the last observer, auto rectification should stop", func() {
+			So(so.RemoveObservers("192.168.0.1:33254"), ShouldEqual, 0)
+			// Drain the one which might be in flight.
+			time.Sleep(50 * time.Millisecond)
+			for len(rectified) > 0 {
+				<-rectified
+			}
+			time.Sleep(50 * time.Millisecond)
+			So(rectified, ShouldHaveLength, 0)
+		})
+	})
+}
@@ -1,10 +1,7 @@
 package hub
 
 import (
-	"flag"
 	"fmt"
-	"sync/atomic"
-	"time"
 
 	"github.com/golang/glog"
 	prom "github.com/prometheus/client_golang/prometheus"
@@ -19,8 +16,6 @@ const (
 )
 
 var (
-	autoRectifyInterval = flag.Duration("auto-rectify-interval", 60*time.Second, "The interval of auto rectification.")
-
 	addObserverGauge = prom.NewGaugeVec(
 		prom.GaugeOpts{
 			Namespace: "infra",
@@ -49,74 +44,61 @@ func init() {
 // AddObserver adds an observer of the given service specs for the given
 // clientAddr. When service endpoints changed, it notifies the observer
 // through the returned channel.
-func (eh *endpointsHub) AddObserver(specs []*pb.ServiceSpec, clientAddr string, resolveFull bool) (<-chan *EndpointsUpdate, error) {
+func (eh *endpointsHub) AddObserver(specs []*pb.ServiceSpec, clientAddr string, opts ObserverOptions) (<-chan *EndpointsUpdate, error) {
+	sels, err := parseSelectors(specs, opts)
+	if err != nil {
+		return nil, err
+	}
+
 	notifyCh := make(chan *EndpointsUpdate, ChanCapMultiplication*len(specs))
+	queue := newObserverQueue(notifyCh)
 
-	for _, spec := range specs {
-		glog.V(2).Infof("Resolve service %s.%s on port name %q from client %s", spec.Namespace, spec.ServiceName, spec.PortName, clientAddr)
+	for i, spec := range specs {
 		label := fmt.Sprintf("%s.%s", spec.Namespace, spec.ServiceName)
+		glog.V(2).Infof("Resolve service %s on port name %q from client %s, selector %q", label, spec.PortName, clientAddr, opts.Selectors[label])
 		addObserverGauge.WithLabelValues(label).Inc()
 
-		co := &clientObject{
-			spec:        spec,
-			clientAddr:  clientAddr,
-			notifyCh:    notifyCh,
-			stopCh:      make(chan struct{}),
-			resolveFull: resolveFull,
-		}
-
 		var eps *api.Endpoints
+		var sourceEps map[string]*api.Endpoints
 		var err error
-		if *withinK8s {
+		switch {
+		case withinHybrid():
+			if sourceEps, err = eh.fetchHybridEndpoints(spec.Namespace, spec.ServiceName); err == nil {
+				eps = mergeSourceEndpoints(spec, sourceEps)
+			}
+		case *withinK8s:
 			eps, err = eh.fetchK8sEndpoints(spec.Namespace, spec.ServiceName)
-		} else {
+		case withinConsul():
+			eps, err = eh.fetchConsulEndpoints(spec.Namespace, spec.ServiceName)
+		case withinFile():
+			eps, err = eh.fetchFileEndpoints(spec.Namespace, spec.ServiceName)
+		default:
 			eps, err = eh.fetchEndpoints(spec.Namespace, spec.ServiceName)
 		}
 		if err != nil {
+			// Release the observers added for the previous specs.
+			eh.RemoveObserver(specs[:i], clientAddr)
+			queue.stop()
 			return nil, err
 		}
+		glog.V(3).Infof("Received initial endpoints for client %s: %+v.", clientAddr, eps)
 
+		// The service object is looked up or created, and the observer is
+		// added to it, under the lock of the hub, so that it can't be freed
+		// by RemoveObserver in between.
 		key := eh.calculateKey(spec.Namespace, spec.ServiceName)
-		var so *serviceObject
-		err = eh.WithWLock(func() error {
-			glog.V(3).Infof("Received initial endpoints for client %s: %+v.", clientAddr, eps)
-
-			epsMap := skypbEndpointsToMap(spec, eps)
-			var ok bool
-			if so, ok = eh.services[key]; !ok {
-				so = &serviceObject{
-					spec:      spec,
-					endpoints: epsMap,
-				}
+		eh.WithWLock(func() error {
+			so, ok := eh.services[key]
+			if !ok {
+				so = eh.newServiceObject(key, spec)
+				so.sourceEps = sourceEps
+				so.WithWLock(func() error {
+					setEndpoints(so, so.healthyEndpoints(skypbAllEndpointsToMap(spec, eps)))
+					return nil
+				})
 				eh.services[key] = so
-
-				if !*withinK8s {
-					// Periodically update the endpoints so that client gets a
-					// chance to rectify its endpoint list.
-					go func() {
-						ticker := time.NewTicker(*autoRectifyInterval)
-						for range ticker.C {
-							glog.V(3).Infof("Automatic endpoints rectification for %s.", key)
-							eh.updateEndpoints(key)
-						}
-					}()
-				}
 			}
-
-			up := EndpointsUpdate{
-				Id:        atomic.AddInt64(&nextUpdateId, 1),
-				Endpoints: diffEndpoints(spec, nil, epsMap),
-			}
-			notifyCh <- &up
-			return nil
-		})
-		if err != nil {
-			close(notifyCh)
-			return nil, err
-		}
-
-		so.WithWLock(func() error {
-			so.observers = append(so.observers, co)
+			so.addObserver(newClientObject(spec, clientAddr, queue, opts, sels[i]))
 			return nil
 		})
 	}
@@ -124,41 +106,59 @@ func (eh *endpointsHub) AddObserver(specs []*pb.ServiceSpec, clientAddr string,
 	return notifyCh, nil
 }
 
+// newServiceObject creates the service object of the given key, and starts
+// the goroutines to keep its endpoints updated if the endpoints source
+// needs any, and to check their health if enabled.
+func (eh *endpointsHub) newServiceObject(key string, spec *pb.ServiceSpec) *serviceObject {
+	update := func() {
+		eh.updateEndpoints(key)
+	}
+
+	var so *serviceObject
+	switch {
+	case withinHybrid():
+		so = newServiceObject(spec, update)
+	case *withinK8s:
+		// The Kubernetes informer resyncs by itself.
+		so = newServiceObject(spec, nil)
+	case withinConsul():
+		// Consul blocking queries are per service.
+		so = newServiceObject(spec, nil)
+		go eh.startConsulWatcher(spec.Namespace, spec.ServiceName, so.stopCh)
+	case withinFile():
+		// The endpoints file watcher applies changes by itself.
+		so = newServiceObject(spec, nil)
+	default:
+		so = newServiceObject(spec, update)
+	}
+
+	if *healthCheck {
+		so.health = newHealthState()
+		go so.startHealthCheck()
+	}
+	return so
+}
+
 // RemoveObserver removes the observer for the given service specs for the
-// given clientAddr.
+// given clientAddr. A service object is freed when it has no observers
+// left.
 func (eh *endpointsHub) RemoveObserver(specs []*pb.ServiceSpec, clientAddr string) {
 	for _, spec := range specs {
 		label := fmt.Sprintf("%s.%s", spec.Namespace, spec.ServiceName)
 		removeObserverGauge.WithLabelValues(label).Inc()
 
 		key := eh.calculateKey(spec.Namespace, spec.ServiceName)
-
-		var so *serviceObject
-		var ok bool
-		eh.WithRLock(func() error {
-			so, ok = eh.services[key]
-			return nil
-		})
-		if !ok {
-			return
-		}
-
-		so.WithWLock(func() error {
-			so.observers = removeObserverFromSlice(so.observers, spec, clientAddr)
+		eh.WithWLock(func() error {
+			so, ok := eh.services[key]
+			if !ok {
+				return nil
+			}
+			if so.RemoveObservers(clientAddr) == 0 {
+				glog.V(3).Infof("Service %s has no observers left, free it.", label)
+				delete(eh.services, key)
+				so.close()
+			}
 			return nil
 		})
 	}
 }
-
-func removeObserverFromSlice(obs []*clientObject, spec *pb.ServiceSpec, clientAddr string) []*clientObject {
-	remaining := make([]*clientObject, 0, len(obs))
-	for _, ob := range obs {
-		if ob.clientAddr == clientAddr && ob.spec.String() == spec.String() {
-			// Stop all goroutines for this observer.
-			close(ob.stopCh)
-		} else {
-			remaining = append(remaining, ob)
-		}
-	}
-	return remaining
-}
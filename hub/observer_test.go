@@ -3,7 +3,9 @@ package hub
 import (
 	"context"
 	"fmt"
+	"runtime"
 	"testing"
+	"time"
 
 	etcdcli "github.com/coreos/etcd/client"
 	. "github.com/smartystreets/goconvey/convey"
@@ -63,18 +65,18 @@ func TestAddObserver(t *testing.T) {
 			etcdMock := new(etcd.KeysAPIMock)
 			etcdMock.On("Get", ctx, keyService1, &getOpts).Return(&resp, nil)
 			eh := endpointsHub{
-				etcdCli:  etcdMock,
+				registry: &etcdRegistry{cli: etcdMock},
 				services: serviceMap{},
 			}
 
-			ch, err := eh.AddObserver(specs, "192.168.0.1:8000", true /* resolveFull */)
+			ch, err := eh.AddObserver(specs, "192.168.0.1:8000", ObserverOptions{ResolveFull: true})
 			So(ch, ShouldNotBeNil)
 			So(err, ShouldBeNil)
-			So(eh.services, ShouldContainKey, keyService1)
-
-			so := eh.services[keyService1]
-			So(so, ShouldNotBeNil)
-			So(len(so.observers), ShouldEqual, 1)
+			// Don't format the service object in assertions, which races with
+			// the goroutine notifying the observer.
+			so, ok := eh.services[keyService1]
+			So(ok, ShouldBeTrue)
+			So(len(so.Observers()), ShouldEqual, 1)
 			So(len(so.endpoints), ShouldEqual, 3)
 			So(so.endpoints, ShouldContainKey, "172.0.10.1:8080")
 			So(so.endpoints["172.0.10.1:8080"].IP, ShouldEqual, "172.0.10.1")
@@ -85,121 +87,114 @@ func TestAddObserver(t *testing.T) {
 			So(so.endpoints, ShouldContainKey, "172.0.10.3:8080")
 			So(so.endpoints["172.0.10.3:8080"].IP, ShouldEqual, "172.0.10.3")
 			So(so.endpoints["172.0.10.3:8080"].Port, ShouldEqual, 8080)
-			fmt.Println(so)
 
-			co := so.observers[0]
-			So(co, ShouldNotBeNil)
-			So(co.clientAddr, ShouldEqual, "192.168.0.1:8000")
-		})
-	})
-}
+			co := so.Observers()[0]
+			So(co.ClientAddr(), ShouldEqual, "192.168.0.1:8000")
 
-func TestRemoveObserver(t *testing.T) {
-	spec := pb.ServiceSpec{
-		Namespace:   namespace,
-		ServiceName: serviceName,
-		PortName:    portName,
-	}
-
-	observers := []*clientObject{}
-	for _, cip := range []string{
-		"192.168.0.12:33486",
-		"192.168.0.10:30121",
-	} {
-		observers = append(observers, &clientObject{
-			spec:       &spec,
-			clientAddr: cip,
-			stopCh:     make(chan struct{}),
+			up := <-ch
+			So(up.Endpoints.InstEndpoints, ShouldHaveLength, 3)
 		})
-	}
-
-	so := serviceObject{
-		spec:      &spec,
-		endpoints: serviceEndpoints{},
-		observers: observers,
-	}
-
-	eh := endpointsHub{
-		services: serviceMap{},
-	}
-	key := eh.calculateKey(spec.Namespace, spec.ServiceName)
-	eh.services[key] = &so
-
-	Convey("Remove one observer from the endpoints hub (one still remaining)", t, func() {
-		eh.RemoveObserver([]*pb.ServiceSpec{&spec}, "192.168.0.12:33486")
-		So(eh.services, ShouldContainKey, key)
-		sobj := eh.services[key]
-		So(len(sobj.observers), ShouldEqual, 1)
 	})
 }
 
-func TestRemoveObserverFromSlice(t *testing.T) {
+func TestRemoveObserver(t *testing.T) {
 	spec := pb.ServiceSpec{
 		Namespace:   namespace,
 		ServiceName: serviceName,
 		PortName:    portName,
 	}
 
-	clientAddrs := []string{
-		"192.168.0.12:33486",
-		"192.168.0.10:30121",
-		"192.168.0.18:35469",
-		"192.168.1.33:30983",
-		"192.168.1.54:31128",
-	}
-
-	observers := []*clientObject{}
-	for _, cip := range clientAddrs {
-		observers = append(observers, &clientObject{
-			spec:       &spec,
-			clientAddr: cip,
-			stopCh:     make(chan struct{}),
+	Convey("Remove observers from the endpoints hub", t, func() {
+		eh := endpointsHub{
+			services: serviceMap{},
+		}
+		key := eh.calculateKey(spec.Namespace, spec.ServiceName)
+		so := newServiceObject(&spec, nil)
+		eh.services[key] = so
+
+		for _, cip := range []string{
+			"192.168.0.12:33486",
+			"192.168.0.10:30121",
+			"192.168.0.10:30121", // Dup observers of the same client.
+		} {
+			newTestObserver(so, cip, ObserverOptions{})
+		}
+
+		Convey("One removed, one still remaining", func() {
+			eh.RemoveObserver([]*pb.ServiceSpec{&spec}, "192.168.0.12:33486")
+			_, ok := eh.services[key]
+			So(ok, ShouldBeTrue)
+			So(len(eh.services[key].Observers()), ShouldEqual, 2)
+
+			Convey("All removed, the service object should be freed", func() {
+				eh.RemoveObserver([]*pb.ServiceSpec{&spec}, "192.168.0.10:30121")
+				So(eh.services, ShouldNotContainKey, key)
+				_, open := <-so.stopCh
+				So(open, ShouldBeFalse)
+			})
 		})
-	}
 
-	Convey("Remove observer from managed list", t, func() {
-		Convey("when the observer does not exist in list", func() {
-			obs := removeObserverFromSlice(observers, &spec, "192.168.0.12:10000")
-			So(len(obs), ShouldEqual, 5)
-		})
-		Convey("when the observer exists in list", func() {
-			obs := removeObserverFromSlice(observers, &spec, "192.168.1.33:30983")
-			So(len(obs), ShouldEqual, 4)
+		Convey("Absent observer should not be removed", func() {
+			eh.RemoveObserver([]*pb.ServiceSpec{&spec}, "192.168.0.12:10000")
+			So(len(eh.services[key].Observers()), ShouldEqual, 3)
 		})
 	})
 }
 
-func TestRemoveObserverFromSlice_withDupSpecs(t *testing.T) {
-	spec := pb.ServiceSpec{
-		Namespace:   namespace,
-		ServiceName: serviceName,
-		PortName:    portName,
-	}
-
-	clientAddrs := []string{
-		"192.168.0.12:33486",
-		"192.168.0.10:30121", // Be duplicated at the 5th element.
-		"192.168.0.18:35469",
-		"192.168.1.33:30983",
-		"192.168.0.10:30121", // Keep the dup at end of the slice.
-	}
+func TestObserverGoroutineLeak(t *testing.T) {
+	const (
+		numServices  = 20
+		numObservers = 5000
+	)
+
+	Convey("Add and remove thousands of observers", t, func() {
+		eh := endpointsHub{
+			registry: NewMemRegistry(),
+			services: serviceMap{},
+		}
+
+		specs := make([]*pb.ServiceSpec, numServices)
+		for i := range specs {
+			specs[i] = &pb.ServiceSpec{
+				Namespace:   namespace,
+				ServiceName: fmt.Sprintf("service%d", i),
+				PortName:    portName,
+			}
+			So(eh.InsertEndpoint(specs[i], "172.0.10.1", 8080, 0, nil), ShouldBeNil)
+		}
 
-	observers := []*clientObject{}
-	for _, cip := range clientAddrs {
-		observers = append(observers, &clientObject{
-			spec:       &spec,
-			clientAddr: cip,
-			stopCh:     make(chan struct{}),
-		})
-	}
+		before := runtime.NumGoroutine()
 
-	Convey("Remove observer from managed list", t, func() {
-		Convey("when removing the dup observer", func() {
-			obs := removeObserverFromSlice(observers, &spec, "192.168.0.10:30121")
-			So(len(obs), ShouldEqual, 3)
-			for _, ip := range observers {
-				So(ip, ShouldNotEqual, "192.168.0.10:30121")
-			}
-		})
+		chs := make([]<-chan *EndpointsUpdate, numObservers)
+		for i := range chs {
+			spec := specs[i%numServices]
+			ch, err := eh.AddObserver([]*pb.ServiceSpec{spec}, fmt.Sprintf("192.168.0.1:%d", 10000+i), ObserverOptions{})
+			So(err, ShouldBeNil)
+			chs[i] = ch
+		}
+		So(eh.services, ShouldHaveLength, numServices)
+
+		// Change the endpoints so that every observer gets notified.
+		for _, spec := range specs {
+			So(eh.InsertEndpoint(spec, "172.0.10.2", 8080, 0, nil), ShouldBeNil)
+			eh.updateEndpoints(eh.calculateKey(spec.Namespace, spec.ServiceName))
+		}
+		for _, ch := range chs[:numServices] {
+			So(<-ch, ShouldNotBeNil)
+			So(<-ch, ShouldNotBeNil)
+		}
+		So(runtime.NumGoroutine(), ShouldBeGreaterThan, before)
+
+		for i := range chs {
+			eh.RemoveObserver([]*pb.ServiceSpec{specs[i%numServices]}, fmt.Sprintf("192.168.0.1:%d", 10000+i))
+		}
+		So(eh.services, ShouldBeEmpty)
+
+		// Goroutines exit asynchronously once stopped.
+		deadline := time.Now().Add(5 * time.Second)
+		for runtime.NumGoroutine() > before && time.Now().Before(deadline) {
+			time.Sleep(10 * time.Millisecond)
+		}
+		So(runtime.NumGoroutine(), ShouldBeLessThanOrEqualTo, before)
 	})
 }
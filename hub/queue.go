@@ -0,0 +1,179 @@
+package hub
+
+import (
+	"flag"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/golang/glog"
+	prom "github.com/prometheus/client_golang/prometheus"
+)
+
+var (
+	slowObserverThreshold = flag.Duration("slow-observer-threshold", 5*time.Second, "The time a client may take to receive an endpoints update before it's reported as a slow observer")
+
+	coalescedNotifyCounts = prom.NewCounterVec(
+		prom.CounterOpts{
+			Namespace: "infra",
+			Subsystem: "skylb",
+			Name:      "coalesced_notify_counts",
+			Help:      "SkyLB observer notification counts coalesced into a pending one, by service.",
+		},
+		[]string{"service"},
+	)
+	slowObserverCounts = prom.NewCounterVec(
+		prom.CounterOpts{
+			Namespace: "infra",
+			Subsystem: "skylb",
+			Name:      "slow_observer_counts",
+			Help:      "SkyLB endpoints update counts which took the client longer than --slow-observer-threshold to receive, by service.",
+		},
+		[]string{"service"},
+	)
+)
+
+func init() {
+	prom.MustRegister(coalescedNotifyCounts)
+	prom.MustRegister(slowObserverCounts)
+}
+
+// observerQueue delivers the endpoints updates to the notify channel of one
+// client, i.e. one AddObserver call, from a single goroutine, so that the
+// updates of each service arrive in order.
+//
+// The hub never blocks on a slow client. A notified observer is queued
+// once, and its update is built from the latest endpoints when it's
+// delivered, so the notifications which arrive meanwhile are coalesced.
+type observerQueue struct {
+	notifyCh      chan<- *EndpointsUpdate
+	slowThreshold time.Duration
+
+	// Guards the fields below.
+	lock    sync.Mutex
+	pending []*clientObject // In the order they were notified.
+	queued  map[*clientObject]bool
+	refs    int // The number of observers not closed yet.
+
+	wakeCh   chan struct{}
+	stopCh   chan struct{}
+	stopOnce sync.Once
+}
+
+// newObserverQueue creates an observer queue and starts its delivery
+// goroutine, which exits once all observers of the queue are closed.
+func newObserverQueue(notifyCh chan<- *EndpointsUpdate) *observerQueue {
+	q := observerQueue{
+		notifyCh:      notifyCh,
+		slowThreshold: *slowObserverThreshold,
+		queued:        map[*clientObject]bool{},
+		wakeCh:        make(chan struct{}, 1),
+		stopCh:        make(chan struct{}),
+	}
+	go q.run()
+	return &q
+}
+
+// acquire records a new observer of the queue.
+func (q *observerQueue) acquire() {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+
+	q.refs++
+}
+
+// release records that an observer of the queue was closed, and stops the
+// queue when none is left.
+func (q *observerQueue) release() {
+	q.lock.Lock()
+	q.refs--
+	refs := q.refs
+	q.lock.Unlock()
+
+	if refs <= 0 {
+		q.stop()
+	}
+}
+
+// stop drops the pending updates and stops the delivery goroutine.
+func (q *observerQueue) stop() {
+	q.stopOnce.Do(func() {
+		close(q.stopCh)
+	})
+}
+
+// push queues an update of the given observer. It never blocks.
+func (q *observerQueue) push(co *clientObject) {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+
+	if q.queued[co] {
+		coalescedNotifyCounts.WithLabelValues(fmt.Sprintf("%s.%s", co.spec.Namespace, co.spec.ServiceName)).Inc()
+		return
+	}
+	q.queued[co] = true
+	q.pending = append(q.pending, co)
+
+	select {
+	case q.wakeCh <- struct{}{}:
+	default:
+	}
+}
+
+// pop returns the next observer to update, or nil if none is pending.
+func (q *observerQueue) pop() *clientObject {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+
+	if len(q.pending) == 0 {
+		return nil
+	}
+	co := q.pending[0]
+	q.pending[0] = nil
+	q.pending = q.pending[1:]
+	delete(q.queued, co)
+	return co
+}
+
+func (q *observerQueue) run() {
+	for {
+		select {
+		case <-q.stopCh:
+			return
+		case <-q.wakeCh:
+		}
+
+		for co := q.pop(); co != nil; co = q.pop() {
+			if !q.deliver(co) {
+				return
+			}
+		}
+	}
+}
+
+// deliver sends the next update of the given observer, if any. It returns
+// false if the queue was stopped meanwhile.
+func (q *observerQueue) deliver(co *clientObject) bool {
+	up, now := co.nextUpdate()
+	if up == nil {
+		return true
+	}
+
+	timer := time.NewTimer(q.slowThreshold)
+	defer timer.Stop()
+
+	start := time.Now()
+	for {
+		select {
+		case <-q.stopCh:
+			return false
+		case q.notifyCh <- up:
+			co.delivered(up, now)
+			return true
+		case <-timer.C:
+			label := fmt.Sprintf("%s.%s", co.spec.Namespace, co.spec.ServiceName)
+			glog.Warningf("Client %s is slow to receive endpoints updates of service %s, still waiting after %v.", co.clientAddr, label, time.Since(start))
+			slowObserverCounts.WithLabelValues(label).Inc()
+		}
+	}
+}
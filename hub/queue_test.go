@@ -0,0 +1,88 @@
+package hub
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	. "github.com/smartystreets/goconvey/convey"
+
+	pb "github.com/binchencoder/skylb-api/proto"
+)
+
+func TestObserverQueue(t *testing.T) {
+	spec := &pb.ServiceSpec{
+		Namespace:   namespace,
+		ServiceName: serviceName,
+		PortName:    portName,
+	}
+
+	Convey("Deliver endpoints updates through the observer queue", t, func() {
+		oldThreshold := *slowObserverThreshold
+		*slowObserverThreshold = 50 * time.Millisecond
+		Reset(func() {
+			*slowObserverThreshold = oldThreshold
+		})
+
+		eh := endpointsHub{
+			services: serviceMap{},
+		}
+		so := newServiceObject(spec, nil)
+
+		// An unbuffered channel which nobody reads yet, like a slow client.
+		ch := make(chan *EndpointsUpdate)
+		q := newObserverQueue(ch)
+		co := newClientObject(spec, "192.168.0.1:8000", q, ObserverOptions{}, nil)
+		so.addObserver(co)
+		Reset(func() {
+			so.RemoveObservers("192.168.0.1:8000")
+		})
+		// Let the initial update be built and wait for the client.
+		time.Sleep(50 * time.Millisecond)
+
+		Convey("Updates to a slow client should be coalesced and delivered in order", func() {
+			// Returns at once even though the client doesn't read.
+			for i := 1; i <= 5; i++ {
+				ips := make([]string, i)
+				for j := range ips {
+					ips[j] = fmt.Sprintf("192.168.1.%d", j+1)
+				}
+				eh.applyEndpoints(so, newTestEndpoints(ips...))
+			}
+			time.Sleep(100 * time.Millisecond)
+
+			// The initial update was built before the changes.
+			up := <-ch
+			So(up.Endpoints.InstEndpoints, ShouldBeEmpty)
+
+			// All changes since then are coalesced into one.
+			up = <-ch
+			So(up.Endpoints.InstEndpoints, ShouldHaveLength, 5)
+
+			select {
+			case up = <-ch:
+				So(up, ShouldBeNil)
+			case <-time.After(100 * time.Millisecond):
+			}
+		})
+
+		Convey("The delivery goroutine should stop once all observers are closed", func() {
+			so.RemoveObservers("192.168.0.1:8000")
+			_, open := <-q.stopCh
+			So(open, ShouldBeFalse)
+
+			// The initial update might still get through, as it was being
+			// sent when the queue stopped, but nothing after it.
+			eh.applyEndpoints(so, newTestEndpoints("192.168.1.1"))
+			timeout := time.After(100 * time.Millisecond)
+			for done := false; !done; {
+				select {
+				case up := <-ch:
+					So(up.Endpoints.InstEndpoints, ShouldBeEmpty)
+				case <-timeout:
+					done = true
+				}
+			}
+		})
+	})
+}
@@ -0,0 +1,134 @@
+package hub
+
+import (
+	"errors"
+	"flag"
+	"strings"
+	"time"
+
+	"github.com/golang/glog"
+	"golang.org/x/net/context"
+)
+
+const (
+	RegistryEtcd2  = "etcd2"
+	RegistryEtcd3  = "etcd3"
+	RegistryMemory = "memory"
+)
+
+var (
+	registryBackend = flag.String("registry-backend", RegistryEtcd2, "The registry backend, one of etcd2, etcd3 and memory")
+
+	// ErrKeyNotFound is returned by a Registry when the requested key or
+	// prefix does not exist.
+	ErrKeyNotFound = errors.New("registry key not found")
+
+	// ErrWatchReset is returned by a Watcher when the requested revision is
+	// no longer available and the watcher must be recreated.
+	ErrWatchReset = errors.New("registry watcher reset")
+)
+
+// EventType defines the type of a registry change event.
+type EventType int
+
+const (
+	// EventPut means the key was created or updated.
+	EventPut EventType = iota
+	// EventDelete means the key was deleted.
+	EventDelete
+	// EventExpire means the key expired because its TTL elapsed.
+	EventExpire
+)
+
+func (et EventType) String() string {
+	switch et {
+	case EventPut:
+		return "put"
+	case EventDelete:
+		return "delete"
+	case EventExpire:
+		return "expire"
+	}
+	return "unknown"
+}
+
+// KeyValue represents a key/value pair stored in the registry.
+type KeyValue struct {
+	Key   string
+	Value string
+}
+
+// Event represents a change of a key in the registry.
+type Event struct {
+	Type EventType
+	Key  string
+
+	// Value is the new value for EventPut, PrevValue is the value before
+	// the change if it's known.
+	Value     string
+	PrevValue string
+
+	// Index is the revision of the registry at which the change happened.
+	Index uint64
+}
+
+// Watcher watches the changes of keys under a prefix.
+type Watcher interface {
+	// Next blocks until the next change event arrives. It returns
+	// ErrWatchReset when the watcher can't continue from where it was.
+	Next(ctx context.Context) (*Event, error)
+}
+
+// Registry defines the storage backend of the endpoints hub.
+type Registry interface {
+	// List returns all key/values under the given prefix, and the registry
+	// revision at which they were read. It returns ErrKeyNotFound when there
+	// is nothing under the prefix.
+	List(ctx context.Context, prefix string) ([]*KeyValue, uint64, error)
+
+	// Put stores the value with the given key. The key never expires if
+	// ttl is zero.
+	Put(ctx context.Context, key, value string, ttl time.Duration) error
+
+	// Refresh resets the TTL of the given key without changing its value.
+	// It returns ErrKeyNotFound when the key does not exist.
+	Refresh(ctx context.Context, key string, ttl time.Duration) error
+
+	// Update replaces the value of the given key, keeping its TTL. It
+	// returns ErrKeyNotFound when the key does not exist.
+	Update(ctx context.Context, key, value string) error
+
+	// Delete deletes the given key and everything under it.
+	Delete(ctx context.Context, key string) error
+
+	// Watch returns a watcher for changes under the given prefix which
+	// happen after the given revision. Zero means watching from now on.
+	Watch(prefix string, afterIndex uint64) Watcher
+}
+
+// keyUnder returns true if key equals to dir or is under dir.
+func keyUnder(key, dir string) bool {
+	return key == dir || strings.HasPrefix(key, dir+"/")
+}
+
+// CreateRegistry returns the Registry selected by flag --registry-backend.
+// When flag --endpoints-file is set without --etcd-endpoints, it returns an
+// in-memory registry.
+func CreateRegistry() Registry {
+	if withinFile() && *EtcdEndpoints == "" {
+		// Run without etcd, e.g. on dev laptops.
+		glog.Infoln("No etcd endpoints specified, use the in-memory registry.")
+		return NewMemRegistry()
+	}
+
+	switch *registryBackend {
+	case RegistryEtcd2:
+		return NewEtcdRegistry(CreateEtcdClient(*EtcdEndpoints, true))
+	case RegistryEtcd3:
+		return NewEtcd3Registry(CreateEtcd3Client(*EtcdEndpoints))
+	case RegistryMemory:
+		return NewMemRegistry()
+	}
+	glog.Fatalf("Unknown registry backend %q.", *registryBackend)
+	return nil
+}
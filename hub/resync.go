@@ -0,0 +1,88 @@
+package hub
+
+import (
+	"sort"
+
+	prom "github.com/prometheus/client_golang/prometheus"
+)
+
+const (
+	resyncWatcherEndpoints = "endpoints"
+	resyncWatcherLameduck  = "lameduck"
+)
+
+var (
+	watcherResyncCounts = prom.NewCounterVec(
+		prom.CounterOpts{
+			Namespace: "infra",
+			Subsystem: "skylb",
+			Name:      "watcher_resync_counts",
+			Help:      "SkyLB full resync counts after a watcher was reset, by watcher.",
+		},
+		[]string{"watcher"},
+	)
+)
+
+func init() {
+	prom.MustRegister(watcherResyncCounts)
+}
+
+// keyValueSet tracks the key/values under a prefix which a watcher has seen,
+// so that the changes missed in a watch gap can be replayed after a resync.
+type keyValueSet map[string]string
+
+func newKeyValueSet(kvs []*KeyValue) keyValueSet {
+	set := make(keyValueSet, len(kvs))
+	for _, kv := range kvs {
+		set[kv.Key] = kv.Value
+	}
+	return set
+}
+
+// apply patches the set with the given watch event.
+func (set keyValueSet) apply(ev *Event) {
+	if ev.Type == EventPut {
+		set[ev.Key] = ev.Value
+		return
+	}
+	for key := range set {
+		if keyUnder(key, ev.Key) {
+			delete(set, key)
+		}
+	}
+}
+
+// resync replaces the set with the given key/values read at the given
+// registry revision, and returns the events which turn the old set into the
+// new one, sorted by key.
+func (set keyValueSet) resync(kvs []*KeyValue, index uint64) []*Event {
+	fresh := newKeyValueSet(kvs)
+	events := []*Event{}
+	for key, value := range set {
+		if _, ok := fresh[key]; !ok {
+			events = append(events, &Event{
+				Type:      EventDelete,
+				Key:       key,
+				PrevValue: value,
+				Index:     index,
+			})
+			delete(set, key)
+		}
+	}
+	for key, value := range fresh {
+		if prev, ok := set[key]; !ok || prev != value {
+			events = append(events, &Event{
+				Type:      EventPut,
+				Key:       key,
+				Value:     value,
+				PrevValue: prev,
+				Index:     index,
+			})
+			set[key] = value
+		}
+	}
+	sort.Slice(events, func(i, j int) bool {
+		return events[i].Key < events[j].Key
+	})
+	return events
+}
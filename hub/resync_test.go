@@ -0,0 +1,45 @@
+package hub
+
+import (
+	"testing"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestKeyValueSetResync(t *testing.T) {
+	Convey("Replay the changes missed in a watch gap", t, func() {
+		set := newKeyValueSet([]*KeyValue{
+			{Key: "/lameduck/default/service1/172.0.10.1:8080", Value: "1"},
+			{Key: "/lameduck/default/service1/172.0.10.2:8080", Value: "1"},
+		})
+
+		Convey("Watch events should patch the set", func() {
+			set.apply(&Event{Type: EventPut, Key: "/lameduck/default/service2/172.0.10.3:8080", Value: "1"})
+			So(set, ShouldHaveLength, 3)
+			set.apply(&Event{Type: EventDelete, Key: "/lameduck/default/service1"})
+			So(set, ShouldHaveLength, 1)
+		})
+
+		Convey("Resync should return the changes in the gap", func() {
+			events := set.resync([]*KeyValue{
+				{Key: "/lameduck/default/service1/172.0.10.2:8080", Value: "2"},
+				{Key: "/lameduck/default/service1/172.0.10.3:8080", Value: "1"},
+			}, 100)
+			So(events, ShouldHaveLength, 3)
+			So(events[0].Type, ShouldEqual, EventDelete)
+			So(events[0].Key, ShouldEqual, "/lameduck/default/service1/172.0.10.1:8080")
+			So(events[1].Type, ShouldEqual, EventPut)
+			So(events[1].Value, ShouldEqual, "2")
+			So(events[1].PrevValue, ShouldEqual, "1")
+			So(events[2].Type, ShouldEqual, EventPut)
+			So(events[2].Key, ShouldEqual, "/lameduck/default/service1/172.0.10.3:8080")
+			So(events[2].Index, ShouldEqual, 100)
+			So(set, ShouldHaveLength, 2)
+
+			So(set.resync([]*KeyValue{
+				{Key: "/lameduck/default/service1/172.0.10.2:8080", Value: "2"},
+				{Key: "/lameduck/default/service1/172.0.10.3:8080", Value: "1"},
+			}, 101), ShouldBeEmpty)
+		})
+	})
+}
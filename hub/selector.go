@@ -0,0 +1,139 @@
+package hub
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+
+	"k8s.io/apimachinery/pkg/labels"
+
+	pb "github.com/binchencoder/skylb-api/proto"
+)
+
+// parseSelectors parses the label selectors of the given service specs in
+// ObserverOptions.Selectors. A spec without a selector gets nil, which
+// matches all endpoints.
+func parseSelectors(specs []*pb.ServiceSpec, opts ObserverOptions) ([]labels.Selector, error) {
+	sels := make([]labels.Selector, len(specs))
+	for i, spec := range specs {
+		label := fmt.Sprintf("%s.%s", spec.Namespace, spec.ServiceName)
+		s, ok := opts.Selectors[label]
+		if !ok || s == "" {
+			continue
+		}
+		sel, err := labels.Parse(s)
+		if err != nil {
+			return nil, fmt.Errorf("invalid label selector %q of service %s, %v", s, label, err)
+		}
+		sels[i] = sel
+	}
+	return sels, nil
+}
+
+// matching returns the endpoints whose metadata matches the given label
+// selector. A nil selector matches all endpoints.
+func (se serviceEndpoints) matching(sel labels.Selector) serviceEndpoints {
+	if sel == nil {
+		return se
+	}
+	m := make(serviceEndpoints, len(se))
+	for k, v := range se {
+		if sel.Matches(labels.Set(v.Metadata)) {
+			m[k] = v
+		}
+	}
+	return m
+}
+
+// describe returns how the observer is notified, for introspection.
+func (co *clientObject) describe() string {
+	co.lock.Lock()
+	defer co.lock.Unlock()
+
+	sel := "<all>"
+	if co.selector != nil {
+		sel = co.selector.String()
+	}
+	return fmt.Sprintf("%s port=%s full=%t not-ready=%t weight-updates=%t selector=%q zone=%q zone-only=%t spilled=%t subset=%d subset-key=%q endpoints=%d",
+		co.clientAddr, co.spec.PortName, co.resolveFull, co.includeNotReady, co.weightUpdates, sel, co.zone, co.zoneOnly, co.spilled, co.subsetSize, co.subsetKey, len(co.lastEps))
+}
+
+// describeObservers writes the observers of all services, sorted by
+// service, one per line.
+func (eh *endpointsHub) describeObservers(w io.Writer) {
+	var keys []string
+	sos := map[string]*serviceObject{}
+	eh.WithRLock(func() error {
+		for k, so := range eh.services {
+			keys = append(keys, k)
+			sos[k] = so
+		}
+		return nil
+	})
+	sort.Strings(keys)
+
+	for _, k := range keys {
+		so := sos[k]
+		spec := so.Spec()
+		fmt.Fprintf(w, "%s.%s\n", spec.Namespace, spec.ServiceName)
+		for _, o := range so.Observers() {
+			if co, ok := o.(*clientObject); ok {
+				fmt.Fprintf(w, "\t%s\n", co.describe())
+			}
+		}
+	}
+}
+
+// ObserversHandler serves the observers of all services and how they are
+// notified, including their label selectors, as plain text.
+func ObserversHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	if hub == nil {
+		return
+	}
+	hub.describeObservers(w)
+}
+
+// describeEndpoints writes the endpoints of all observed services, sorted
+// by service and endpoint, one per line.
+func (eh *endpointsHub) describeEndpoints(w io.Writer) {
+	var keys []string
+	sos := map[string]*serviceObject{}
+	eh.WithRLock(func() error {
+		for k, so := range eh.services {
+			keys = append(keys, k)
+			sos[k] = so
+		}
+		return nil
+	})
+	sort.Strings(keys)
+
+	for _, k := range keys {
+		so := sos[k]
+		spec := so.Spec()
+		fmt.Fprintf(w, "%s.%s\n", spec.Namespace, spec.ServiceName)
+
+		var lines []string
+		so.WithRLock(func() error {
+			for _, ep := range so.endpoints {
+				lines = append(lines, ep.describe())
+			}
+			return nil
+		})
+		sort.Strings(lines)
+		for _, l := range lines {
+			fmt.Fprintf(w, "\t%s\n", l)
+		}
+	}
+}
+
+// EndpointsHandler serves the endpoints of all observed services and their
+// state, including where they come from in hybrid mode, as plain text.
+func EndpointsHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	if hub == nil {
+		return
+	}
+	hub.describeEndpoints(w)
+}
@@ -0,0 +1,102 @@
+package hub
+
+import (
+	"bytes"
+	"fmt"
+	"testing"
+
+	. "github.com/smartystreets/goconvey/convey"
+	"k8s.io/apimachinery/pkg/labels"
+
+	pb "github.com/binchencoder/skylb-api/proto"
+)
+
+func TestParseSelectors(t *testing.T) {
+	specs := []*pb.ServiceSpec{
+		{Namespace: namespace, ServiceName: serviceName, PortName: portName},
+		{Namespace: namespace, ServiceName: "other-service", PortName: portName},
+	}
+	label := fmt.Sprintf("%s.%s", namespace, serviceName)
+
+	Convey("Parse the label selectors of service specs", t, func() {
+		sels, err := parseSelectors(specs, ObserverOptions{
+			Selectors: map[string]string{label: "zone in (a,b)"},
+		})
+		So(err, ShouldBeNil)
+		So(sels, ShouldHaveLength, 2)
+		So(sels[0].Matches(labels.Set{"zone": "a"}), ShouldBeTrue)
+		So(sels[0].Matches(labels.Set{"zone": "c"}), ShouldBeFalse)
+		So(sels[1], ShouldBeNil)
+
+		_, err = parseSelectors(specs, ObserverOptions{
+			Selectors: map[string]string{label: "zone in (a"},
+		})
+		So(err, ShouldNotBeNil)
+	})
+}
+
+func TestSelectorObserver(t *testing.T) {
+	spec := &pb.ServiceSpec{
+		Namespace:   namespace,
+		ServiceName: serviceName,
+		PortName:    portName,
+	}
+
+	Convey("Observers with a selector only receive the matching endpoints", t, func() {
+		eh := endpointsHub{
+			registry: NewMemRegistry(),
+			services: serviceMap{},
+		}
+		So(eh.InsertEndpoint(spec, "192.168.1.1", port, 0, map[string]string{"version": "v1"}), ShouldBeNil)
+		So(eh.InsertEndpoint(spec, "192.168.1.2", port, 0, map[string]string{"version": "v2"}), ShouldBeNil)
+		So(eh.InsertEndpoint(spec, "192.168.1.3", port, 0, nil), ShouldBeNil)
+		apply := func(so *serviceObject) {
+			eps, err := eh.fetchEndpoints(namespace, serviceName)
+			So(err, ShouldBeNil)
+			eh.applyEndpoints(so, eps)
+		}
+
+		so := newServiceObject(spec, nil)
+		eh.services[eh.calculateKey(namespace, serviceName)] = so
+		sel, err := labels.Parse("version=v2")
+		So(err, ShouldBeNil)
+		ch := make(chan *EndpointsUpdate, 10)
+		so.addObserver(newClientObject(spec, "192.168.0.1:8000", newObserverQueue(ch), ObserverOptions{}, sel))
+		<-ch
+
+		apply(so)
+		up := <-ch
+		So(up.Endpoints.InstEndpoints, ShouldHaveLength, 1)
+		So(up.Endpoints.InstEndpoints[0].Host, ShouldEqual, "192.168.1.2")
+		So(up.Endpoints.InstEndpoints[0].Op, ShouldEqual, pb.Operation_Add)
+
+		Convey("An endpoint should enter the set when its labels start matching", func() {
+			So(eh.InsertEndpoint(spec, "192.168.1.1", port, 0, map[string]string{"version": "v2"}), ShouldBeNil)
+			apply(so)
+
+			up := <-ch
+			So(up.Endpoints.InstEndpoints, ShouldHaveLength, 1)
+			So(up.Endpoints.InstEndpoints[0].Host, ShouldEqual, "192.168.1.1")
+			So(up.Endpoints.InstEndpoints[0].Op, ShouldEqual, pb.Operation_Add)
+		})
+
+		Convey("An endpoint should leave the set when its labels stop matching", func() {
+			So(eh.InsertEndpoint(spec, "192.168.1.2", port, 0, map[string]string{"version": "v3"}), ShouldBeNil)
+			apply(so)
+
+			up := <-ch
+			So(up.Endpoints.InstEndpoints, ShouldHaveLength, 1)
+			So(up.Endpoints.InstEndpoints[0].Host, ShouldEqual, "192.168.1.2")
+			So(up.Endpoints.InstEndpoints[0].Op, ShouldEqual, pb.Operation_Delete)
+		})
+
+		Convey("The selector should be visible in the observers", func() {
+			var buf bytes.Buffer
+			eh.describeObservers(&buf)
+			So(buf.String(), ShouldContainSubstring, fmt.Sprintf("%s.%s\n", namespace, serviceName))
+			So(buf.String(), ShouldContainSubstring, `192.168.0.1:8000`)
+			So(buf.String(), ShouldContainSubstring, `selector="version=v2"`)
+			So(buf.String(), ShouldContainSubstring, `endpoints=1`)
+		})
+	})
+}
@@ -0,0 +1,167 @@
+package hub
+
+import (
+	"flag"
+	"fmt"
+	"math"
+	"strings"
+	"time"
+
+	"github.com/golang/glog"
+
+	pb "github.com/binchencoder/skylb-api/proto"
+)
+
+var (
+	slowStartWindow    = flag.Duration("slow-start-window", 0, "The time a new endpoint takes to ramp up to its weight. Zero disables slow start")
+	slowStartWindows   = flag.String("slow-start-windows", "", "Comma separated namespace.service=duration slow start windows which override --slow-start-window")
+	slowStartMinWeight = flag.Float64("slow-start-min-weight-fraction", 0.1, "The fraction of its weight which a new endpoint starts with")
+	slowStartSteps     = flag.Int("slow-start-steps", 10, "The number of weight steps pushed to observers in a slow start window")
+)
+
+// slowStartWindowOf returns the slow start window of the given service.
+func slowStartWindowOf(spec *pb.ServiceSpec) time.Duration {
+	label := fmt.Sprintf("%s.%s", spec.Namespace, spec.ServiceName)
+	for _, kv := range strings.Split(*slowStartWindows, ",") {
+		parts := strings.SplitN(strings.TrimSpace(kv), "=", 2)
+		if len(parts) != 2 || parts[0] != label {
+			continue
+		}
+		window, err := time.ParseDuration(parts[1])
+		if err != nil {
+			glog.Warningf("Ignore invalid slow start window %q of service %s, %v", parts[1], label, err)
+			continue
+		}
+		return window
+	}
+	return *slowStartWindow
+}
+
+// slowStart ramps up the weights of the endpoints of a service which just
+// became ready, from --slow-start-min-weight-fraction to their weights in
+// --slow-start-steps steps over the slow start window. It's guarded by the
+// lock of the service object.
+type slowStart struct {
+	window time.Duration
+
+	// Whether the initial endpoints of the service were set, which don't
+	// ramp up, since they are not new but only new to the hub.
+	primed bool
+	// When the endpoints ramping up became ready, by address.
+	since map[string]time.Time
+	// Pushes the next step to the observers while any endpoint ramps up.
+	timer *time.Timer
+}
+
+func newSlowStart(window time.Duration) *slowStart {
+	return &slowStart{
+		window: window,
+		since:  map[string]time.Time{},
+	}
+}
+
+// update starts ramping up the endpoints which became ready, and stops
+// ramping up those gone or not ready.
+func (ss *slowStart) update(last, now serviceEndpoints, t time.Time) {
+	primed := ss.primed
+	ss.primed = true
+	for k, v := range now {
+		if v.NotReady {
+			delete(ss.since, k)
+			continue
+		}
+		if l, ok := last[k]; primed && (!ok || l.NotReady) {
+			ss.since[k] = t
+		}
+	}
+	for k := range ss.since {
+		if _, ok := now[k]; !ok {
+			delete(ss.since, k)
+		}
+	}
+}
+
+// expire stops ramping up the endpoints which are through the window.
+func (ss *slowStart) expire(t time.Time) {
+	for k, since := range ss.since {
+		if t.Sub(since) >= ss.window {
+			delete(ss.since, k)
+		}
+	}
+}
+
+// weight returns the weight at the given time of an endpoint of the given
+// weight which became ready at since.
+func (ss *slowStart) weight(weight int32, since, t time.Time) int32 {
+	elapsed := t.Sub(since)
+	if elapsed >= ss.window {
+		return weight
+	}
+	steps := *slowStartSteps
+	if steps < 1 {
+		steps = 1
+	}
+	step := int64(elapsed) * int64(steps) / int64(ss.window)
+	frac := *slowStartMinWeight + (1-*slowStartMinWeight)*float64(step)/float64(steps)
+	w := int32(math.Round(float64(baseWeight(weight)) * frac))
+	if w < 1 {
+		w = 1
+	}
+	return w
+}
+
+// endpoints returns the given endpoints with the weights of those ramping
+// up at the given time.
+func (ss *slowStart) endpoints(eps serviceEndpoints, t time.Time) serviceEndpoints {
+	if len(ss.since) == 0 {
+		return eps
+	}
+	m := make(serviceEndpoints, len(eps))
+	for k, v := range eps {
+		if since, ok := ss.since[k]; ok {
+			v.Weight = ss.weight(v.Weight, since, t)
+		}
+		m[k] = v
+	}
+	return m
+}
+
+// scheduleSlowStart starts pushing the steps to the observers of the
+// service object if any endpoint ramps up. It has to be called with the
+// write lock of the service object held.
+func (so *serviceObject) scheduleSlowStart() {
+	ss := so.slowStart
+	if ss.timer != nil || len(ss.since) == 0 {
+		return
+	}
+	steps := *slowStartSteps
+	if steps < 1 {
+		steps = 1
+	}
+	ss.timer = time.AfterFunc(ss.window/time.Duration(steps), so.stepSlowStart)
+}
+
+// stepSlowStart notifies the observers of the service object of the next
+// step of the weights ramping up.
+func (so *serviceObject) stepSlowStart() {
+	closed := false
+	so.WithWLock(func() error {
+		so.slowStart.timer = nil
+		select {
+		case <-so.stopCh:
+			closed = true
+			return nil
+		default:
+		}
+		so.slowStart.expire(time.Now())
+		so.scheduleSlowStart()
+		return nil
+	})
+	if closed {
+		return
+	}
+
+	for _, o := range so.Observers() {
+		o.Notify(nil)
+	}
+}
@@ -0,0 +1,137 @@
+package hub
+
+import (
+	"testing"
+	"time"
+
+	. "github.com/smartystreets/goconvey/convey"
+
+	pb "github.com/binchencoder/skylb-api/proto"
+)
+
+func TestSlowStartWindowOf(t *testing.T) {
+	spec := &pb.ServiceSpec{
+		Namespace:   namespace,
+		ServiceName: serviceName,
+		PortName:    portName,
+	}
+
+	Convey("The slow start window is configurable per service", t, func() {
+		defer func(window time.Duration, windows string) {
+			*slowStartWindow, *slowStartWindows = window, windows
+		}(*slowStartWindow, *slowStartWindows)
+
+		So(slowStartWindowOf(spec), ShouldEqual, 0)
+
+		*slowStartWindow = time.Minute
+		So(slowStartWindowOf(spec), ShouldEqual, time.Minute)
+
+		*slowStartWindows = "default.other=10s, default.service1=30s"
+		So(slowStartWindowOf(spec), ShouldEqual, 30*time.Second)
+
+		*slowStartWindows = "default.service1=soon"
+		So(slowStartWindowOf(spec), ShouldEqual, time.Minute)
+	})
+}
+
+func TestSlowStartWeight(t *testing.T) {
+	Convey("The weight ramps up in steps over the window", t, func() {
+		ss := newSlowStart(10 * time.Second)
+		since := time.Now()
+
+		So(ss.weight(0, since, since), ShouldEqual, 10)
+		So(ss.weight(0, since, since.Add(999*time.Millisecond)), ShouldEqual, 10)
+		So(ss.weight(0, since, since.Add(5*time.Second)), ShouldEqual, 55)
+		So(ss.weight(20, since, since.Add(5*time.Second)), ShouldEqual, 11)
+		So(ss.weight(0, since, since.Add(10*time.Second)), ShouldEqual, 0)
+		So(ss.weight(20, since, since.Add(10*time.Second)), ShouldEqual, 20)
+	})
+
+	Convey("Only the endpoints which became ready ramp up", t, func() {
+		ss := newSlowStart(10 * time.Second)
+		t0 := time.Now()
+		initial := serviceEndpoints{
+			"192.168.1.1:8080": {IP: "192.168.1.1", Port: port},
+			"192.168.1.2:8080": {IP: "192.168.1.2", Port: port, NotReady: true},
+		}
+		ss.update(serviceEndpoints{}, initial, t0)
+		So(ss.since, ShouldBeEmpty)
+
+		now := serviceEndpoints{
+			"192.168.1.1:8080": {IP: "192.168.1.1", Port: port},
+			"192.168.1.2:8080": {IP: "192.168.1.2", Port: port},
+			"192.168.1.3:8080": {IP: "192.168.1.3", Port: port},
+		}
+		ss.update(initial, now, t0)
+		So(ss.since, ShouldHaveLength, 2)
+		eps := ss.endpoints(now, t0)
+		So(eps["192.168.1.1:8080"].Weight, ShouldEqual, 0)
+		So(eps["192.168.1.2:8080"].Weight, ShouldEqual, 10)
+		So(eps["192.168.1.3:8080"].Weight, ShouldEqual, 10)
+
+		delete(now, "192.168.1.3:8080")
+		ss.update(now, now, t0)
+		So(ss.since, ShouldHaveLength, 1)
+
+		ss.expire(t0.Add(10 * time.Second))
+		So(ss.since, ShouldBeEmpty)
+	})
+}
+
+func TestSlowStartObserver(t *testing.T) {
+	spec := &pb.ServiceSpec{
+		Namespace:   namespace,
+		ServiceName: serviceName,
+		PortName:    portName,
+	}
+
+	Convey("New endpoints should be pushed with the weights ramping up", t, func() {
+		defer func(steps int) {
+			*slowStartSteps = steps
+		}(*slowStartSteps)
+		*slowStartSteps = 2
+
+		eh := endpointsHub{
+			services: serviceMap{},
+		}
+		so := newServiceObject(spec, nil)
+		so.slowStart = newSlowStart(400 * time.Millisecond)
+		defer so.close()
+
+		ch := make(chan *EndpointsUpdate, 10)
+		so.addObserver(newClientObject(spec, "192.168.0.1:8000", newObserverQueue(ch), ObserverOptions{WeightUpdates: true}, nil))
+		next := func() *EndpointsUpdate {
+			select {
+			case up := <-ch:
+				return up
+			case <-time.After(time.Second):
+				return nil
+			}
+		}
+		next()
+
+		eh.applyEndpoints(so, newTestEndpoints("192.168.1.1"))
+		up := next()
+		So(up.Endpoints.InstEndpoints, ShouldHaveLength, 1)
+		So(up.Endpoints.InstEndpoints[0].Weight, ShouldEqual, 0)
+
+		eh.applyEndpoints(so, newTestEndpoints("192.168.1.1", "192.168.1.2"))
+		up = next()
+		So(up.Endpoints.InstEndpoints, ShouldHaveLength, 1)
+		So(up.Endpoints.InstEndpoints[0].Op, ShouldEqual, pb.Operation_Add)
+		So(up.Endpoints.InstEndpoints[0].Host, ShouldEqual, "192.168.1.2")
+		So(up.Endpoints.InstEndpoints[0].Weight, ShouldEqual, 10)
+
+		up = next()
+		So(up, ShouldNotBeNil)
+		So(up.Endpoints.InstEndpoints, ShouldHaveLength, 1)
+		So(up.Endpoints.InstEndpoints[0].Op, ShouldEqual, OpWeight)
+		So(up.Endpoints.InstEndpoints[0].Weight, ShouldEqual, 55)
+
+		up = next()
+		So(up, ShouldNotBeNil)
+		So(up.Endpoints.InstEndpoints, ShouldHaveLength, 1)
+		So(up.Endpoints.InstEndpoints[0].Op, ShouldEqual, OpWeight)
+		So(up.Endpoints.InstEndpoints[0].Weight, ShouldEqual, 0)
+	})
+}
@@ -0,0 +1,82 @@
+package hub
+
+import (
+	"hash/fnv"
+	"net"
+	"sort"
+)
+
+// subsetKey returns the identity of the client which its subsets are keyed
+// on, the given client ID if any, or else the IP of the client address, so
+// that a client gets the same subsets when it reconnects.
+func subsetKey(clientId, clientAddr string) string {
+	if clientId != "" {
+		return clientId
+	}
+	if host, _, err := net.SplitHostPort(clientAddr); err == nil {
+		return host
+	}
+	return clientAddr
+}
+
+// subsetScore returns the rendezvous hashing score of the endpoint for the
+// client of the given key.
+func subsetScore(key, endpoint string) uint64 {
+	h := fnv.New64a()
+	h.Write([]byte(key))
+	h.Write([]byte{0})
+	h.Write([]byte(endpoint))
+
+	// Finalize with splitmix64 to spread the similar keys evenly.
+	x := h.Sum64()
+	x ^= x >> 30
+	x *= 0xbf58476d1ce4e5b9
+	x ^= x >> 27
+	x *= 0x94d049bb133111eb
+	x ^= x >> 31
+	return x
+}
+
+// subset returns the subset of the given size of the endpoints for the
+// client of the given key, or all endpoints if size is not positive.
+//
+// It uses rendezvous hashing: every endpoint gets a score by the client
+// key, and the size ready endpoints with the highest scores are picked. So
+// the subset of a client is stable, the endpoints are evenly spread over
+// the clients, and an endpoint which comes or goes only moves the clients
+// which pick it. The not ready endpoints scoring higher than the lowest
+// picked one are kept too, since they replace it once ready.
+func (se serviceEndpoints) subset(key string, size int) serviceEndpoints {
+	if size <= 0 || len(se) <= size {
+		return se
+	}
+
+	type scored struct {
+		key   string
+		score uint64
+	}
+	all := make([]scored, 0, len(se))
+	for k := range se {
+		all = append(all, scored{k, subsetScore(key, k)})
+	}
+	sort.Slice(all, func(i, j int) bool {
+		if all[i].score != all[j].score {
+			return all[i].score > all[j].score
+		}
+		return all[i].key < all[j].key
+	})
+
+	m := make(serviceEndpoints, size)
+	ready := 0
+	for _, s := range all {
+		if ready == size {
+			break
+		}
+		v := se[s.key]
+		m[s.key] = v
+		if !v.NotReady {
+			ready++
+		}
+	}
+	return m
+}
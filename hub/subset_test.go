@@ -0,0 +1,162 @@
+package hub
+
+import (
+	"fmt"
+	"testing"
+
+	. "github.com/smartystreets/goconvey/convey"
+
+	pb "github.com/binchencoder/skylb-api/proto"
+)
+
+func newSubsetEndpoints(n int) serviceEndpoints {
+	se := serviceEndpoints{}
+	for i := 0; i < n; i++ {
+		v := ServiceEndpoint{IP: fmt.Sprintf("172.0.%d.%d", i/250, i%250+1), Port: port}
+		se[v.toString()] = v
+	}
+	return se
+}
+
+func TestSubsetKey(t *testing.T) {
+	Convey("Subsets are keyed on the client ID or the client IP", t, func() {
+		So(subsetKey("client-1", "192.168.0.1:8000"), ShouldEqual, "client-1")
+		So(subsetKey("", "192.168.0.1:8000"), ShouldEqual, "192.168.0.1")
+		So(subsetKey("", "192.168.0.1"), ShouldEqual, "192.168.0.1")
+	})
+}
+
+func TestSubset(t *testing.T) {
+	const (
+		numClients   = 1000
+		numEndpoints = 100
+		subsetSize   = 10
+	)
+	clients := make([]string, numClients)
+	for i := range clients {
+		clients[i] = fmt.Sprintf("10.0.%d.%d", i/250, i%250+1)
+	}
+
+	Convey("Subset the endpoints for each client", t, func() {
+		se := newSubsetEndpoints(numEndpoints)
+
+		Convey("A subset should be stable and of the given size", func() {
+			s := se.subset(clients[0], subsetSize)
+			So(s, ShouldHaveLength, subsetSize)
+			So(se.subset(clients[0], subsetSize), ShouldResemble, s)
+			So(se.subset(clients[0], 0), ShouldHaveLength, numEndpoints)
+			So(se.subset(clients[0], numEndpoints+1), ShouldHaveLength, numEndpoints)
+		})
+
+		Convey("The load should be even across endpoints", func() {
+			load := map[string]int{}
+			for _, c := range clients {
+				for k := range se.subset(c, subsetSize) {
+					load[k]++
+				}
+			}
+			So(load, ShouldHaveLength, numEndpoints)
+
+			// Each endpoint is expected to be picked by 100 clients.
+			expected := numClients * subsetSize / numEndpoints
+			for _, n := range load {
+				So(n, ShouldBeBetweenOrEqual, expected*6/10, expected*14/10)
+			}
+		})
+
+		Convey("An endpoint which goes should only move the clients which picked it", func() {
+			gone := "172.0.0.1:8080"
+			after := serviceEndpoints{}
+			for k, v := range se {
+				if k != gone {
+					after[k] = v
+				}
+			}
+
+			for _, c := range clients {
+				before, now := se.subset(c, subsetSize), after.subset(c, subsetSize)
+				So(now, ShouldHaveLength, subsetSize)
+				moved := 0
+				for k := range now {
+					if _, ok := before[k]; !ok {
+						moved++
+					}
+				}
+				if _, ok := before[gone]; ok {
+					So(moved, ShouldEqual, 1)
+				} else {
+					So(moved, ShouldEqual, 0)
+				}
+			}
+		})
+
+		Convey("An endpoint which comes should move few clients by one endpoint", func() {
+			after := newSubsetEndpoints(numEndpoints + 1)
+
+			total := 0
+			for _, c := range clients {
+				before, now := se.subset(c, subsetSize), after.subset(c, subsetSize)
+				moved := 0
+				for k := range now {
+					if _, ok := before[k]; !ok {
+						moved++
+					}
+				}
+				So(moved, ShouldBeLessThanOrEqualTo, 1)
+				total += moved
+			}
+			// About subsetSize / (numEndpoints + 1) of the clients.
+			So(total, ShouldBeBetweenOrEqual, numClients*subsetSize/numEndpoints/2, numClients*subsetSize/numEndpoints*2)
+		})
+
+		Convey("Not ready endpoints should be kept only if they would be picked", func() {
+			s := se.subset(clients[0], subsetSize)
+			var picked string
+			for k := range s {
+				picked = k
+				break
+			}
+			v := se[picked]
+			v.NotReady = true
+			se[picked] = v
+
+			now := se.subset(clients[0], subsetSize)
+			So(now, ShouldHaveLength, subsetSize+1)
+			So(now[picked].NotReady, ShouldBeTrue)
+			So(now.ready(), ShouldHaveLength, subsetSize)
+		})
+	})
+}
+
+func TestSubsetObserver(t *testing.T) {
+	spec := &pb.ServiceSpec{
+		Namespace:   namespace,
+		ServiceName: serviceName,
+		PortName:    portName,
+	}
+
+	Convey("Observers with a subset size only receive their subset", t, func() {
+		eh := endpointsHub{
+			services: serviceMap{},
+		}
+		so := newServiceObject(spec, nil)
+		ch := make(chan *EndpointsUpdate, 10)
+		opts := ObserverOptions{
+			SubsetSizes: map[string]int{fmt.Sprintf("%s.%s", namespace, serviceName): 2},
+		}
+		co := newClientObject(spec, "192.168.0.1:8000", newObserverQueue(ch), opts, nil)
+		So(co.subsetKey, ShouldEqual, "192.168.0.1")
+		so.addObserver(co)
+		<-ch
+
+		eps := newTestEndpoints("192.168.1.1", "192.168.1.2", "192.168.1.3", "192.168.1.4", "192.168.1.5")
+		eh.applyEndpoints(so, eps)
+		up := <-ch
+		So(up.Endpoints.InstEndpoints, ShouldHaveLength, 2)
+		for _, ep := range up.Endpoints.InstEndpoints {
+			So(ep.Op, ShouldEqual, pb.Operation_Add)
+			_, ok := skypbEndpointsToMap(spec, eps).subset("192.168.0.1", 2)[fmt.Sprintf("%s:%d", ep.Host, ep.Port)]
+			So(ok, ShouldBeTrue)
+		}
+	})
+}
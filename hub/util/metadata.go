@@ -0,0 +1,66 @@
+package util
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	api "k8s.io/api/core/v1"
+)
+
+// CalculateMetadataKeyPrefix returns the prefix of the labels which carry
+// the metadata of the given endpoint, one label per metadata key.
+func CalculateMetadataKeyPrefix(host string, port int32) string {
+	return fmt.Sprintf("%s_%d_meta_", host, port)
+}
+
+// CalculateMetadataKey returns the label which carries the given metadata
+// key of the given endpoint.
+func CalculateMetadataKey(host string, port int32, name string) string {
+	return CalculateMetadataKeyPrefix(host, port) + name
+}
+
+// EndpointMetadata returns the metadata of the given endpoint carried in the
+// labels of the endpoints record, or nil if it has none.
+func EndpointMetadata(eps *api.Endpoints, host string, port int32) map[string]string {
+	prefix := CalculateMetadataKeyPrefix(host, port)
+	var md map[string]string
+	for k, v := range eps.Labels {
+		if !strings.HasPrefix(k, prefix) || len(k) == len(prefix) {
+			continue
+		}
+		if md == nil {
+			md = map[string]string{}
+		}
+		md[k[len(prefix):]] = v
+	}
+	return md
+}
+
+// SetEndpointMetadata replaces the metadata of the given endpoint in the
+// labels of the endpoints record.
+func SetEndpointMetadata(eps *api.Endpoints, host string, port int32, md map[string]string) {
+	prefix := CalculateMetadataKeyPrefix(host, port)
+	for k := range eps.Labels {
+		if strings.HasPrefix(k, prefix) {
+			delete(eps.Labels, k)
+		}
+	}
+	for k, v := range md {
+		if eps.Labels == nil {
+			eps.Labels = make(map[string]string)
+		}
+		eps.Labels[CalculateMetadataKey(host, port, k)] = v
+	}
+}
+
+// FormatMetadata formats the metadata as comma separated key=value pairs
+// sorted by key.
+func FormatMetadata(md map[string]string) string {
+	pairs := make([]string, 0, len(md))
+	for k, v := range md {
+		pairs = append(pairs, fmt.Sprintf("%s=%s", k, v))
+	}
+	sort.Strings(pairs)
+	return strings.Join(pairs, ",")
+}
@@ -0,0 +1,31 @@
+package util
+
+import (
+	"testing"
+
+	. "github.com/smartystreets/goconvey/convey"
+	api "k8s.io/api/core/v1"
+)
+
+func TestEndpointMetadata(t *testing.T) {
+	Convey("Carry endpoint metadata in the labels of the endpoints record", t, func() {
+		eps := api.Endpoints{}
+		md := map[string]string{
+			"version": "1.2.0",
+			"zone":    "zone-a",
+		}
+		SetEndpointMetadata(&eps, "172.0.0.100", 8080, md)
+		So(eps.Labels, ShouldResemble, map[string]string{
+			"172.0.0.100_8080_meta_version": "1.2.0",
+			"172.0.0.100_8080_meta_zone":    "zone-a",
+		})
+		So(EndpointMetadata(&eps, "172.0.0.100", 8080), ShouldResemble, md)
+		So(EndpointMetadata(&eps, "172.0.0.100", 8081), ShouldBeNil)
+		So(FormatMetadata(md), ShouldEqual, "version=1.2.0,zone=zone-a")
+
+		Convey("Replacing the metadata should drop the old keys", func() {
+			SetEndpointMetadata(&eps, "172.0.0.100", 8080, map[string]string{"canary": "true"})
+			So(EndpointMetadata(&eps, "172.0.0.100", 8080), ShouldResemble, map[string]string{"canary": "true"})
+		})
+	})
+}
@@ -0,0 +1,101 @@
+package hub
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+
+	"github.com/golang/glog"
+	prom "github.com/prometheus/client_golang/prometheus"
+	"golang.org/x/net/context"
+	api "k8s.io/api/core/v1"
+
+	pb "github.com/binchencoder/skylb-api/proto"
+)
+
+var (
+	defaultWeight = flag.Int("default-weight", 100, "The weight of an endpoint which has none, as the base of slow start weights")
+
+	weightChangeCounts = prom.NewCounterVec(
+		prom.CounterOpts{
+			Namespace: "infra",
+			Subsystem: "skylb",
+			Name:      "weight_change_counts",
+			Help:      "SkyLB endpoint weight change counts, by service.",
+		},
+		[]string{"service"},
+	)
+)
+
+func init() {
+	prom.MustRegister(weightChangeCounts)
+}
+
+// baseWeight returns the given weight, or --default-weight if it's not set.
+func baseWeight(weight int32) int32 {
+	if weight <= 0 {
+		return int32(*defaultWeight)
+	}
+	return weight
+}
+
+// countWeightChanges counts the endpoints which are kept but changed their
+// weights.
+func countWeightChanges(spec *pb.ServiceSpec, last, now serviceEndpoints) {
+	label := fmt.Sprintf("%s.%s", spec.Namespace, spec.ServiceName)
+	for k, v := range now {
+		if l, ok := last[k]; ok && l.Weight != v.Weight {
+			glog.V(3).Infof("Endpoint %s of service %s changed weight from %d to %d.", k, label, l.Weight, v.Weight)
+			weightChangeCounts.WithLabelValues(label).Inc()
+		}
+	}
+}
+
+// UpdateEndpointWeight changes the weight of a registered endpoint without
+// registering it again. Zero resets it to the default weight.
+func (eh *endpointsHub) UpdateEndpointWeight(spec *pb.ServiceSpec, host string, port, weight int32) error {
+	return SetEndpointWeight(context.Background(), eh.registry, spec, host, port, weight)
+}
+
+// SetEndpointWeight changes the weight of an endpoint registered in the
+// given registry, keeping its TTL so that it's not registered again. Zero
+// resets it to the default weight. It returns ErrKeyNotFound if the
+// endpoint isn't registered.
+func SetEndpointWeight(ctx context.Context, registry Registry, spec *pb.ServiceSpec, host string, port, weight int32) error {
+	key := calculateEndpointKey(spec.Namespace, spec.ServiceName, host, port)
+
+	kvs, _, err := registry.List(ctx, key)
+	if err != nil {
+		return err
+	}
+	var value string
+	for _, kv := range kvs {
+		if kv.Key == key {
+			value = kv.Value
+		}
+	}
+	if value == "" {
+		return ErrKeyNotFound
+	}
+
+	eps := api.Endpoints{}
+	if err := json.Unmarshal([]byte(value), &eps); err != nil {
+		return err
+	}
+	weightKey := calculateWeightKey(host, port)
+	if weight == 0 {
+		delete(eps.Labels, weightKey)
+	} else {
+		if eps.Labels == nil {
+			eps.Labels = make(map[string]string)
+		}
+		eps.Labels[weightKey] = fmt.Sprintf("%d", weight)
+	}
+	b, err := json.Marshal(&eps)
+	if err != nil {
+		return err
+	}
+
+	glog.Infof("Update weight of endpoint %s:%d of service %s.%s to %d.", host, port, spec.Namespace, spec.ServiceName, weight)
+	return registry.Update(ctx, key, string(b))
+}
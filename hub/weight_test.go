@@ -0,0 +1,46 @@
+package hub
+
+import (
+	"testing"
+
+	. "github.com/smartystreets/goconvey/convey"
+	"golang.org/x/net/context"
+
+	pb "github.com/binchencoder/skylb-api/proto"
+)
+
+func TestUpdateEndpointWeight(t *testing.T) {
+	spec := &pb.ServiceSpec{
+		Namespace:   namespace,
+		ServiceName: serviceName,
+		PortName:    portName,
+	}
+
+	Convey("Change the weight of a registered endpoint", t, func() {
+		eh := endpointsHub{
+			registry: NewMemRegistry(),
+			services: serviceMap{},
+		}
+		So(eh.UpdateEndpointWeight(spec, "192.168.1.1", port, 5), ShouldEqual, ErrKeyNotFound)
+		So(eh.InsertEndpoint(spec, "192.168.1.1", port, 0, nil), ShouldBeNil)
+
+		weightOf := func() int32 {
+			eps, err := eh.fetchEndpoints(namespace, serviceName)
+			So(err, ShouldBeNil)
+			return skypbAllEndpointsToMap(spec, eps)["192.168.1.1:8080"].Weight
+		}
+		So(weightOf(), ShouldEqual, 0)
+
+		So(eh.UpdateEndpointWeight(spec, "192.168.1.1", port, 5), ShouldBeNil)
+		So(weightOf(), ShouldEqual, 5)
+
+		So(eh.UpdateEndpointWeight(spec, "192.168.1.1", port, 0), ShouldBeNil)
+		So(weightOf(), ShouldEqual, 0)
+
+		Convey("Change the weight with the registry alone", func() {
+			So(SetEndpointWeight(context.Background(), eh.registry, spec, "192.168.1.1", port, 7), ShouldBeNil)
+			So(weightOf(), ShouldEqual, 7)
+			So(SetEndpointWeight(context.Background(), eh.registry, spec, "192.168.1.2", port, 7), ShouldEqual, ErrKeyNotFound)
+		})
+	})
+}
@@ -0,0 +1,112 @@
+package hub
+
+import (
+	"flag"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/golang/glog"
+	prom "github.com/prometheus/client_golang/prometheus"
+
+	pb "github.com/binchencoder/skylb-api/proto"
+	"github.com/binchencoder/skylb/hub/model"
+)
+
+const (
+	zeroActionHeld     = "held"
+	zeroActionNotified = "notified"
+	zeroActionRecover  = "recovered"
+)
+
+var (
+	zeroEpsPanicThreshold = flag.Int("zero-endpoints-panic-threshold", 3, "When a service loses at least this many endpoints at once and has none left, hold the last known endpoints for the grace period. Zero disables it")
+	zeroEpsGracePeriod    = flag.Duration("zero-endpoints-grace-period", 30*time.Second, "How long to hold the last known endpoints of a service which lost all of them at once")
+
+	zeroEndpointsCounts = prom.NewCounterVec(
+		prom.CounterOpts{
+			Namespace: "infra",
+			Subsystem: "skylb",
+			Name:      "zero_endpoints_counts",
+			Help:      "SkyLB zero endpoints event counts, by service and action.",
+		},
+		[]string{"service", "action"},
+	)
+)
+
+func init() {
+	prom.MustRegister(zeroEndpointsCounts)
+}
+
+// holdZeroEndpoints decides whether to hold back the given endpoints of the
+// service object, and returns true if so. It has to be called with the
+// write lock of the service object held.
+//
+// A service which loses many endpoints at once and has none left is more
+// likely to suffer from a broken endpoints source than to be really down.
+// So if it loses at least --zero-endpoints-panic-threshold endpoints, the
+// last known endpoints are kept for --zero-endpoints-grace-period. If the
+// service doesn't recover meanwhile, the observers are notified of zero
+// endpoints.
+func (eh *endpointsHub) holdZeroEndpoints(so *serviceObject, epsMap serviceEndpoints) bool {
+	label := fmt.Sprintf("%s.%s", so.Spec().Namespace, so.Spec().ServiceName)
+
+	if len(epsMap.ready()) > 0 {
+		if so.zeroTimer != nil {
+			glog.Infof("Service %s recovered within the zero endpoints grace period.", label)
+			zeroEndpointsCounts.WithLabelValues(label, zeroActionRecover).Inc()
+			so.zeroTimer.Stop()
+			so.zeroTimer = nil
+			so.heldEps = nil
+		}
+		return false
+	}
+
+	if so.zeroTimer != nil {
+		// Still in the grace period, keep the latest.
+		so.heldEps = epsMap
+		return true
+	}
+
+	lost := len(so.endpoints.ready())
+	if lost == 0 || *zeroEpsPanicThreshold <= 0 || lost < *zeroEpsPanicThreshold || *zeroEpsGracePeriod <= 0 {
+		return false
+	}
+
+	glog.Warningf("Service %s lost all of its %d endpoints at once, hold the last known endpoints for %v.", label, lost, *zeroEpsGracePeriod)
+	zeroEndpointsCounts.WithLabelValues(label, zeroActionHeld).Inc()
+
+	so.heldEps = epsMap
+	var timer *time.Timer
+	timer = time.AfterFunc(*zeroEpsGracePeriod, func() {
+		expired := false
+		so.WithWLock(func() error {
+			if so.zeroTimer != timer {
+				// The service has recovered or been freed.
+				return nil
+			}
+			expired = true
+			so.zeroTimer = nil
+			setEndpoints(so, so.heldEps)
+			so.heldEps = nil
+			return nil
+		})
+		if expired {
+			reportZeroEndpoints(so.Spec(), so.Observers())
+		}
+	})
+	so.zeroTimer = timer
+	return true
+}
+
+// reportZeroEndpoints logs and counts that the given service has no
+// endpoints left, naming the observers affected.
+func reportZeroEndpoints(spec *pb.ServiceSpec, observers []model.ClientObserver) {
+	label := fmt.Sprintf("%s.%s", spec.Namespace, spec.ServiceName)
+	addrs := make([]string, 0, len(observers))
+	for _, co := range observers {
+		addrs = append(addrs, co.ClientAddr())
+	}
+	glog.Warningf("Service %s has zero endpoints, notify %d observer(s): %s.", label, len(addrs), strings.Join(addrs, ", "))
+	zeroEndpointsCounts.WithLabelValues(label, zeroActionNotified).Inc()
+}
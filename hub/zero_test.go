@@ -0,0 +1,74 @@
+package hub
+
+import (
+	"testing"
+	"time"
+
+	. "github.com/smartystreets/goconvey/convey"
+
+	pb "github.com/binchencoder/skylb-api/proto"
+)
+
+func TestHoldZeroEndpoints(t *testing.T) {
+	spec := &pb.ServiceSpec{
+		Namespace:   namespace,
+		ServiceName: serviceName,
+		PortName:    portName,
+	}
+
+	Convey("Hold the last known endpoints when a service loses all of them", t, func() {
+		oldThreshold, oldGrace := *zeroEpsPanicThreshold, *zeroEpsGracePeriod
+		*zeroEpsPanicThreshold, *zeroEpsGracePeriod = 2, 200*time.Millisecond
+		Reset(func() {
+			*zeroEpsPanicThreshold, *zeroEpsGracePeriod = oldThreshold, oldGrace
+		})
+
+		eh := endpointsHub{
+			services: serviceMap{},
+		}
+		so := newServiceObject(spec, nil)
+		ch := newTestObserver(so, "192.168.0.1:8000", ObserverOptions{ResolveFull: true})
+		next := func(timeout time.Duration) *EndpointsUpdate {
+			select {
+			case up := <-ch:
+				return up
+			case <-time.After(timeout):
+				return nil
+			}
+		}
+
+		eh.applyEndpoints(so, newTestEndpoints("192.168.1.1", "192.168.1.2"))
+		So(next(time.Second).Endpoints.InstEndpoints, ShouldHaveLength, 2)
+
+		eh.applyEndpoints(so, newTestEndpoints())
+		So(next(50*time.Millisecond), ShouldBeNil)
+		so.WithRLock(func() error {
+			So(so.endpoints.ready(), ShouldHaveLength, 2)
+			return nil
+		})
+
+		Convey("Should drop the hold when the service recovers", func() {
+			eh.applyEndpoints(so, newTestEndpoints("192.168.1.3"))
+			up := next(time.Second)
+			So(up.Endpoints.InstEndpoints, ShouldHaveLength, 1)
+			So(up.Endpoints.InstEndpoints[0].Host, ShouldEqual, "192.168.1.3")
+
+			// The timer was stopped, nothing more is sent.
+			So(next(400*time.Millisecond), ShouldBeNil)
+			so.WithRLock(func() error {
+				So(so.zeroTimer, ShouldBeNil)
+				return nil
+			})
+		})
+
+		Convey("Should notify zero endpoints after the grace period", func() {
+			up := next(time.Second)
+			So(up, ShouldNotBeNil)
+			So(up.Endpoints.InstEndpoints, ShouldBeEmpty)
+			so.WithRLock(func() error {
+				So(so.endpoints, ShouldBeEmpty)
+				return nil
+			})
+		})
+	})
+}
@@ -0,0 +1,115 @@
+package hub
+
+import (
+	"flag"
+	"fmt"
+	"sort"
+
+	"github.com/golang/glog"
+	prom "github.com/prometheus/client_golang/prometheus"
+
+	pb "github.com/binchencoder/skylb-api/proto"
+)
+
+// ZoneMetadataKey is the endpoint metadata key of the zone where the
+// endpoint lives.
+const ZoneMetadataKey = "zone"
+
+var (
+	zoneSpilloverFraction = flag.Float64("zone-spillover-fraction", 0.5, "The fraction of its fair share of ready endpoints below which a zone spills over to other zones for zone-only observers")
+
+	zoneSpilloverCounts = prom.NewCounterVec(
+		prom.CounterOpts{
+			Namespace: "infra",
+			Subsystem: "skylb",
+			Name:      "zone_spillover_counts",
+			Help:      "SkyLB counts of zone-only observers starting to spill over to other zones, by service and zone.",
+		},
+		[]string{"service", "zone"},
+	)
+)
+
+func init() {
+	prom.MustRegister(zoneSpilloverCounts)
+}
+
+// zone returns the zone of the endpoint, or "" if unknown.
+func (se ServiceEndpoint) zone() string {
+	return se.Metadata[ZoneMetadataKey]
+}
+
+// inZone returns the endpoints in the given zone.
+func (se serviceEndpoints) inZone(zone string) serviceEndpoints {
+	m := make(serviceEndpoints, len(se))
+	for k, v := range se {
+		if v.zone() == zone {
+			m[k] = v
+		}
+	}
+	return m
+}
+
+// lowZoneCapacity returns true if the ready endpoints in the given zone
+// are fewer than the given fraction of its fair share, i.e. the ready
+// endpoints of all zones divided by the number of zones. The endpoints
+// without a zone count as one zone.
+func (se serviceEndpoints) lowZoneCapacity(zone string, fraction float64) bool {
+	local, total := 0, 0
+	zones := map[string]struct{}{}
+	for _, v := range se {
+		if v.NotReady {
+			continue
+		}
+		total++
+		zones[v.zone()] = struct{}{}
+		if v.zone() == zone {
+			local++
+		}
+	}
+	if total == 0 {
+		return false
+	}
+	return float64(local) < fraction*float64(total)/float64(len(zones))
+}
+
+// zoneEndpoints returns the endpoints to send to the observer in the given
+// zone. A zone-only observer gets the endpoints in its zone, or all of them
+// while its zone is short of capacity, see lowZoneCapacity.
+func (co *clientObject) zoneEndpoints(now serviceEndpoints) serviceEndpoints {
+	if co.zone == "" || !co.zoneOnly {
+		return now
+	}
+
+	spilled := now.lowZoneCapacity(co.zone, co.spilloverFraction)
+	if spilled != co.spilled {
+		label := fmt.Sprintf("%s.%s", co.spec.Namespace, co.spec.ServiceName)
+		if spilled {
+			glog.Infof("Zone %s of service %s is short of ready endpoints, spill over to other zones for client %s.", co.zone, label, co.clientAddr)
+			zoneSpilloverCounts.WithLabelValues(label, co.zone).Inc()
+		} else {
+			glog.Infof("Zone %s of service %s has recovered, stop spilling over for client %s.", co.zone, label, co.clientAddr)
+		}
+		co.spilled = spilled
+	}
+	if spilled {
+		return now
+	}
+	return now.inZone(co.zone)
+}
+
+// orderByZone moves the endpoints in the given zone ahead of the others,
+// keeping the ready endpoints ahead of the not ready ones.
+func orderByZone(eps *pb.ServiceEndpoints, now serviceEndpoints, zone string) {
+	local := func(ep *pb.InstanceEndpoint) bool {
+		v, ok := now[fmt.Sprintf("%s:%d", ep.Host, ep.Port)]
+		return ok && v.zone() == zone
+	}
+	ieps := eps.InstEndpoints
+	sort.SliceStable(ieps, func(i, j int) bool {
+		a, b := ieps[i], ieps[j]
+		if (a.Op == OpNotReady) != (b.Op == OpNotReady) {
+			return b.Op == OpNotReady
+		}
+		return local(a) && !local(b)
+	})
+}
@@ -0,0 +1,156 @@
+package hub
+
+import (
+	"testing"
+
+	. "github.com/smartystreets/goconvey/convey"
+	"golang.org/x/net/context"
+
+	pb "github.com/binchencoder/skylb-api/proto"
+)
+
+func newZoneEndpoint(ip, zone string, notReady bool) ServiceEndpoint {
+	return ServiceEndpoint{
+		IP:       ip,
+		Port:     port,
+		NotReady: notReady,
+		Metadata: map[string]string{ZoneMetadataKey: zone},
+	}
+}
+
+func TestLowZoneCapacity(t *testing.T) {
+	Convey("A zone is short of capacity below the fraction of its fair share", t, func() {
+		se := serviceEndpoints{
+			"192.168.1.1:8080": newZoneEndpoint("192.168.1.1", "a", false),
+			"192.168.1.2:8080": newZoneEndpoint("192.168.1.2", "a", true),
+			"192.168.1.3:8080": newZoneEndpoint("192.168.1.3", "b", false),
+			"192.168.1.4:8080": newZoneEndpoint("192.168.1.4", "b", false),
+			"192.168.1.5:8080": newZoneEndpoint("192.168.1.5", "b", false),
+		}
+		// The fair share of each zone is 2 ready endpoints.
+		So(se.lowZoneCapacity("a", 0.5), ShouldBeFalse)
+		So(se.lowZoneCapacity("a", 0.6), ShouldBeTrue)
+		So(se.lowZoneCapacity("b", 1), ShouldBeFalse)
+		So(se.lowZoneCapacity("c", 0.1), ShouldBeTrue)
+		So(serviceEndpoints{}.lowZoneCapacity("a", 0.5), ShouldBeFalse)
+	})
+}
+
+func TestOrderByZone(t *testing.T) {
+	Convey("Endpoints in the zone should go first, ready ones ahead", t, func() {
+		now := serviceEndpoints{
+			"192.168.1.1:8080": newZoneEndpoint("192.168.1.1", "b", false),
+			"192.168.1.2:8080": newZoneEndpoint("192.168.1.2", "a", true),
+			"192.168.1.3:8080": newZoneEndpoint("192.168.1.3", "b", true),
+			"192.168.1.4:8080": newZoneEndpoint("192.168.1.4", "a", false),
+		}
+		eps := snapshotEndpoints(&pb.ServiceSpec{}, now)
+		orderByZone(eps, now, "a")
+
+		hosts := []string{}
+		for _, ep := range eps.InstEndpoints {
+			hosts = append(hosts, ep.Host)
+		}
+		So(hosts, ShouldResemble, []string{"192.168.1.4", "192.168.1.1", "192.168.1.2", "192.168.1.3"})
+	})
+}
+
+func TestZoneOnlyObserver(t *testing.T) {
+	spec := &pb.ServiceSpec{
+		Namespace:   namespace,
+		ServiceName: serviceName,
+		PortName:    portName,
+	}
+
+	Convey("Zone-only observers spill over when their zone is short of capacity", t, func() {
+		eh := endpointsHub{
+			registry: NewMemRegistry(),
+			services: serviceMap{},
+		}
+		zone := func(z string) map[string]string {
+			return map[string]string{ZoneMetadataKey: z}
+		}
+		for _, ip := range []string{"192.168.1.1", "192.168.1.2"} {
+			So(eh.InsertEndpoint(spec, ip, port, 0, zone("a")), ShouldBeNil)
+		}
+		for _, ip := range []string{"192.168.1.3", "192.168.1.4", "192.168.1.5", "192.168.1.6"} {
+			So(eh.InsertEndpoint(spec, ip, port, 0, zone("b")), ShouldBeNil)
+		}
+		apply := func(so *serviceObject) {
+			eps, err := eh.fetchEndpoints(namespace, serviceName)
+			So(err, ShouldBeNil)
+			eh.applyEndpoints(so, eps)
+		}
+		ops := func(up *EndpointsUpdate) map[string]pb.Operation {
+			m := map[string]pb.Operation{}
+			for _, ep := range up.Endpoints.InstEndpoints {
+				m[ep.Host] = ep.Op
+			}
+			return m
+		}
+
+		so := newServiceObject(spec, nil)
+		ch := make(chan *EndpointsUpdate, 10)
+		so.addObserver(newClientObject(spec, "192.168.0.1:8000", newObserverQueue(ch), ObserverOptions{Zone: "a", ZoneOnly: true}, nil))
+		<-ch
+
+		apply(so)
+		So(ops(<-ch), ShouldResemble, map[string]pb.Operation{
+			"192.168.1.1": pb.Operation_Add,
+			"192.168.1.2": pb.Operation_Add,
+		})
+
+		Convey("Other zones should be added while the zone is short, and deleted after", func() {
+			// The fair share is 2.5 ready endpoints per zone, and half of
+			// it is more than the one left in the zone.
+			So(eh.registry.Delete(context.Background(), eh.calculateEndpointKey(namespace, serviceName, "192.168.1.2", port)), ShouldBeNil)
+			apply(so)
+			So(ops(<-ch), ShouldResemble, map[string]pb.Operation{
+				"192.168.1.2": pb.Operation_Delete,
+				"192.168.1.3": pb.Operation_Add,
+				"192.168.1.4": pb.Operation_Add,
+				"192.168.1.5": pb.Operation_Add,
+				"192.168.1.6": pb.Operation_Add,
+			})
+
+			So(eh.InsertEndpoint(spec, "192.168.1.2", port, 0, zone("a")), ShouldBeNil)
+			apply(so)
+			up := <-ch
+			// The endpoint of the zone goes first.
+			So(up.Endpoints.InstEndpoints[0].Host, ShouldEqual, "192.168.1.2")
+			So(ops(up), ShouldResemble, map[string]pb.Operation{
+				"192.168.1.2": pb.Operation_Add,
+				"192.168.1.3": pb.Operation_Delete,
+				"192.168.1.4": pb.Operation_Delete,
+				"192.168.1.5": pb.Operation_Delete,
+				"192.168.1.6": pb.Operation_Delete,
+			})
+		})
+	})
+}
+
+func TestOrderDeltaByZone(t *testing.T) {
+	Convey("Delta updates should send the endpoints in the zone first", t, func() {
+		last := serviceEndpoints{
+			"192.168.1.1:8080": newZoneEndpoint("192.168.1.1", "a", false),
+			"192.168.1.2:8080": newZoneEndpoint("192.168.1.2", "b", false),
+		}
+		now := serviceEndpoints{
+			"192.168.1.3:8080": newZoneEndpoint("192.168.1.3", "b", false),
+			"192.168.1.4:8080": newZoneEndpoint("192.168.1.4", "a", false),
+			"192.168.1.5:8080": newZoneEndpoint("192.168.1.5", "b", false),
+			"192.168.1.6:8080": newZoneEndpoint("192.168.1.6", "a", false),
+		}
+		// Map order varies from run to run, so diff a few times.
+		for i := 0; i < 10; i++ {
+			eps := diffEndpoints(&pb.ServiceSpec{}, last, now, false)
+			orderByZone(eps, now, "a")
+
+			hosts := []string{}
+			for _, ep := range eps.InstEndpoints {
+				hosts = append(hosts, ep.Host)
+			}
+			So(hosts, ShouldResemble, []string{"192.168.1.4", "192.168.1.6", "192.168.1.1", "192.168.1.2", "192.168.1.3", "192.168.1.5"})
+		}
+	})
+}
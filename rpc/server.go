@@ -6,11 +6,14 @@ import (
 	"flag"
 	"fmt"
 	"math/rand"
+	"strconv"
 	"strings"
 	"time"
 
 	"github.com/golang/glog"
 	prom "github.com/prometheus/client_golang/prometheus"
+	"golang.org/x/net/context"
+	"google.golang.org/grpc/metadata"
 	"google.golang.org/grpc/peer"
 
 	"github.com/binchencoder/skylb-api/lameduck"
@@ -18,6 +21,46 @@ import (
 	"github.com/binchencoder/skylb/hub"
 )
 
+const (
+	// includeNotReadyKey is the gRPC metadata key for clients of Resolve to
+	// opt in to receive not ready endpoints, marked with hub.OpNotReady.
+	includeNotReadyKey = "skylb-include-not-ready"
+
+	// weightUpdatesKey is the gRPC metadata key for clients of Resolve to
+	// opt in to receive weight changes marked with hub.OpWeight, see
+	// hub.ObserverOptions.WeightUpdates.
+	weightUpdatesKey = "skylb-weight-updates"
+
+	// endpointMetadataKeyPrefix is the prefix of the gRPC metadata keys for
+	// servers of ReportLoad to register endpoint metadata, e.g.
+	// "skylb-meta-version: 1.2.0" registers metadata "version".
+	endpointMetadataKeyPrefix = "skylb-meta-"
+
+	// selectorKeyPrefix is the prefix of the gRPC metadata keys for clients
+	// of Resolve to select endpoints of a service by their metadata with a
+	// label selector, e.g. "skylb-selector-default.echo: version=v2".
+	selectorKeyPrefix = "skylb-selector-"
+
+	// zoneKey is the gRPC metadata key of the zone where the client of
+	// Resolve or the server of ReportLoad lives. Servers register it as the
+	// endpoint metadata hub.ZoneMetadataKey.
+	zoneKey = "skylb-zone"
+
+	// zoneOnlyKey is the gRPC metadata key for clients of Resolve to opt in
+	// to receive only the endpoints in their zone, see
+	// hub.ObserverOptions.ZoneOnly.
+	zoneOnlyKey = "skylb-zone-only"
+
+	// subsetSizeKeyPrefix is the prefix of the gRPC metadata keys for
+	// clients of Resolve to receive only a subset of the endpoints of a
+	// service, e.g. "skylb-subset-size-default.echo: 10".
+	subsetSizeKeyPrefix = "skylb-subset-size-"
+
+	// clientIdKey is the gRPC metadata key of the client identity which the
+	// subsets are keyed on, see hub.ObserverOptions.ClientId.
+	clientIdKey = "skylb-client-id"
+)
+
 var (
 	flagNotifyTimeout      = flag.Duration("endpoints-notify-timeout", 10*time.Second, "The timeout to notify client endpoints update")
 	flagAutoDisconnTimeout = flag.Duration("auto-disconn-timeout", 5*time.Minute, "The timeout to automatically disconnect the resolve RPC")
@@ -156,7 +199,17 @@ func (ss *skylbServer) Resolve(req *pb.ResolveRequest, stream pb.Skylb_ResolveSe
 		}
 	}()
 
-	notiCh, err := ss.epsHub.AddObserver(req.Services, p.Addr.String(), req.ResolveFullEndpoints)
+	opts := hub.ObserverOptions{
+		ResolveFull:     req.ResolveFullEndpoints,
+		IncludeNotReady: metadataValue(stream.Context(), includeNotReadyKey) == "true",
+		WeightUpdates:   metadataValue(stream.Context(), weightUpdatesKey) == "true",
+		Selectors:       selectors(stream.Context(), req.Services),
+		Zone:            metadataValue(stream.Context(), zoneKey),
+		ZoneOnly:        metadataValue(stream.Context(), zoneOnlyKey) == "true",
+		SubsetSizes:     subsetSizes(stream.Context(), req.Services),
+		ClientId:        metadataValue(stream.Context(), clientIdKey),
+	}
+	notiCh, err := ss.epsHub.AddObserver(req.Services, p.Addr.String(), opts)
 	if err != nil {
 		for _, s := range req.Services {
 			label := fmt.Sprintf("%s.%s", s.Namespace, s.ServiceName)
@@ -181,7 +234,7 @@ func (ss *skylbServer) Resolve(req *pb.ResolveRequest, stream pb.Skylb_ResolveSe
 
 		label := fmt.Sprintf("%s.%s", spec.Namespace, spec.ServiceName)
 		activeObserverGauge.WithLabelValues(label).Inc()
-		glog.Infof("Registered caller service ID %d client %s to observe service %s.%s on port name %q", req.CallerServiceId, p.Addr.String(), spec.Namespace, spec.ServiceName, spec.PortName)
+		glog.Infof("Registered caller service ID %d client %s to observe service %s.%s on port name %q, selector %q", req.CallerServiceId, p.Addr.String(), spec.Namespace, spec.ServiceName, spec.PortName, opts.Selectors[label])
 	}
 
 	timer := time.NewTimer(*flagAutoDisconnTimeout + time.Duration(rand.Int63n(int64(*flagAutoDisconnTimeout))))
@@ -289,6 +342,8 @@ func (ss *skylbServer) ReportLoad(stream pb.Skylb_ReportLoadServer) error {
 		host = host[:pos]
 	}
 
+	md := endpointMetadata(stream.Context())
+
 	glog.Infof("Start accepting load report from %s.", host)
 	fmt.Printf("Start accepting load report from %s. \n", host)
 	activeReporterGauge.WithLabelValues(host).Inc()
@@ -322,7 +377,7 @@ func (ss *skylbServer) ReportLoad(stream pb.Skylb_ReportLoadServer) error {
 			// the weights are modified. If only the epsHub.UpsertEndpoint
 			// method is used, the weight level is not modified.
 			// purely Just to prevent this issue.
-			if err := ss.epsHub.InsertEndpoint(req.Spec, h, req.Port, req.Weight); err != nil {
+			if err := ss.epsHub.InsertEndpoint(req.Spec, h, req.Port, req.Weight, md); err != nil {
 				glog.Errorf("Failed to update etcd entry for endpoint %s:%d, closing the report stream.", h, req.Port)
 				return err
 			}
@@ -339,7 +394,7 @@ func (ss *skylbServer) ReportLoad(stream pb.Skylb_ReportLoadServer) error {
 		glog.V(4).Infof("Received load report from %s:%d.", h, req.Port)
 		fmt.Printf("Received load report from %s:%d. \n", h, req.Port)
 
-		if err := ss.epsHub.UpsertEndpoint(req.Spec, h, req.Port, req.Weight); err != nil {
+		if err := ss.epsHub.UpsertEndpoint(req.Spec, h, req.Port, req.Weight, md); err != nil {
 			glog.Errorf("Failed to update etcd entry for endpoint %s:%d, closing the report stream.", h, req.Port)
 			return err
 		}
@@ -351,10 +406,11 @@ func (ss *skylbServer) AttachForDiagnosis(stream pb.Skylb_AttachForDiagnosisServ
 	return nil
 }
 
-// NewSkylbServer creates and returns a new SkyLB gRPC server.
-func NewSkylbServer() pb.SkylbServer {
+// NewSkylbServer creates and returns a new SkyLB gRPC server backed by
+// the given registry.
+func NewSkylbServer(registry hub.Registry) pb.SkylbServer {
 	return &skylbServer{
-		epsHub: hub.Init(),
+		epsHub: hub.Init(registry),
 	}
 }
 
@@ -364,6 +420,97 @@ func opToString(op pb.Operation) string {
 		return "ADD"
 	case pb.Operation_Delete:
 		return "DELETE"
+	case hub.OpNotReady:
+		return "NOT_READY"
+	case hub.OpWeight:
+		return "WEIGHT"
+	}
+	return ""
+}
+
+// endpointMetadata returns the endpoint metadata which the server of
+// ReportLoad registers with gRPC metadata, including its zone, or nil if
+// none.
+func endpointMetadata(ctx context.Context) map[string]string {
+	md, ok := metadata.FromIncomingContext(ctx)
+	if !ok {
+		return nil
+	}
+	var em map[string]string
+	for k, vs := range md {
+		if !strings.HasPrefix(k, endpointMetadataKeyPrefix) || len(k) == len(endpointMetadataKeyPrefix) || len(vs) == 0 {
+			continue
+		}
+		if em == nil {
+			em = map[string]string{}
+		}
+		em[k[len(endpointMetadataKeyPrefix):]] = vs[len(vs)-1]
+	}
+	if zone := metadataValue(ctx, zoneKey); zone != "" {
+		if em == nil {
+			em = map[string]string{}
+		}
+		em[hub.ZoneMetadataKey] = zone
+	}
+	return em
+}
+
+// metadataValue returns the last value of the given gRPC metadata key, or
+// "" if none.
+func metadataValue(ctx context.Context, key string) string {
+	md, ok := metadata.FromIncomingContext(ctx)
+	if !ok {
+		return ""
+	}
+	if vs := md[key]; len(vs) > 0 {
+		return vs[len(vs)-1]
 	}
 	return ""
 }
+
+// selectors returns the label selectors which the client of Resolve sets
+// with gRPC metadata for the given service specs, keyed by
+// "namespace.service", or nil if none.
+func selectors(ctx context.Context, specs []*pb.ServiceSpec) map[string]string {
+	md, ok := metadata.FromIncomingContext(ctx)
+	if !ok {
+		return nil
+	}
+	var sels map[string]string
+	for _, spec := range specs {
+		label := fmt.Sprintf("%s.%s", spec.Namespace, spec.ServiceName)
+		vs := md[selectorKeyPrefix+strings.ToLower(label)]
+		if len(vs) == 0 || vs[len(vs)-1] == "" {
+			continue
+		}
+		if sels == nil {
+			sels = map[string]string{}
+		}
+		sels[label] = vs[len(vs)-1]
+	}
+	return sels
+}
+
+// subsetSizes returns the subset sizes which the client of Resolve sets
+// with gRPC metadata for the given service specs, keyed by
+// "namespace.service", or nil if none. Invalid sizes are ignored.
+func subsetSizes(ctx context.Context, specs []*pb.ServiceSpec) map[string]int {
+	var sizes map[string]int
+	for _, spec := range specs {
+		label := fmt.Sprintf("%s.%s", spec.Namespace, spec.ServiceName)
+		v := metadataValue(ctx, subsetSizeKeyPrefix+strings.ToLower(label))
+		if v == "" {
+			continue
+		}
+		size, err := strconv.Atoi(v)
+		if err != nil || size <= 0 {
+			glog.Warningf("Ignore invalid subset size %q of service %s.", v, label)
+			continue
+		}
+		if sizes == nil {
+			sizes = map[string]int{}
+		}
+		sizes[label] = size
+	}
+	return sizes
+}
@@ -22,8 +22,8 @@ type EndpointsHubMock struct {
 	mock.Mock
 }
 
-func (ephm *EndpointsHubMock) AddObserver(specs []*pb.ServiceSpec, clientAddr string, resolveFull bool) (<-chan *hub.EndpointsUpdate, error) {
-	args := ephm.Called(specs, clientAddr, resolveFull)
+func (ephm *EndpointsHubMock) AddObserver(specs []*pb.ServiceSpec, clientAddr string, opts hub.ObserverOptions) (<-chan *hub.EndpointsUpdate, error) {
+	args := ephm.Called(specs, clientAddr, opts)
 	if res, ok := args.Get(0).(chan *hub.EndpointsUpdate); ok {
 		return res, args.Error(1)
 	}
@@ -34,16 +34,21 @@ func (ephm *EndpointsHubMock) RemoveObserver(specs []*pb.ServiceSpec, clientAddr
 	ephm.Called(specs, clientAddr)
 }
 
-func (ephm *EndpointsHubMock) InsertEndpoint(spec *pb.ServiceSpec, host string, port, weight int32) error {
-	args := ephm.Called(spec, host, port, weight)
+func (ephm *EndpointsHubMock) InsertEndpoint(spec *pb.ServiceSpec, host string, port, weight int32, metadata map[string]string) error {
+	args := ephm.Called(spec, host, port, weight, metadata)
 	return args.Error(0)
 }
 
-func (ephm *EndpointsHubMock) UpsertEndpoint(spec *pb.ServiceSpec, host string, port, weight int32) error {
+func (ephm *EndpointsHubMock) UpdateEndpointWeight(spec *pb.ServiceSpec, host string, port, weight int32) error {
 	args := ephm.Called(spec, host, port, weight)
 	return args.Error(0)
 }
 
+func (ephm *EndpointsHubMock) UpsertEndpoint(spec *pb.ServiceSpec, host string, port, weight int32, metadata map[string]string) error {
+	args := ephm.Called(spec, host, port, weight, metadata)
+	return args.Error(0)
+}
+
 func (ephm *EndpointsHubMock) TrackServiceGraph(req *pb.ResolveRequest, callee *pb.ServiceSpec, callerAddr net.Addr) {
 	ephm.Called(req, callee, callerAddr)
 }
@@ -147,6 +152,7 @@ func TestOpToString(t *testing.T) {
 	for op, expected := range map[pb.Operation]string{
 		pb.Operation_Add:    "ADD",
 		pb.Operation_Delete: "DELETE",
+		hub.OpNotReady:      "NOT_READY",
 		pb.Operation(10000): "",
 	} {
 		str := opToString(op)
@@ -155,6 +161,86 @@ func TestOpToString(t *testing.T) {
 		}
 	}
 }
+
+func TestMetadataValue(t *testing.T) {
+	if v := metadataValue(context.Background(), includeNotReadyKey); v != "" {
+		t.Errorf("expect no value but got %q", v)
+	}
+
+	ctx := metadata.NewIncomingContext(context.Background(), metadata.Pairs(
+		includeNotReadyKey, "false",
+		includeNotReadyKey, "true",
+	))
+	if v := metadataValue(ctx, includeNotReadyKey); v != "true" {
+		t.Errorf("expect the last value true but got %q", v)
+	}
+}
+
+func TestEndpointMetadata(t *testing.T) {
+	if md := endpointMetadata(context.Background()); md != nil {
+		t.Errorf("expect no metadata but got %v", md)
+	}
+
+	ctx := metadata.NewIncomingContext(context.Background(), metadata.Pairs(
+		"skylb-meta-version", "1.2.0",
+		"skylb-meta-zone", "zone-a",
+		"skylb-meta-", "ignored",
+		"user-agent", "grpc-go",
+	))
+	md := endpointMetadata(ctx)
+	if len(md) != 2 || md["version"] != "1.2.0" || md["zone"] != "zone-a" {
+		t.Errorf("expect version and zone metadata but got %v", md)
+	}
+
+	ctx = metadata.NewIncomingContext(context.Background(), metadata.Pairs(
+		"skylb-meta-zone", "zone-a",
+		zoneKey, "zone-b",
+	))
+	if md := endpointMetadata(ctx); len(md) != 1 || md[hub.ZoneMetadataKey] != "zone-b" {
+		t.Errorf("expect zone-b from %s but got %v", zoneKey, md)
+	}
+}
+
+func TestSelectors(t *testing.T) {
+	specs := []*pb.ServiceSpec{
+		{Namespace: "default", ServiceName: "Echo-Service"},
+		{Namespace: "default", ServiceName: "other-service"},
+	}
+	if sels := selectors(context.Background(), specs); sels != nil {
+		t.Errorf("expect no selectors but got %v", sels)
+	}
+
+	ctx := metadata.NewIncomingContext(context.Background(), metadata.Pairs(
+		"skylb-selector-default.echo-service", "zone in (a,b)",
+		"skylb-selector-default.unknown", "version=v2",
+	))
+	sels := selectors(ctx, specs)
+	if len(sels) != 1 || sels["default.Echo-Service"] != "zone in (a,b)" {
+		t.Errorf("expect the selector of default.Echo-Service but got %v", sels)
+	}
+}
+
+func TestSubsetSizes(t *testing.T) {
+	specs := []*pb.ServiceSpec{
+		{Namespace: "default", ServiceName: "echo-service"},
+		{Namespace: "default", ServiceName: "other-service"},
+		{Namespace: "default", ServiceName: "third-service"},
+	}
+	if sizes := subsetSizes(context.Background(), specs); sizes != nil {
+		t.Errorf("expect no subset sizes but got %v", sizes)
+	}
+
+	ctx := metadata.NewIncomingContext(context.Background(), metadata.Pairs(
+		"skylb-subset-size-default.echo-service", "10",
+		"skylb-subset-size-default.other-service", "many",
+		"skylb-subset-size-default.third-service", "-1",
+	))
+	sizes := subsetSizes(ctx, specs)
+	if len(sizes) != 1 || sizes["default.echo-service"] != 10 {
+		t.Errorf("expect the subset size of default.echo-service but got %v", sizes)
+	}
+}
+
 func TestResolve(t *testing.T) {
 	spec := pb.ServiceSpec{
 		Namespace:   "default",
@@ -208,7 +294,7 @@ func TestResolve(t *testing.T) {
 	close(ch)
 	eh.On("TrackServiceGraph", &req, &spec, addr)
 	eh.On("UntrackServiceGraph", &req, &spec, addr)
-	eh.On("AddObserver", []*pb.ServiceSpec{&spec}, "192.168.0.101", true).Return(ch, nil)
+	eh.On("AddObserver", []*pb.ServiceSpec{&spec}, "192.168.0.101", hub.ObserverOptions{ResolveFull: true}).Return(ch, nil)
 	eh.On("RemoveObserver", []*pb.ServiceSpec{&spec}, "192.168.0.101")
 
 	err := s.Resolve(&req, stream)
@@ -270,7 +356,7 @@ func TestResolve_timeout(t *testing.T) {
 	}
 	eh.On("TrackServiceGraph", &req, &spec, addr)
 	eh.On("UntrackServiceGraph", &req, &spec, addr)
-	eh.On("AddObserver", []*pb.ServiceSpec{&spec}, "192.168.0.101", true).Return(ch, nil)
+	eh.On("AddObserver", []*pb.ServiceSpec{&spec}, "192.168.0.101", hub.ObserverOptions{ResolveFull: true}).Return(ch, nil)
 	eh.On("RemoveObserver", []*pb.ServiceSpec{&spec}, "192.168.0.101")
 
 	// Set a short timeout.
@@ -338,7 +424,7 @@ func TestResolve_errToSend(t *testing.T) {
 	}
 	eh.On("TrackServiceGraph", &req, &spec, addr)
 	eh.On("UntrackServiceGraph", &req, &spec, addr)
-	eh.On("AddObserver", []*pb.ServiceSpec{&spec}, "192.168.0.101", true).Return(ch, nil)
+	eh.On("AddObserver", []*pb.ServiceSpec{&spec}, "192.168.0.101", hub.ObserverOptions{ResolveFull: true}).Return(ch, nil)
 	eh.On("RemoveObserver", []*pb.ServiceSpec{&spec}, "192.168.0.101")
 
 	// Note that when error to send, the stream should be discarded,
@@ -372,8 +458,8 @@ func TestReportLoad(t *testing.T) {
 	stream.On("Recv").Once().Return(nil, quitErr)
 
 	eh := new(EndpointsHubMock)
-	eh.On("UpsertEndpoint", req.Spec, "192.168.0.101", req.Port, int32(0)).Return(nil)
-	eh.On("InsertEndpoint", req.Spec, "192.168.0.101", req.Port, int32(0)).Return(nil)
+	eh.On("UpsertEndpoint", req.Spec, "192.168.0.101", req.Port, int32(0), map[string]string(nil)).Return(nil)
+	eh.On("InsertEndpoint", req.Spec, "192.168.0.101", req.Port, int32(0), map[string]string(nil)).Return(nil)
 
 	s := &skylbServer{
 		epsHub: eh,